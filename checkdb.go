@@ -1,16 +1,97 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
 	_ "github.com/go-sql-driver/mysql"
 )
 
-func (a *app) checkDb() error {
-	db, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(127.0.0.1:3306)/%s",
-		a.conf.DbUser, a.conf.DbPassword, a.conf.DbName))
+// dbStatus is the result of a successful database health probe.
+type dbStatus struct {
+	Latency          time.Duration // time to connect, ping and run a trivial query
+	ThreadsRunning   int
+	ThreadsConnected int
+}
+
+// checkDb connects to the WordPress database, pings it, runs a cheap query and
+// reads the server's thread counters. The whole probe is bounded by a.dbTimeout,
+// so a wedged server is reported as an error rather than hanging the run.
+func (a *app) checkDb() (*dbStatus, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), a.dbTimeout)
+	defer cancel()
+
+	db, err := a.openDb()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	start := time.Now()
+	if err := db.PingContext(ctx); err != nil {
+		return nil, fmt.Errorf("ping: %w", err)
+	}
+	var one int
+	if err := db.QueryRowContext(ctx, "SELECT 1").Scan(&one); err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+	st := &dbStatus{Latency: time.Since(start)}
+
+	rows, err := db.QueryContext(ctx, "SHOW GLOBAL STATUS WHERE Variable_name IN ('Threads_running', 'Threads_connected')")
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("reading global status: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		n, _ := strconv.Atoi(value)
+		switch strings.ToLower(name) {
+		case "threads_running":
+			st.ThreadsRunning = n
+		case "threads_connected":
+			st.ThreadsConnected = n
+		}
+	}
+	return st, rows.Err()
+}
+
+// openDb opens the WordPress database.
+func (a *app) openDb() (*sql.DB, error) {
+	return sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(127.0.0.1:3306)/%s?timeout=%s",
+		a.conf.DbUser, a.conf.DbPassword, a.conf.DbName, a.dbTimeout))
+}
+
+// dbOverload returns a reason string if any database threshold is exceeded,
+// or "" if the database looks healthy. A zero threshold disables that check.
+func (a *app) dbOverload(st *dbStatus) string {
+	switch {
+	case a.maxDbLatency > 0 && st.Latency >= a.maxDbLatency:
+		return fmt.Sprintf("db latency %s", st.Latency.Round(time.Millisecond))
+	case a.maxThreadsRunning > 0 && st.ThreadsRunning >= a.maxThreadsRunning:
+		return fmt.Sprintf("db threads running %d", st.ThreadsRunning)
+	case a.maxThreadsConnected > 0 && st.ThreadsConnected >= a.maxThreadsConnected:
+		return fmt.Sprintf("db threads connected %d", st.ThreadsConnected)
+	}
+	return ""
+}
+
+// dbMetrics returns the metric values for a database probe. st is nil if the
+// probe failed.
+func dbMetrics(st *dbStatus) map[string]float64 {
+	if st == nil {
+		return map[string]float64{"db_up": 0}
+	}
+	return map[string]float64{
+		"db_up":                1,
+		"db_latency_ms":        float64(st.Latency.Microseconds()) / 1000,
+		"db_threads_running":   float64(st.ThreadsRunning),
+		"db_threads_connected": float64(st.ThreadsConnected),
 	}
-	return db.Close()
 }
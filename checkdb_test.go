@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDbOverload(t *testing.T) {
+	a := newTestApp()
+	a.maxDbLatency = time.Second
+	a.maxThreadsRunning = 20
+	a.maxThreadsConnected = 100
+	cases := []struct {
+		name string
+		st   dbStatus
+		want string
+	}{
+		{"healthy", dbStatus{Latency: 10 * time.Millisecond, ThreadsRunning: 2, ThreadsConnected: 10}, ""},
+		{"slow", dbStatus{Latency: 1500 * time.Millisecond}, "db latency 1.5s"},
+		{"busy", dbStatus{Latency: time.Millisecond, ThreadsRunning: 25}, "db threads running 25"},
+		{"saturated", dbStatus{Latency: time.Millisecond, ThreadsConnected: 100}, "db threads connected 100"},
+	}
+	for _, tc := range cases {
+		if got := a.dbOverload(&tc.st); got != tc.want {
+			t.Errorf("%s: dbOverload = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestDbOverload_ZeroThresholdsDisabled(t *testing.T) {
+	a := newTestApp()
+	st := &dbStatus{Latency: time.Hour, ThreadsRunning: 1000, ThreadsConnected: 1000}
+	if got := a.dbOverload(st); got != "" {
+		t.Errorf("dbOverload with no thresholds = %q, want \"\"", got)
+	}
+}
+
+func TestDbMetrics(t *testing.T) {
+	if m := dbMetrics(nil); m["db_up"] != 0 || len(m) != 1 {
+		t.Errorf("dbMetrics(nil) = %v, want only db_up=0", m)
+	}
+	m := dbMetrics(&dbStatus{Latency: 1500 * time.Microsecond, ThreadsRunning: 3, ThreadsConnected: 7})
+	if m["db_up"] != 1 || m["db_latency_ms"] != 1.5 || m["db_threads_running"] != 3 || m["db_threads_connected"] != 7 {
+		t.Errorf("dbMetrics = %v", m)
+	}
+}
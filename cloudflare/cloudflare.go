@@ -0,0 +1,169 @@
+// Package cloudflare is a small client for the parts of the Cloudflare API
+// used to manage WAF rules: zones, rulesets and their rules, and zone
+// settings. Every call takes a context, and API errors carry everything
+// Cloudflare reported.
+package cloudflare
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DefaultBaseURL is the Cloudflare API v4 endpoint.
+const DefaultBaseURL = "https://api.cloudflare.com/client/v4"
+
+// Client calls the Cloudflare API with an API token.
+type Client struct {
+	BaseURL    string       // DefaultBaseURL if empty
+	Token      string       // API token, sent as a bearer token
+	HTTPClient *http.Client // http.DefaultClient if nil
+}
+
+// New returns a client for the Cloudflare API using token.
+func New(token string) *Client {
+	return &Client{BaseURL: DefaultBaseURL, Token: token}
+}
+
+// URL builds an API URL by joining the base URL with the given path segments.
+func (c *Client) URL(segments ...string) string {
+	base := c.BaseURL
+	if base == "" {
+		base = DefaultBaseURL
+	}
+	u, err := url.JoinPath(base, segments...)
+	if err != nil {
+		panic(err) // only fires if BaseURL is malformed
+	}
+	return u
+}
+
+// NewRequest creates an HTTP request with Cloudflare authentication headers set.
+func (c *Client) NewRequest(ctx context.Context, method, endpoint string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// Error is one error reported in a Cloudflare response.
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e Error) Error() string {
+	return fmt.Sprintf("cloudflare error %d: %s", e.Code, e.Message)
+}
+
+// APIError is returned when Cloudflare rejects a request, with the HTTP status
+// and every error in the response.
+type APIError struct {
+	StatusCode int
+	Errors     []Error
+}
+
+func (e *APIError) Error() string {
+	if len(e.Errors) == 0 {
+		if e.StatusCode/100 == 2 {
+			return "cloudflare API returned success=false"
+		}
+		return fmt.Sprintf("HTTP %d", e.StatusCode)
+	}
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Unwrap returns the individual errors, so that errors.As can find an Error.
+func (e *APIError) Unwrap() []error {
+	errs := make([]error, len(e.Errors))
+	for i, err := range e.Errors {
+		errs[i] = err
+	}
+	return errs
+}
+
+// IsNotFound reports whether err is an APIError for a 404 response.
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// ResultInfo is the pagination information in a list response.
+type ResultInfo struct {
+	Page       int `json:"page"`
+	PerPage    int `json:"per_page"`
+	TotalPages int `json:"total_pages"`
+	Count      int `json:"count"`
+	TotalCount int `json:"total_count"`
+}
+
+// do sends a request with body, if not nil, encoded as JSON, and decodes the
+// result into dst and the pagination information into info, either of which
+// may be nil.
+func (c *Client) do(ctx context.Context, method, endpoint string, body, dst any, info *ResultInfo) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := c.NewRequest(ctx, method, endpoint, r)
+	if err != nil {
+		return err
+	}
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	return decode(resp, dst, info)
+}
+
+// decode reads a Cloudflare JSON envelope, decoding the result field into dst
+// and result_info into info. It returns an APIError if the status is non-2xx or
+// success is false; the errors in the body are decoded in either case.
+func decode(resp *http.Response, dst any, info *ResultInfo) error {
+	defer resp.Body.Close()
+	var env struct {
+		Success    bool        `json:"success"`
+		Errors     []Error     `json:"errors"`
+		Result     any         `json:"result"`
+		ResultInfo *ResultInfo `json:"result_info"`
+	}
+	env.ResultInfo = info
+	if dst != nil {
+		env.Result = dst
+	}
+	if resp.StatusCode/100 != 2 {
+		var errEnv struct {
+			Errors []Error `json:"errors"`
+		}
+		json.NewDecoder(resp.Body).Decode(&errEnv) // the body may not be JSON
+		return &APIError{StatusCode: resp.StatusCode, Errors: errEnv.Errors}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&env); err != nil {
+		return fmt.Errorf("HTTP %d: could not decode CF response - %w", resp.StatusCode, err)
+	}
+	if !env.Success {
+		return &APIError{StatusCode: resp.StatusCode, Errors: env.Errors}
+	}
+	return nil
+}
@@ -0,0 +1,268 @@
+package cloudflare
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// newTestClient returns a client for a server running handler.
+func newTestClient(t *testing.T, handler http.HandlerFunc) *Client {
+	t.Helper()
+	ts := httptest.NewServer(handler)
+	t.Cleanup(ts.Close)
+	return &Client{BaseURL: ts.URL, Token: "test-key", HTTPClient: ts.Client()}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// ---------------------------------------------------------------------------
+// NewRequest
+// ---------------------------------------------------------------------------
+
+func TestURL(t *testing.T) {
+	c := &Client{BaseURL: "https://api.cloudflare.com/client/v4"}
+	cases := []struct {
+		segments []string
+		want     string
+	}{
+		{[]string{"zones"}, "https://api.cloudflare.com/client/v4/zones"},
+		{[]string{"zones", "zoneID", "rulesets", "rulesetID"}, "https://api.cloudflare.com/client/v4/zones/zoneID/rulesets/rulesetID"},
+		{[]string{"zones", "zoneID", "rulesets", "rulesetID", "rules"}, "https://api.cloudflare.com/client/v4/zones/zoneID/rulesets/rulesetID/rules"},
+		{[]string{"zones", "zoneID", "rulesets", "rulesetID", "rules", "ruleID"}, "https://api.cloudflare.com/client/v4/zones/zoneID/rulesets/rulesetID/rules/ruleID"},
+	}
+	for _, tc := range cases {
+		if got := c.URL(tc.segments...); got != tc.want {
+			t.Errorf("URL(%v) = %q, want %q", tc.segments, got, tc.want)
+		}
+	}
+	if got := (&Client{}).URL("zones"); got != DefaultBaseURL+"/zones" {
+		t.Errorf("URL with no BaseURL = %q, want the default", got)
+	}
+}
+
+func TestNewRequest_SetsAuthHeader(t *testing.T) {
+	req, err := New("my-secret-key").NewRequest(context.Background(), "GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("NewRequest error: %v", err)
+	}
+	if got := req.Header.Get("Authorization"); got != "Bearer my-secret-key" {
+		t.Errorf("Authorization = %q, want %q", got, "Bearer my-secret-key")
+	}
+}
+
+func TestNewRequest_SetsContentType(t *testing.T) {
+	req, err := New("").NewRequest(context.Background(), "POST", "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("NewRequest error: %v", err)
+	}
+	if got := req.Header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+}
+
+func TestNewRequest_Methods(t *testing.T) {
+	c := New("")
+	for _, method := range []string{"GET", "POST", "PATCH", "DELETE"} {
+		req, err := c.NewRequest(context.Background(), method, "http://example.com", nil)
+		if err != nil {
+			t.Fatalf("NewRequest(%q) error: %v", method, err)
+		}
+		if req.Method != method {
+			t.Errorf("Method = %q, want %q", req.Method, method)
+		}
+	}
+}
+
+func TestNewRequest_InvalidURL(t *testing.T) {
+	if _, err := New("").NewRequest(context.Background(), "GET", "://bad-url", nil); err == nil {
+		t.Error("expected error for invalid URL, got nil")
+	}
+}
+
+func TestNewRequest_UsesContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request sent despite cancelled context")
+	})
+	if _, err := c.Ruleset(ctx, "z1", "rs1"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Ruleset error = %v, want context.Canceled", err)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Errors
+// ---------------------------------------------------------------------------
+
+func TestAPIError_DecodesErrorsOnFailureStatus(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusBadRequest, map[string]any{
+			"success": false,
+			"errors": []map[string]any{
+				{"code": 20217, "message": "ref must be unique"},
+				{"code": 20021, "message": "invalid expression"},
+			},
+		})
+	})
+	_, err := c.CreateRule(context.Background(), "z1", "rs1", Rule{Ref: "r"})
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("error = %v, want *APIError", err)
+	}
+	if apiErr.StatusCode != http.StatusBadRequest || len(apiErr.Errors) != 2 {
+		t.Errorf("APIError = %+v, want status 400 and both errors", apiErr)
+	}
+	want := "cloudflare error 20217: ref must be unique; cloudflare error 20021: invalid expression"
+	if err.Error() != want {
+		t.Errorf("Error() = %q, want %q", err.Error(), want)
+	}
+	var first Error
+	if !errors.As(err, &first) || first.Code != 20217 {
+		t.Errorf("errors.As(Error) = %+v, want the first error", first)
+	}
+}
+
+func TestAPIError_NonJSONBody(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+	})
+	err := c.DeleteRule(context.Background(), "z1", "rs1", "r1")
+	if err == nil || err.Error() != "HTTP 502" {
+		t.Errorf("error = %v, want HTTP 502", err)
+	}
+}
+
+func TestAPIError_SuccessFalse(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"success": false})
+	})
+	if _, err := c.SecurityLevel(context.Background(), "z1"); err == nil || !strings.Contains(err.Error(), "success=false") {
+		t.Errorf("error = %v, want success=false", err)
+	}
+}
+
+func TestIsNotFound(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusNotFound, map[string]any{"success": false, "errors": []map[string]any{{"code": 10003, "message": "not found"}}})
+	})
+	_, err := c.PhaseEntrypoint(context.Background(), "z1", "http_ratelimit")
+	if !IsNotFound(err) {
+		t.Errorf("IsNotFound(%v) = false, want true", err)
+	}
+	if IsNotFound(errors.New("other")) || IsNotFound(nil) {
+		t.Error("IsNotFound true for a non-API error")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Zones and rulesets
+// ---------------------------------------------------------------------------
+
+func TestListZones_FollowsPages(t *testing.T) {
+	var names []string
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		names = append(names, r.URL.Query().Get("name"))
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		writeJSON(w, http.StatusOK, map[string]any{
+			"success":     true,
+			"result":      []Zone{{ID: "z" + strconv.Itoa(page), Name: "example.com", Status: "active"}},
+			"result_info": ResultInfo{Page: page, PerPage: 1, TotalPages: 3},
+		})
+	})
+	zones, err := c.ListZones(context.Background(), "example.com")
+	if err != nil {
+		t.Fatalf("ListZones error: %v", err)
+	}
+	if len(zones) != 3 || zones[2].ID != "z3" {
+		t.Errorf("zones = %+v, want one from each of 3 pages", zones)
+	}
+	if len(names) != 3 || names[0] != "example.com" {
+		t.Errorf("name filters = %v", names)
+	}
+}
+
+func TestCreateRule_SendsTypedRule(t *testing.T) {
+	var body map[string]any
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/zones/z1/rulesets/rs1/rules" {
+			t.Errorf("%s %s", r.Method, r.URL.Path)
+		}
+		b, _ := io.ReadAll(r.Body)
+		json.Unmarshal(b, &body)
+		writeJSON(w, http.StatusOK, map[string]any{
+			"success": true,
+			"result":  Ruleset{ID: "rs1", Rules: []Rule{{ID: "new", Ref: "r", Action: "block"}}},
+		})
+	})
+	rule := Rule{
+		ID:         "ignored",
+		Ref:        "r",
+		Action:     "block",
+		Expression: "true",
+		Enabled:    true,
+		RateLimit:  &RateLimit{Characteristics: []string{"cf.colo.id", "ip.src"}, Period: 60, RequestsPerPeriod: 10, MitigationTimeout: 600},
+		Position:   First(),
+	}
+	rs, err := c.CreateRule(context.Background(), "z1", "rs1", rule)
+	if err != nil {
+		t.Fatalf("CreateRule error: %v", err)
+	}
+	if r := rs.Rule("new"); r == nil || r.Ref != "r" {
+		t.Errorf("ruleset = %+v", rs)
+	}
+	if _, ok := body["id"]; ok {
+		t.Error("rule ID sent on create")
+	}
+	if body["enabled"] != true || body["ref"] != "r" {
+		t.Errorf("body = %v", body)
+	}
+	if rl := body["ratelimit"].(map[string]any); rl["requests_per_period"] != 10.0 {
+		t.Errorf("ratelimit = %v", rl)
+	}
+	if pos := body["position"].(map[string]any); len(pos) != 1 || pos["before"] != "" {
+		t.Errorf("position = %v, want before the first rule", pos)
+	}
+}
+
+func TestPositionJSON(t *testing.T) {
+	cases := []struct {
+		pos  *Position
+		want string
+	}{
+		{First(), `{"before":""}`},
+		{Last(), `{"after":""}`},
+		{Before("r1"), `{"before":"r1"}`},
+		{After("r2"), `{"after":"r2"}`},
+	}
+	for _, tc := range cases {
+		b, _ := json.Marshal(tc.pos)
+		if string(b) != tc.want {
+			t.Errorf("position JSON = %s, want %s", b, tc.want)
+		}
+	}
+}
+
+func TestUpdatePhaseEntrypoint_SendsEmptyRules(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		if r.Method != http.MethodPut || string(b) != `{"rules":[]}` {
+			t.Errorf("%s body %s, want PUT with an empty rules list", r.Method, b)
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"success": true, "result": Ruleset{ID: "entry"}})
+	})
+	rs, err := c.UpdatePhaseEntrypoint(context.Background(), "z1", "http_ratelimit", nil)
+	if err != nil || rs.ID != "entry" {
+		t.Errorf("UpdatePhaseEntrypoint = %+v, %v", rs, err)
+	}
+}
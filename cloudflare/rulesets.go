@@ -0,0 +1,129 @@
+package cloudflare
+
+import (
+	"context"
+	"net/http"
+)
+
+// Ruleset is a zone ruleset, such as a phase entrypoint.
+type Ruleset struct {
+	ID    string `json:"id"`
+	Name  string `json:"name,omitempty"`
+	Kind  string `json:"kind,omitempty"`
+	Phase string `json:"phase,omitempty"`
+	Rules []Rule `json:"rules"`
+}
+
+// Rule finds the rule with the given ID, returning nil if there is none.
+func (rs *Ruleset) Rule(id string) *Rule {
+	for i := range rs.Rules {
+		if rs.Rules[i].ID == id {
+			return &rs.Rules[i]
+		}
+	}
+	return nil
+}
+
+// Rule is a rule in a ruleset. When creating or updating a rule, ID is
+// ignored and Position, if set, says where the rule goes.
+type Rule struct {
+	ID          string     `json:"id,omitempty"`
+	Ref         string     `json:"ref,omitempty"` // caller-chosen identifier, unique within the ruleset
+	Description string     `json:"description,omitempty"`
+	Expression  string     `json:"expression,omitempty"`
+	Action      string     `json:"action,omitempty"`
+	Enabled     bool       `json:"enabled"`
+	RateLimit   *RateLimit `json:"ratelimit,omitempty"`
+	Position    *Position  `json:"position,omitempty"`
+}
+
+// RateLimit holds the parameters of a rule in the http_ratelimit phase.
+type RateLimit struct {
+	Characteristics   []string `json:"characteristics"`
+	Period            int      `json:"period"`
+	RequestsPerPeriod int      `json:"requests_per_period"`
+	MitigationTimeout int      `json:"mitigation_timeout"`
+}
+
+// Position places a rule before or after the rule with the given ID. An
+// empty ID means the start or end of the ruleset; see First and Last.
+type Position struct {
+	Before *string `json:"before,omitempty"`
+	After  *string `json:"after,omitempty"`
+}
+
+// First places a rule at the start of its ruleset.
+func First() *Position { return Before("") }
+
+// Last places a rule at the end of its ruleset.
+func Last() *Position { return After("") }
+
+// Before places a rule immediately before the rule with ID id.
+func Before(id string) *Position { return &Position{Before: &id} }
+
+// After places a rule immediately after the rule with ID id.
+func After(id string) *Position { return &Position{After: &id} }
+
+// Ruleset returns a zone ruleset and its rules, in evaluation order.
+func (c *Client) Ruleset(ctx context.Context, zoneID, rulesetID string) (*Ruleset, error) {
+	var rs Ruleset
+	if err := c.do(ctx, http.MethodGet, c.URL("zones", zoneID, "rulesets", rulesetID), nil, &rs, nil); err != nil {
+		return nil, err
+	}
+	return &rs, nil
+}
+
+// PhaseEntrypoint returns the zone's entrypoint ruleset for phase, such as
+// "http_request_firewall_custom". If the zone has none the error satisfies
+// IsNotFound.
+func (c *Client) PhaseEntrypoint(ctx context.Context, zoneID, phase string) (*Ruleset, error) {
+	var rs Ruleset
+	if err := c.do(ctx, http.MethodGet, c.URL("zones", zoneID, "rulesets", "phases", phase, "entrypoint"), nil, &rs, nil); err != nil {
+		return nil, err
+	}
+	return &rs, nil
+}
+
+// UpdatePhaseEntrypoint replaces the rules of the zone's entrypoint ruleset
+// for phase, creating the ruleset if it does not exist.
+func (c *Client) UpdatePhaseEntrypoint(ctx context.Context, zoneID, phase string, rules []Rule) (*Ruleset, error) {
+	if rules == nil {
+		rules = []Rule{}
+	}
+	body := struct {
+		Rules []Rule `json:"rules"`
+	}{rules}
+	var rs Ruleset
+	if err := c.do(ctx, http.MethodPut, c.URL("zones", zoneID, "rulesets", "phases", phase, "entrypoint"), body, &rs, nil); err != nil {
+		return nil, err
+	}
+	return &rs, nil
+}
+
+// CreateRule adds r to a ruleset, at the end unless r.Position says
+// otherwise, and returns the updated ruleset.
+func (c *Client) CreateRule(ctx context.Context, zoneID, rulesetID string, r Rule) (*Ruleset, error) {
+	r.ID = ""
+	var rs Ruleset
+	if err := c.do(ctx, http.MethodPost, c.URL("zones", zoneID, "rulesets", rulesetID, "rules"), r, &rs, nil); err != nil {
+		return nil, err
+	}
+	return &rs, nil
+}
+
+// UpdateRule updates rule ruleID in place with the fields set in r, keeping
+// its ID and, unless r.Position is set, its position. It returns the updated
+// ruleset.
+func (c *Client) UpdateRule(ctx context.Context, zoneID, rulesetID, ruleID string, r Rule) (*Ruleset, error) {
+	r.ID = ""
+	var rs Ruleset
+	if err := c.do(ctx, http.MethodPatch, c.URL("zones", zoneID, "rulesets", rulesetID, "rules", ruleID), r, &rs, nil); err != nil {
+		return nil, err
+	}
+	return &rs, nil
+}
+
+// DeleteRule removes rule ruleID from a ruleset.
+func (c *Client) DeleteRule(ctx context.Context, zoneID, rulesetID, ruleID string) error {
+	return c.do(ctx, http.MethodDelete, c.URL("zones", zoneID, "rulesets", rulesetID, "rules", ruleID), nil, nil, nil)
+}
@@ -0,0 +1,54 @@
+package cloudflare
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Zone is a Cloudflare zone.
+type Zone struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Status string `json:"status"` // e.g. "active" or "pending"
+}
+
+// ListZones returns the zones the token can see, following pagination. If
+// name is not empty only zones with that name are returned; there may be
+// several, in different accounts.
+func (c *Client) ListZones(ctx context.Context, name string) ([]Zone, error) {
+	var zones []Zone
+	for page := 1; ; page++ {
+		q := url.Values{"page": {strconv.Itoa(page)}, "per_page": {"50"}}
+		if name != "" {
+			q.Set("name", name)
+		}
+		var batch []Zone
+		var info ResultInfo
+		if err := c.do(ctx, http.MethodGet, c.URL("zones")+"?"+q.Encode(), nil, &batch, &info); err != nil {
+			return nil, err
+		}
+		zones = append(zones, batch...)
+		if len(batch) == 0 || page >= info.TotalPages {
+			return zones, nil
+		}
+	}
+}
+
+// SecurityLevel returns the zone's security_level setting, e.g. "medium".
+func (c *Client) SecurityLevel(ctx context.Context, zoneID string) (string, error) {
+	var setting struct {
+		Value string `json:"value"`
+	}
+	if err := c.do(ctx, http.MethodGet, c.URL("zones", zoneID, "settings", "security_level"), nil, &setting, nil); err != nil {
+		return "", err
+	}
+	return setting.Value, nil
+}
+
+// SetSecurityLevel changes the zone's security_level setting.
+func (c *Client) SetSecurityLevel(ctx context.Context, zoneID, level string) error {
+	body := map[string]string{"value": level}
+	return c.do(ctx, http.MethodPatch, c.URL("zones", zoneID, "settings", "security_level"), body, nil, nil)
+}
@@ -23,6 +23,12 @@ func TestParseLogEntry(t *testing.T) {
 				Enabled: false,
 			},
 		},
+		{
+			line: "2026/04/19 03:00:00 INFO rule state enabled=true window=crawler",
+			wantEntry: &LogEntry{
+				Enabled: true,
+			},
+		},
 		{
 			line:      "2026/04/20 10:02:00 DEBUG pushMetrics metrics=...",
 			wantEntry: nil,
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// cpuCount returns the number of CPUs available to this host or container:
+// the processor count from cpuinfoFile, capped by the cgroup v2 CPU quota in
+// cpuMaxFile if one is set. A missing cpuMaxFile is not an error.
+func cpuCount(cpuinfoFile, cpuMaxFile string) (float64, error) {
+	text, err := os.ReadFile(cpuinfoFile)
+	if err != nil {
+		return 0, err
+	}
+	n := countProcessors(string(text))
+	if n == 0 {
+		return 0, fmt.Errorf("%s: no processors found", cpuinfoFile)
+	}
+	cpus := float64(n)
+
+	text, err = os.ReadFile(cpuMaxFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return cpus, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	quota, ok, err := cpuQuota(string(text))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", cpuMaxFile, err)
+	}
+	if ok && quota < cpus {
+		cpus = quota
+	}
+	return cpus, nil
+}
+
+// countProcessors counts the "processor" entries in the contents of /proc/cpuinfo.
+func countProcessors(text string) int {
+	n := 0
+	for _, line := range strings.Split(text, "\n") {
+		key, _, ok := strings.Cut(line, ":")
+		if ok && strings.TrimSpace(key) == "processor" {
+			n++
+		}
+	}
+	return n
+}
+
+// cpuQuota parses a cgroup v2 cpu.max file ("$MAX $PERIOD") and returns the
+// quota as a number of CPUs. ok is false if the quota is unlimited ("max").
+func cpuQuota(text string) (cpus float64, ok bool, err error) {
+	fields := strings.Fields(text)
+	if len(fields) != 2 {
+		return 0, false, fmt.Errorf("malformed cpu.max %q", strings.TrimSpace(text))
+	}
+	if fields[0] == "max" {
+		return 0, false, nil
+	}
+	quota, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, false, err
+	}
+	period, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return 0, false, err
+	}
+	if quota <= 0 || period <= 0 {
+		return 0, false, fmt.Errorf("malformed cpu.max %q", strings.TrimSpace(text))
+	}
+	return quota / period, true, nil
+}
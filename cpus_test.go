@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func cpuinfoFixture(n int) string {
+	var b strings.Builder
+	for i := range n {
+		b.WriteString("processor\t: " + string(rune('0'+i)) + "\nmodel name\t: Test CPU\n\n")
+	}
+	return b.String()
+}
+
+func TestCountProcessors(t *testing.T) {
+	if got := countProcessors(cpuinfoFixture(4)); got != 4 {
+		t.Errorf("countProcessors = %d, want 4", got)
+	}
+	if got := countProcessors(""); got != 0 {
+		t.Errorf("countProcessors(\"\") = %d, want 0", got)
+	}
+}
+
+func TestCPUQuota(t *testing.T) {
+	cases := []struct {
+		in     string
+		want   float64
+		wantOK bool
+	}{
+		{"max 100000\n", 0, false},
+		{"200000 100000\n", 2, true},
+		{"150000 100000", 1.5, true},
+	}
+	for _, tc := range cases {
+		got, ok, err := cpuQuota(tc.in)
+		if err != nil {
+			t.Errorf("cpuQuota(%q) error: %v", tc.in, err)
+			continue
+		}
+		if got != tc.want || ok != tc.wantOK {
+			t.Errorf("cpuQuota(%q) = %v, %v, want %v, %v", tc.in, got, ok, tc.want, tc.wantOK)
+		}
+	}
+	for _, in := range []string{"", "100000", "x 100000", "0 100000"} {
+		if _, _, err := cpuQuota(in); err == nil {
+			t.Errorf("cpuQuota(%q): expected error, got nil", in)
+		}
+	}
+}
+
+func TestCPUCount(t *testing.T) {
+	cpuinfo := writeTempLoadFile(t, cpuinfoFixture(8))
+	if got, err := cpuCount(cpuinfo, filepath.Join(t.TempDir(), "missing")); err != nil || got != 8 {
+		t.Errorf("cpuCount without quota = %v, %v, want 8", got, err)
+	}
+	if got, err := cpuCount(cpuinfo, writeTempLoadFile(t, "250000 100000")); err != nil || got != 2.5 {
+		t.Errorf("cpuCount with quota = %v, %v, want 2.5", got, err)
+	}
+	if got, err := cpuCount(cpuinfo, writeTempLoadFile(t, "max 100000")); err != nil || got != 8 {
+		t.Errorf("cpuCount with unlimited quota = %v, %v, want 8", got, err)
+	}
+}
+
+func TestLoadSignal_PerCPU(t *testing.T) {
+	a := newTestApp()
+	a.loadFile = writeTempLoadFile(t, "6.00 5.00 4.00 1/100 1")
+	a.cpuinfoFile = writeTempLoadFile(t, cpuinfoFixture(4))
+	a.cpuMaxFile = filepath.Join(t.TempDir(), "missing")
+	a.perCPU = true
+	a.maxLoad = 2
+	a.minLoad = 0.5
+	s, err := newLoadSignal(a, json.RawMessage(`{}`))
+	if err != nil {
+		t.Fatalf("newLoadSignal error: %v", err)
+	}
+	ls := s.(*loadSignal)
+	if ls.Max != 8 || ls.Min != 2 {
+		t.Errorf("effective thresholds = %v/%v, want 8/2", ls.Max, ls.Min)
+	}
+	r, err := s.Sample()
+	if err != nil {
+		t.Fatalf("Sample error: %v", err)
+	}
+	if r.Verdict != Neutral {
+		t.Errorf("verdict = %v, want neutral for load 6 on 4 CPUs", r.Verdict)
+	}
+	if r.Metrics["load_per_cpu"] != 1.5 {
+		t.Errorf("load_per_cpu = %v, want 1.5", r.Metrics["load_per_cpu"])
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// runDaemon samples signals every a.interval until ctx is cancelled. The zone
+// ID, signals and rule state are kept in memory between samples, so Cloudflare
+// is only called when the rule needs to change or the cached rule expires.
+// Metrics are batched and pushed every a.metricsInterval, which is also when
+// the rule state is logged for the blocked tool.
+func (a *app) runDaemon(ctx context.Context) {
+	slog.Info("starting daemon", "interval", a.interval, "metricsInterval", a.metricsInterval)
+	sampleTick := time.NewTicker(a.interval)
+	defer sampleTick.Stop()
+	pushTick := time.NewTicker(a.metricsInterval)
+	defer pushTick.Stop()
+
+	enabled := a.check()
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("shutting down", "reason", context.Cause(ctx))
+			a.flushMetrics()
+			a.notifications.wait(notifyWait)
+			return
+		case <-sampleTick.C:
+			enabled = a.check()
+		case <-pushTick.C:
+			slog.Info("rule state", append([]any{"enabled", enabled}, a.windowAttrs(time.Now())...)...)
+			a.flushMetrics()
+		}
+	}
+}
+
+// check runs one sample in daemon mode. Errors are logged rather than fatal,
+// and the cached rules are discarded so the next sample looks them up afresh.
+func (a *app) check() bool {
+	enabled, err := a.runOnce()
+	if err != nil {
+		slog.Error("check failed", "err", err)
+		for _, z := range a.zones {
+			z.forgetRule()
+		}
+	}
+	return enabled
+}
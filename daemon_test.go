@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingTransport counts requests by method.
+type countingTransport struct {
+	mu     sync.Mutex
+	counts map[string]int
+	base   http.RoundTripper
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	c.counts[req.Method]++
+	c.mu.Unlock()
+	return c.base.RoundTrip(req)
+}
+
+func (c *countingTransport) count(method string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[method]
+}
+
+func TestRunDaemon_CallsCloudflareOnlyOnTransitions(t *testing.T) {
+	ts, rules := rulesetServer(t, "zd1", "rs1", nil)
+	a := newDoItApp(t, ts, "10.00 8.00 6.00 5/200 12345", "zd1", "rs1")
+	ct := &countingTransport{counts: map[string]int{}, base: ts.Client().Transport}
+	a.client = &http.Client{Transport: ct}
+	a.daemon = true
+	a.interval = 5 * time.Millisecond
+	a.metricsInterval = time.Hour
+	a.ruleRefresh = time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	a.runDaemon(ctx)
+
+	if len(*rules) != 1 {
+		t.Fatalf("expected 1 rule, got %d", len(*rules))
+	}
+	if got := ct.count(http.MethodGet); got != 1 {
+		t.Errorf("GET requests = %d, want 1 (rule lookup cached)", got)
+	}
+	if got := ct.count(http.MethodPost); got != 1 {
+		t.Errorf("POST requests = %d, want 1", got)
+	}
+}
+
+func TestRunDaemon_BatchesMetrics(t *testing.T) {
+	var mu sync.Mutex
+	var pushes, points int
+	metricsSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			ResourceMetrics []struct {
+				ScopeMetrics []struct {
+					Metrics []struct {
+						Name  string
+						Gauge struct{ DataPoints []any }
+					}
+				}
+			}
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		defer mu.Unlock()
+		pushes++
+		for _, m := range body.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+			if m.Name == "load_average" {
+				points += len(m.Gauge.DataPoints)
+			}
+		}
+	}))
+	defer metricsSrv.Close()
+
+	ts, _ := rulesetServer(t, "zd2", "rs1", nil)
+	a := newDoItApp(t, ts, "2.00 1.50 1.20 3/100 12345", "zd2", "rs1")
+	a.conf.MetricsURL = metricsSrv.URL
+	a.daemon = true
+	a.interval = 5 * time.Millisecond
+	a.metricsInterval = time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	a.runDaemon(ctx)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if pushes != 1 {
+		t.Errorf("metric pushes = %d, want 1 batched push at shutdown", pushes)
+	}
+	if points < 2 {
+		t.Errorf("load_average data points = %d, want one per sample", points)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Ways of matching an exempted date in the request path, selected by -dateMatch.
+const (
+	dateContains = "contains" // the date appears anywhere in the path, e.g. /articles/19-04-2026/slug
+	datePrefix   = "prefix"   // the path starts with the date, e.g. /2026/04/19/slug
+)
+
+// dateUnit is the granularity of one segment of a date format.
+type dateUnit int
+
+const (
+	unitDay dateUnit = iota
+	unitMonth
+	unitYear
+)
+
+// dateLevels splits a slash-separated date format into progressively coarser
+// formats, so that "2006/01/02" gives "2006/01/02", "2006/01" and "2006". Only
+// trailing day, month and year segments are peeled off, in that order; a
+// format without slashes has a single level.
+func dateLevels(format string) (formats []string, units []dateUnit) {
+	segs := strings.Split(format, "/")
+	unit, ok := segmentUnit(segs[len(segs)-1])
+	if !ok {
+		return []string{format}, []dateUnit{unitDay}
+	}
+	formats, units = []string{format}, []dateUnit{unit}
+	for len(segs) > 1 {
+		parent, ok := segmentUnit(segs[len(segs)-2])
+		if !ok || parent != unit+1 {
+			break
+		}
+		segs = segs[:len(segs)-1]
+		unit = parent
+		formats = append(formats, strings.Join(segs, "/"))
+		units = append(units, unit)
+	}
+	return formats, units
+}
+
+// segmentUnit returns the unit of a date format segment such as "02" or "2006".
+func segmentUnit(seg string) (dateUnit, bool) {
+	switch seg {
+	case "02", "_2", "2":
+		return unitDay, true
+	case "01", "1":
+		return unitMonth, true
+	case "2006":
+		return unitYear, true
+	}
+	return 0, false
+}
+
+// datePaths returns the path fragments exempting articles dated from tomorrow,
+// to allow for timezones, back to days-2 days before now. Where the format has
+// slash-separated day, month and year segments, a month or year that the window
+// covers completely is exempted by its shorter prefix instead of day by day.
+// Each fragment is the formatted date wrapped in slashes, e.g. "/2026/04/".
+func datePaths(now time.Time, days int, format string) []string {
+	if days <= 0 {
+		return nil
+	}
+	window := map[string]bool{}
+	var dates []time.Time
+	for i := range days {
+		d := now.AddDate(0, 0, 1-i)
+		dates = append(dates, d)
+		window[d.Format(time.DateOnly)] = true
+	}
+	covered := func(t time.Time, unit dateUnit) bool {
+		var start, end time.Time
+		switch unit {
+		case unitMonth:
+			start = time.Date(t.Year(), t.Month(), 1, 12, 0, 0, 0, t.Location())
+			end = start.AddDate(0, 1, 0)
+		case unitYear:
+			start = time.Date(t.Year(), 1, 1, 12, 0, 0, 0, t.Location())
+			end = start.AddDate(1, 0, 0)
+		default:
+			return window[t.Format(time.DateOnly)]
+		}
+		for d := start; d.Before(end); d = d.AddDate(0, 0, 1) {
+			if !window[d.Format(time.DateOnly)] {
+				return false
+			}
+		}
+		return true
+	}
+
+	formats, units := dateLevels(format)
+	var paths []string
+	for _, d := range dates {
+		level := 0
+		for l := len(formats) - 1; l > 0; l-- {
+			if covered(d, units[l]) {
+				level = l
+				break
+			}
+		}
+		p := "/" + d.Format(formats[level]) + "/"
+		if !slices.Contains(paths, p) {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// dateClause returns the expression matching paths that contain the date path p.
+func (a *app) dateClause(p string) (string, error) {
+	switch a.dateMatch {
+	case "", dateContains:
+		return "http.request.uri.path contains " + quoteExpr(p), nil
+	case datePrefix:
+		return fmt.Sprintf("starts_with(http.request.uri.path, %s)", quoteExpr(p)), nil
+	}
+	return "", fmt.Errorf("unknown date match %q, want %s or %s", a.dateMatch, dateContains, datePrefix)
+}
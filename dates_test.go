@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func day(s string) time.Time {
+	t, err := time.ParseInLocation(time.DateOnly, s, time.Local)
+	if err != nil {
+		panic(err)
+	}
+	return t.Add(12 * time.Hour)
+}
+
+func TestDateLevels(t *testing.T) {
+	for _, tc := range []struct {
+		format string
+		want   []string
+	}{
+		{"02-01-2006", []string{"02-01-2006"}},
+		{"2006/01/02", []string{"2006/01/02", "2006/01", "2006"}},
+		{"2006/01", []string{"2006/01", "2006"}},
+		{"blog/2006/1/2", []string{"blog/2006/1/2", "blog/2006/1", "blog/2006"}},
+		{"02/01/2006", []string{"02/01/2006"}},
+	} {
+		if got, _ := dateLevels(tc.format); !slices.Equal(got, tc.want) {
+			t.Errorf("dateLevels(%q) = %q, want %q", tc.format, got, tc.want)
+		}
+	}
+}
+
+func TestDatePaths_DayByDay(t *testing.T) {
+	got := datePaths(day("2026-04-19"), 3, "2006/01/02")
+	want := []string{"/2026/04/20/", "/2026/04/19/", "/2026/04/18/"}
+	if !slices.Equal(got, want) {
+		t.Errorf("datePaths = %q, want %q", got, want)
+	}
+}
+
+func TestDatePaths_CollapsesWholeMonth(t *testing.T) {
+	// Tomorrow is 2026-05-02; the window runs back to 2026-03-30, covering
+	// all of April.
+	got := datePaths(day("2026-05-01"), 34, "2006/01/02")
+	want := []string{"/2026/05/02/", "/2026/05/01/", "/2026/04/", "/2026/03/31/", "/2026/03/30/"}
+	if !slices.Equal(got, want) {
+		t.Errorf("datePaths = %q, want %q", got, want)
+	}
+}
+
+func TestDatePaths_PartialMonthNotCollapsed(t *testing.T) {
+	got := datePaths(day("2026-04-28"), 30, "2006/01/02") // 2026-03-31 to 2026-04-29
+	for _, p := range got {
+		if p == "/2026/04/" {
+			t.Errorf("datePaths collapsed April, which the window does not fully cover: %q", got)
+		}
+	}
+	if len(got) != 30 {
+		t.Errorf("datePaths returned %d paths, want 30", len(got))
+	}
+}
+
+func TestDatePaths_MonthGranular(t *testing.T) {
+	got := datePaths(day("2026-05-03"), 9, "2006/01")
+	want := []string{"/2026/05/", "/2026/04/"}
+	if !slices.Equal(got, want) {
+		t.Errorf("datePaths = %q, want %q", got, want)
+	}
+}
+
+func TestDatePaths_CollapsesWholeYear(t *testing.T) {
+	got := datePaths(day("2026-01-01"), 368, "2006/01")
+	if !slices.Contains(got, "/2025/") {
+		t.Errorf("datePaths = %q, want 2025 collapsed to a single prefix", got)
+	}
+	if slices.Contains(got, "/2025/06/") {
+		t.Errorf("datePaths = %q, should not list months of a collapsed year", got)
+	}
+}
+
+func TestDatePaths_NoDays(t *testing.T) {
+	if got := datePaths(day("2026-04-19"), 0, "2006/01/02"); got != nil {
+		t.Errorf("datePaths = %q, want none", got)
+	}
+}
+
+func TestBuildExpression_PrefixDates(t *testing.T) {
+	a := newApp()
+	a.dateFormat = "2006/01/02"
+	a.dateMatch = datePrefix
+	expr := mustBuildExpression(t, a)
+	for i := range 9 {
+		d := time.Now().AddDate(0, 0, 1-i).Format("2006/01/02")
+		want := fmt.Sprintf(`starts_with(http.request.uri.path, "/%s/")`, d)
+		if !strings.Contains(expr, want) {
+			t.Errorf("expression missing %s", want)
+		}
+	}
+	if strings.Contains(expr, `contains "/20`) {
+		t.Errorf("prefix mode should not use contains for dates: %s", expr)
+	}
+}
+
+func TestBuildExpression_MonthGranularDates(t *testing.T) {
+	a := newApp()
+	a.dateFormat = "2006/01"
+	expr := mustBuildExpression(t, a)
+	month := time.Now().Format("2006/01")
+	if n := strings.Count(expr, `"/`+month+`/"`); n != 1 {
+		t.Errorf("expression exempts %s %d times, want once: %s", month, n, expr)
+	}
+}
+
+func TestBuildExpression_UnknownDateMatch(t *testing.T) {
+	a := newApp()
+	a.dateMatch = "suffix"
+	if _, err := a.buildExpression(); err == nil {
+		t.Error("expected error for unknown -dateMatch")
+	}
+}
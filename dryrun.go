@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"text/tabwriter"
+)
+
+// plan is what a dry run would do, built up as the run goes: the readings,
+// each zone's decision, and the changes that would have been made in
+// Cloudflare. A nil *plan records nothing, so callers need not check for it.
+type plan struct {
+	Signals []readingReport `json:"signals"`
+	Zones   []*zonePlan     `json:"zones"`
+	Error   string          `json:"error,omitempty"`
+}
+
+type readingReport struct {
+	Signal  string             `json:"signal"`
+	Verdict string             `json:"verdict"`
+	Reason  string             `json:"reason,omitempty"`
+	Metrics map[string]float64 `json:"metrics,omitempty"`
+	Error   string             `json:"error,omitempty"`
+}
+
+// zonePlan is the decision and planned changes for one zone.
+type zonePlan struct {
+	Zone              string          `json:"zone"`
+	Decision          string          `json:"decision"` // enable, disable or none
+	Reason            string          `json:"reason,omitempty"`
+	Changes           []plannedChange `json:"changes"`
+	CurrentExpression string          `json:"currentExpression,omitempty"` // of the rule in Cloudflare, if any
+	Expression        string          `json:"expression,omitempty"`        // as buildExpression would produce it
+	Diff              []string        `json:"diff,omitempty"`              // see exprDiff
+}
+
+// plannedChange is a Cloudflare request that a dry run did not make.
+type plannedChange struct {
+	Action     string `json:"action"` // create_rule, update_rule, delete_rule, create_entrypoint or set_security_level
+	Ruleset    string `json:"ruleset,omitempty"`
+	RuleID     string `json:"ruleId,omitempty"`
+	Rule       string `json:"rule,omitempty"` // the rule's description
+	RuleAction string `json:"ruleAction,omitempty"`
+	Value      string `json:"value,omitempty"` // the phase or security level
+}
+
+// plannedRuleset stands in for the ID of an entrypoint ruleset that a dry run
+// would have created.
+const plannedRuleset = "(new ruleset)"
+
+// setReadings records the signal readings.
+func (p *plan) setReadings(readings []Reading) {
+	if p == nil {
+		return
+	}
+	p.Signals = reportReadings(readings)
+}
+
+// reportReadings summarises readings for output and the state file.
+func reportReadings(readings []Reading) []readingReport {
+	var reports []readingReport
+	for _, r := range readings {
+		rr := readingReport{Signal: r.Signal, Verdict: r.Verdict.String(), Reason: r.Reason, Metrics: r.Metrics}
+		if r.Err != nil {
+			rr.Error = r.Err.Error()
+		}
+		reports = append(reports, rr)
+	}
+	return reports
+}
+
+// zone returns the plan for domain, adding it if necessary.
+func (p *plan) zone(domain string) *zonePlan {
+	for _, z := range p.Zones {
+		if z.Zone == domain {
+			return z
+		}
+	}
+	z := &zonePlan{Zone: domain, Decision: "none", Changes: []plannedChange{}}
+	p.Zones = append(p.Zones, z)
+	return z
+}
+
+// decide records the verdict reached for domain after hysteresis.
+func (p *plan) decide(domain string, verdict Verdict, reason string) {
+	if p == nil {
+		return
+	}
+	z := p.zone(domain)
+	switch verdict {
+	case Overload:
+		z.Decision = "enable"
+	case Recovered:
+		z.Decision = "disable"
+	default:
+		z.Decision = "none"
+	}
+	z.Reason = reason
+}
+
+// change records a change that was not made in domain. Repeats are ignored.
+func (p *plan) change(domain string, c plannedChange) {
+	if p == nil {
+		return
+	}
+	z := p.zone(domain)
+	if !slices.Contains(z.Changes, c) {
+		z.Changes = append(z.Changes, c)
+	}
+}
+
+// readOnlyTransport refuses every request that could change anything, as a
+// backstop for dry runs.
+type readOnlyTransport struct {
+	base http.RoundTripper
+}
+
+func (t readOnlyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return nil, fmt.Errorf("dry run: refusing %s %s", req.Method, req.URL.Redacted())
+	}
+	return t.base.RoundTrip(req)
+}
+
+// planOnce runs one check without changing anything, and writes what it
+// would have done to w, as JSON if asJSON is set. State is not saved and
+// metrics are not pushed.
+func (a *app) planOnce(w io.Writer, asJSON bool) error {
+	_, err := a.runOnce()
+	if err != nil {
+		a.plan.Error = err.Error()
+	}
+	for _, z := range a.zones {
+		zp := a.plan.zone(z.conf.Domain)
+		if eerr := z.planExpression(zp); eerr != nil {
+			err = errors.Join(err, fmt.Errorf("%s: %w", z.conf.Domain, eerr))
+		}
+	}
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if werr := enc.Encode(a.plan); werr != nil {
+			return werr
+		}
+	} else if werr := a.plan.write(w); werr != nil {
+		return werr
+	}
+	return err
+}
+
+// planExpression fills in zp's current and intended rule expressions. The
+// rule is the rate limiting rule in ratelimit mode, else the bot check rule.
+func (a *app) planExpression(zp *zonePlan) error {
+	want, err := a.buildExpression()
+	if err != nil {
+		return err
+	}
+	zp.Expression = want
+
+	cur, err := a.managedRule()
+	if err != nil {
+		return err
+	}
+	if cur != nil {
+		zp.CurrentExpression = cur.Expression
+	}
+	zp.Diff = exprDiff(zp.CurrentExpression, want)
+	return nil
+}
+
+// write prints p for people.
+func (p *plan) write(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "Signals:")
+	for _, r := range p.Signals {
+		reason := r.Reason
+		if r.Error != "" {
+			reason = "error: " + r.Error
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\n", r.Signal, r.Verdict, reason)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for _, z := range p.Zones {
+		fmt.Fprintf(w, "\nZone %s: %s", z.Zone, z.Decision)
+		if z.Reason != "" {
+			fmt.Fprintf(w, " (%s)", z.Reason)
+		}
+		fmt.Fprintln(w)
+		if len(z.Changes) == 0 {
+			fmt.Fprintln(w, "  no changes")
+		}
+		for _, c := range z.Changes {
+			fmt.Fprintln(w, "  would "+c.String())
+		}
+		if len(z.Diff) > 0 {
+			fmt.Fprintln(w, "  Expression:")
+			for _, l := range z.Diff {
+				fmt.Fprintln(w, "    "+l)
+			}
+		}
+	}
+	if p.Error != "" {
+		fmt.Fprintf(w, "\nError: %s\n", p.Error)
+	}
+	return nil
+}
+
+func (c plannedChange) String() string {
+	switch c.Action {
+	case "create_rule":
+		return fmt.Sprintf("create rule %q (%s) in ruleset %s", c.Rule, c.RuleAction, c.Ruleset)
+	case "update_rule":
+		return fmt.Sprintf("update rule %s %q (%s) in ruleset %s", c.RuleID, c.Rule, c.RuleAction, c.Ruleset)
+	case "delete_rule":
+		return fmt.Sprintf("delete rule %s from ruleset %s", c.RuleID, c.Ruleset)
+	case "create_entrypoint":
+		return fmt.Sprintf("create the %s entrypoint ruleset", c.Value)
+	case "set_security_level":
+		return "set the security level to " + c.Value
+	}
+	return c.Action
+}
+
+// exprDiff compares two rule expressions clause by clause, splitting each at
+// its top-level "and"s. Each line is a clause prefixed by "  " if it is in
+// both, "- " if only in old, or "+ " if only in new. It returns nil if the
+// expressions are the same.
+func exprDiff(old, new string) []string {
+	if old == new {
+		return nil
+	}
+	a, b := exprClauses(old), exprClauses(new)
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var lines []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, "  "+a[i])
+			i, j = i+1, j+1
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, "- "+a[i])
+			i++
+		default:
+			lines = append(lines, "+ "+b[j])
+			j++
+		}
+	}
+	return lines
+}
+
+// exprClauses splits expr at the "and"s outside brackets and string literals.
+func exprClauses(expr string) []string {
+	if expr == "" {
+		return nil
+	}
+	var clauses []string
+	depth, start := 0, 0
+	for i := 0; i < len(expr); i++ {
+		switch c := expr[i]; c {
+		case '(', '{':
+			depth++
+		case ')', '}':
+			depth--
+		case '"':
+			for i++; i < len(expr) && expr[i] != '"'; i++ {
+				if expr[i] == '\\' {
+					i++
+				}
+			}
+		case ' ':
+			if depth == 0 && strings.HasPrefix(expr[i:], " and ") {
+				clauses = append(clauses, strings.TrimSpace(expr[start:i]))
+				start = i + len(" and ")
+				i = start - 1
+			}
+		}
+	}
+	return append(clauses, strings.TrimSpace(expr[start:]))
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestPlanOnce_HighLoadPlansRuleWithoutCreatingIt(t *testing.T) {
+	f := newFakeCF(t, "z1", "rs1", nil)
+	a := newDoItApp(t, f.ts, "10.00 8.00 6.00 5/200 12345", "z1", "rs1")
+	a.conf.Domain = "example.com"
+	a.stateFile = filepath.Join(t.TempDir(), "state")
+	a.plan = &plan{}
+	a.client.Transport = readOnlyTransport{base: a.client.Transport}
+	var out bytes.Buffer
+	if err := a.planOnce(&out, true); err != nil {
+		t.Fatalf("planOnce error: %v", err)
+	}
+	if len(f.rules) != 0 {
+		t.Errorf("dry run created %d rules", len(f.rules))
+	}
+	if _, err := os.Stat(a.stateFile); !os.IsNotExist(err) {
+		t.Errorf("dry run wrote the state file: %v", err)
+	}
+
+	var p plan
+	if err := json.Unmarshal(out.Bytes(), &p); err != nil {
+		t.Fatalf("output is not JSON: %v\n%s", err, out.String())
+	}
+	if len(p.Zones) != 1 {
+		t.Fatalf("zones = %+v, want 1", p.Zones)
+	}
+	z := p.Zones[0]
+	if z.Decision != "enable" || !strings.Contains(z.Reason, "load") {
+		t.Errorf("decision = %q (%q), want enable because of load", z.Decision, z.Reason)
+	}
+	want := []plannedChange{{Action: "create_rule", Ruleset: "rs1", Rule: botCheckDescription, RuleAction: "managed_challenge"}}
+	if !slices.Equal(z.Changes, want) {
+		t.Errorf("changes = %+v, want %+v", z.Changes, want)
+	}
+	if z.CurrentExpression != "" || z.Expression != mustBuildExpression(t, a) {
+		t.Errorf("expressions = %q -> %q", z.CurrentExpression, z.Expression)
+	}
+	for _, l := range z.Diff {
+		if !strings.HasPrefix(l, "+ ") {
+			t.Errorf("diff line %q, want only additions for a new rule", l)
+		}
+	}
+	if !slices.ContainsFunc(p.Signals, func(r readingReport) bool { return r.Signal == "load" && r.Verdict == "overload" }) {
+		t.Errorf("signals = %+v, want an overloaded load reading", p.Signals)
+	}
+}
+
+func TestPlanOnce_ShowsUpdateAndDiff(t *testing.T) {
+	f := newFakeCF(t, "z1", "rs1", nil)
+	a := newDoItApp(t, f.ts, "10.00 8.00 6.00 5/200 12345", "z1", "rs1")
+	a.conf.Domain = "example.com"
+	a.stateFile = filepath.Join(t.TempDir(), "state")
+	a.plan = &plan{}
+	a.client.Transport = readOnlyTransport{base: a.client.Transport}
+	stale := `http.request.uri.path contains "/articles/" and not http.request.uri.path contains "/01-01-2020/"`
+	f.rules = []testRule{{ID: "rule-1", Ref: botCheckRef, Description: botCheckDescription, Expression: stale}}
+
+	var out bytes.Buffer
+	if err := a.planOnce(&out, false); err != nil {
+		t.Fatalf("planOnce error: %v", err)
+	}
+	if f.rules[0].Expression != stale {
+		t.Error("dry run changed the rule")
+	}
+	text := out.String()
+	for _, s := range []string{
+		"Zone example.com: enable",
+		`would update rule rule-1 "Bot check" (managed_challenge) in ruleset rs1`,
+		`    - not http.request.uri.path contains "/01-01-2020/"`,
+		`      http.request.uri.path contains "/articles/"`,
+	} {
+		if !strings.Contains(text, s) {
+			t.Errorf("output missing %q:\n%s", s, text)
+		}
+	}
+}
+
+func TestPlanOnce_LowLoadPlansDelete(t *testing.T) {
+	f := newFakeCF(t, "z1", "rs1", []testRule{{ID: "rule-1", Ref: botCheckRef, Description: botCheckDescription, Expression: "true"}})
+	a := newDoItApp(t, f.ts, "0.10 0.20 0.30 1/100 12345", "z1", "rs1")
+	a.conf.Domain = "example.com"
+	a.stateFile = filepath.Join(t.TempDir(), "state")
+	a.plan = &plan{}
+	a.client.Transport = readOnlyTransport{base: a.client.Transport}
+	var out bytes.Buffer
+	if err := a.planOnce(&out, true); err != nil {
+		t.Fatalf("planOnce error: %v", err)
+	}
+	if len(f.rules) != 1 {
+		t.Errorf("dry run deleted the rule")
+	}
+	var p plan
+	json.Unmarshal(out.Bytes(), &p)
+	want := []plannedChange{{Action: "delete_rule", Ruleset: "rs1", RuleID: "rule-1"}}
+	if len(p.Zones) != 1 || p.Zones[0].Decision != "disable" || !slices.Equal(p.Zones[0].Changes, want) {
+		t.Errorf("plan = %+v, want rule-1 deleted", p.Zones)
+	}
+}
+
+func TestReadOnlyTransport_RefusesChanges(t *testing.T) {
+	f := newFakeCF(t, "z1", "rs1", nil)
+	client := &http.Client{Transport: readOnlyTransport{base: http.DefaultTransport}}
+	if resp, err := client.Get(f.ts.URL + "/zones"); err != nil {
+		t.Errorf("GET error: %v", err)
+	} else {
+		resp.Body.Close()
+	}
+	if _, err := client.Post(f.ts.URL+"/zones/z1/rulesets/rs1/rules", "application/json", strings.NewReader("{}")); err == nil {
+		t.Error("POST allowed in dry run")
+	}
+}
+
+func TestExprDiff(t *testing.T) {
+	old := `(a contains "x" or b) and not c contains " and " and d`
+	new := `(a contains "x" or b) and not c contains " and " and e and f`
+	want := []string{
+		`  (a contains "x" or b)`,
+		`  not c contains " and "`,
+		`- d`,
+		`+ e`,
+		`+ f`,
+	}
+	if got := exprDiff(old, new); !slices.Equal(got, want) {
+		t.Errorf("exprDiff =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if got := exprDiff(new, new); got != nil {
+		t.Errorf("exprDiff of equal expressions = %q, want nil", got)
+	}
+	if got := exprDiff("", "a and b"); !slices.Equal(got, []string{"+ a", "+ b"}) {
+		t.Errorf("exprDiff from nothing = %q", got)
+	}
+}
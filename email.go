@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"maps"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// validateEmail checks the settings of a notifyEmail notifier.
+func (nc NotifierConfig) validateEmail() error {
+	if _, _, err := net.SplitHostPort(nc.Host); err != nil {
+		return fmt.Errorf("email Host %q is not host:port", nc.Host)
+	}
+	if _, err := mail.ParseAddress(nc.From); err != nil {
+		return fmt.Errorf("email From: %w", err)
+	}
+	if len(nc.To) == 0 {
+		return errors.New("email needs at least one To address")
+	}
+	for _, to := range nc.To {
+		if _, err := mail.ParseAddress(to); err != nil {
+			return fmt.Errorf("email To: %w", err)
+		}
+	}
+	return nil
+}
+
+// subject returns the subject line of the mail for e.
+func (e event) subject() string {
+	switch e.Kind {
+	case eventEnabled:
+		return fmt.Sprintf("underattack: %s rule enabled on %s", e.Rule, e.Zone)
+	case eventDisabled:
+		return fmt.Sprintf("underattack: %s rule disabled on %s", e.Rule, e.Zone)
+	case eventFailing:
+		return fmt.Sprintf("underattack: %d runs in a row have failed", e.FailedRuns)
+	}
+	return "underattack: Cloudflare call failed for " + e.Zone
+}
+
+// summary returns the body of the mail for e, one field per line.
+func (e event) summary() string {
+	var b bytes.Buffer
+	field := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(&b, "%-12s %s\r\n", name+":", value)
+		}
+	}
+	field("Time", e.Time.UTC().Format(time.RFC3339))
+	field("Zone", e.Zone)
+	field("Rule", e.Rule)
+	field("Rule ID", e.RuleID)
+	field("Action", e.Action)
+	field("Reason", e.Reason)
+	if e.EnabledFor > 0 {
+		field("Enabled for", time.Duration(e.EnabledFor).Round(time.Second).String())
+	}
+	if e.FailedRuns > 0 {
+		field("Failed runs", fmt.Sprint(e.FailedRuns))
+	}
+	field("Error", e.Error)
+	field("URL", e.URL)
+	if len(e.Signals) > 0 {
+		b.WriteString("\r\nSignals:\r\n")
+		for _, k := range slices.Sorted(maps.Keys(e.Signals)) {
+			fmt.Fprintf(&b, "  %s = %g\r\n", k, e.Signals[k])
+		}
+	}
+	if e.Suppressed > 0 {
+		fmt.Fprintf(&b, "\r\n%d similar notifications were suppressed.\r\n", e.Suppressed)
+	}
+	return b.String()
+}
+
+// mailMessage returns e as an RFC 5322 message from nc.From to nc.To.
+func (nc NotifierConfig) mailMessage(e event) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", nc.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(nc.To, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", e.subject()))
+	fmt.Fprintf(&b, "Date: %s\r\n", e.Time.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(e.summary())
+	return b.Bytes()
+}
+
+// sendMail delivers e by SMTP to nc.Host, upgrading the connection with
+// STARTTLS if the server offers it and authenticating with PLAIN if
+// nc.Username is set. smtp.PlainAuth refuses to send the password over an
+// unencrypted connection except to localhost.
+func (n *notifications) sendMail(nc NotifierConfig, e event) error {
+	host, _, _ := net.SplitHostPort(nc.Host)
+	conn, err := net.DialTimeout("tcp", nc.Host, n.client.Timeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(n.client.Timeout))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		cfg := n.tlsConfig
+		if cfg == nil {
+			cfg = &tls.Config{ServerName: host}
+		}
+		if err := c.StartTLS(cfg); err != nil {
+			return fmt.Errorf("STARTTLS: %w", err)
+		}
+	}
+	if nc.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", nc.Username, nc.Password, host)); err != nil {
+			return fmt.Errorf("authenticating: %w", err)
+		}
+	}
+	from, _ := mail.ParseAddress(nc.From)
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, to := range nc.To {
+		addr, _ := mail.ParseAddress(to)
+		if err := c.Rcpt(addr.Address); err != nil {
+			return fmt.Errorf("recipient %s: %w", addr.Address, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(nc.mailMessage(e)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
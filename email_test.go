@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// smtpMessage is a mail received by an smtpServer.
+type smtpMessage struct {
+	auth    string // decoded AUTH PLAIN credentials
+	authTLS bool   // whether AUTH came after STARTTLS
+	tls     bool   // whether the mail was sent after STARTTLS
+	from    string
+	to      []string
+	data    string
+}
+
+// smtpServer is a minimal SMTP server on localhost that accepts every mail.
+// It offers STARTTLS if tls is set.
+type smtpServer struct {
+	addr string
+	tls  *tls.Config
+	mu   sync.Mutex
+	msgs []smtpMessage
+}
+
+func newSMTPServer(t *testing.T) *smtpServer {
+	t.Helper()
+	return startSMTPServer(t, nil)
+}
+
+// newSMTPServerTLS returns an smtpServer offering STARTTLS with a self-signed
+// certificate.
+func newSMTPServerTLS(t *testing.T) *smtpServer {
+	t.Helper()
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	certs := ts.TLS.Certificates
+	ts.Close()
+	return startSMTPServer(t, &tls.Config{Certificates: certs})
+}
+
+func startSMTPServer(t *testing.T, cfg *tls.Config) *smtpServer {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s := &smtpServer{addr: l.Addr().String(), tls: cfg}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	reply("220 localhost ESMTP")
+	var m smtpMessage
+	upgraded := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(cmd) {
+		case "EHLO", "HELO":
+			reply("250-localhost")
+			if s.tls != nil && !upgraded {
+				reply("250-STARTTLS")
+			}
+			reply("250 AUTH PLAIN")
+		case "STARTTLS":
+			reply("220 ready")
+			tc := tls.Server(conn, s.tls)
+			if err := tc.Handshake(); err != nil {
+				return
+			}
+			conn, r, upgraded = tc, bufio.NewReader(tc), true
+		case "AUTH":
+			_, cred, _ := strings.Cut(arg, " ")
+			b, _ := base64.StdEncoding.DecodeString(cred)
+			m.auth, m.authTLS = string(b), upgraded
+			reply("235 ok")
+		case "MAIL":
+			m.from = arg
+			reply("250 ok")
+		case "RCPT":
+			m.to = append(m.to, arg)
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil || l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			m.data, m.tls = data.String(), upgraded
+			s.mu.Lock()
+			s.msgs = append(s.msgs, m)
+			s.mu.Unlock()
+			m = smtpMessage{}
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func (s *smtpServer) messages() []smtpMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.msgs
+}
+
+// notifier returns an email notifier that sends to s.
+func (s *smtpServer) notifier() NotifierConfig {
+	return NotifierConfig{Type: notifyEmail, Host: s.addr, Username: "user", Password: "pw",
+		From: "underattack <alerts@example.com>", To: []string{"oncall@example.com", "ops@example.com"}}
+}
+
+func TestValidateNotifiers_Email(t *testing.T) {
+	ok := NotifierConfig{Type: notifyEmail, Host: "mail.example.com:587", From: "a@example.com", To: []string{"b@example.com"}}
+	if err := validateNotifiers([]NotifierConfig{ok}); err != nil {
+		t.Errorf("validateNotifiers: %v", err)
+	}
+	for _, bad := range []func(*NotifierConfig){
+		func(n *NotifierConfig) { n.Host = "mail.example.com" },
+		func(n *NotifierConfig) { n.From = "" },
+		func(n *NotifierConfig) { n.To = nil },
+		func(n *NotifierConfig) { n.To = []string{"not an address"} },
+	} {
+		n := ok
+		bad(&n)
+		if err := validateNotifiers([]NotifierConfig{n}); err == nil {
+			t.Errorf("validateNotifiers(%+v) succeeded, want an error", n)
+		}
+	}
+}
+
+func TestNotifications_Email(t *testing.T) {
+	s := newSMTPServer(t)
+	n := newNotifications([]NotifierConfig{s.notifier()})
+	n.send(event{Time: time.Now(), Kind: eventDisabled, Zone: "example.com", Rule: botCheckDescription,
+		RuleID: "r1", Reason: "load average below threshold", EnabledFor: duration(90 * time.Minute),
+		Signals: map[string]float64{"load_average": 0.5}})
+	// Single failed calls are not mailed.
+	n.send(event{Time: time.Now(), Kind: eventError, Zone: "example.com", Error: "HTTP 500"})
+	n.wait(5 * time.Second)
+
+	msgs := s.messages()
+	if len(msgs) != 1 {
+		t.Fatalf("got %d mails, want 1", len(msgs))
+	}
+	m := msgs[0]
+	if m.auth != "\x00user\x00pw" {
+		t.Errorf("auth = %q", m.auth)
+	}
+	if m.from != "FROM:<alerts@example.com>" || len(m.to) != 2 {
+		t.Errorf("envelope = %s %v", m.from, m.to)
+	}
+	for _, want := range []string{
+		"Subject: underattack: Bot check rule disabled on example.com",
+		"To: oncall@example.com, ops@example.com",
+		"Enabled for: 1h30m0s",
+		"Reason:      load average below threshold",
+		"load_average = 0.5",
+	} {
+		if !strings.Contains(m.data, want) {
+			t.Errorf("mail lacks %q:\n%s", want, m.data)
+		}
+	}
+}
+
+func TestNotifications_EmailSTARTTLS(t *testing.T) {
+	s := newSMTPServerTLS(t)
+	n := newNotifications([]NotifierConfig{s.notifier()})
+	n.tlsConfig = &tls.Config{InsecureSkipVerify: true}
+	n.send(event{Time: time.Now(), Kind: eventEnabled, Zone: "example.com", Rule: botCheckDescription, Reason: "load 10.00"})
+	n.wait(5 * time.Second)
+
+	msgs := s.messages()
+	if len(msgs) != 1 {
+		t.Fatalf("got %d mails, want 1", len(msgs))
+	}
+	if m := msgs[0]; !m.authTLS || !m.tls || m.auth != "\x00user\x00pw" {
+		t.Errorf("auth %q after STARTTLS %v, mail over TLS %v; want both after the upgrade", m.auth, m.authTLS, m.tls)
+	}
+}
+
+func TestNotifications_EmailSTARTTLSVerifiesCertificate(t *testing.T) {
+	s := newSMTPServerTLS(t)
+	n := newNotifications([]NotifierConfig{s.notifier()})
+	n.send(event{Time: time.Now(), Kind: eventEnabled, Zone: "example.com"})
+	n.wait(5 * time.Second)
+	if len(s.messages()) != 0 {
+		t.Error("mail sent to a server with an untrusted certificate")
+	}
+}
+
+func TestNotifications_EmailFailureIsLogged(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := l.Addr().String()
+	l.Close()
+	n := newNotifications([]NotifierConfig{{Type: notifyEmail, Host: addr, From: "a@example.com", To: []string{"b@example.com"}}})
+	start := time.Now()
+	n.send(event{Time: time.Now(), Kind: eventEnabled, Zone: "example.com"})
+	if time.Since(start) > time.Second {
+		t.Error("send waited for delivery")
+	}
+	n.wait(5 * time.Second)
+}
+
+func TestRunOnce_MailsOnceWhenFailing(t *testing.T) {
+	s := newSMTPServer(t)
+	f := newFakeCF(t, "z1", "rs1", nil)
+	f.fail[http.MethodGet] = true
+	stateFile := writeTempLoadFile(t, "")
+	os.Remove(stateFile)
+
+	// Each cron run is a new process that reads the state file.
+	for run := 1; run <= 5; run++ {
+		a := newDoItApp(t, f.ts, "10.00 8.00 6.00 5/200 12345", "z1", "rs1")
+		a.stateFile = stateFile
+		a.alertAfterFailures = 3
+		a.notifications = newNotifications([]NotifierConfig{s.notifier()})
+		if _, err := a.runOnce(); err == nil {
+			t.Fatalf("run %d succeeded, want a failure", run)
+		}
+		a.notifications.wait(5 * time.Second)
+		want := 0
+		if run >= 3 {
+			want = 1
+		}
+		if got := len(s.messages()); got != want {
+			t.Fatalf("after run %d, %d mails; want %d", run, got, want)
+		}
+	}
+	if !strings.Contains(s.messages()[0].data, "Subject: underattack: 3 runs in a row have failed") {
+		t.Errorf("mail = %s", s.messages()[0].data)
+	}
+
+	// Success resets the count, so a new run of failures is mailed again.
+	f.fail[http.MethodGet] = false
+	a := newDoItApp(t, f.ts, "10.00 8.00 6.00 5/200 12345", "z1", "rs1")
+	a.stateFile = stateFile
+	a.alertAfterFailures = 3
+	a.notifications = newNotifications([]NotifierConfig{s.notifier()})
+	if _, err := a.runOnce(); err != nil {
+		t.Fatalf("runOnce: %v", err)
+	}
+	a.notifications.wait(5 * time.Second)
+	if st, _ := loadState(stateFile); st.FailedRuns != 0 || st.FailureNotified {
+		t.Errorf("state after success = %d, %v; want reset", st.FailedRuns, st.FailureNotified)
+	}
+}
+
+func TestRunOnce_MailsEachChangeOnce(t *testing.T) {
+	s := newSMTPServer(t)
+	f := newFakeCF(t, "z1", "rs1", nil)
+	stateFile := writeTempLoadFile(t, "")
+	os.Remove(stateFile)
+
+	run := func(load string) {
+		t.Helper()
+		a := newDoItApp(t, f.ts, load, "z1", "rs1")
+		a.stateFile = stateFile
+		a.notifications = newNotifications([]NotifierConfig{s.notifier()})
+		if _, err := a.runOnce(); err != nil {
+			t.Fatalf("runOnce: %v", err)
+		}
+		a.notifications.wait(5 * time.Second)
+	}
+	run("10.00 8.00 6.00 5/200 12345")
+	// The rule is deleted in the dashboard and created again: no new mail.
+	f.rules = nil
+	run("10.00 8.00 6.00 5/200 12345")
+	if got := len(s.messages()); got != 1 {
+		t.Fatalf("%d mails after enabling twice, want 1", got)
+	}
+	if !strings.Contains(s.messages()[0].data, "Subject: underattack: Bot check rule enabled on") {
+		t.Errorf("mail = %s", s.messages()[0].data)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// defaultExpression is the rule expression template used when the config has
+// none: challenge GET requests for articles from anything but verified bots and
+// logged in users, except articles published in the last exemptDays days and
+// any posts exempted by Config.Posts.
+const defaultExpression = `{{paths "/articles/"}} and http.request.method eq "GET" and not cf.client.bot and {{exemptCookies "wordpress_logged_in"}}{{with exemptDates}} and {{.}}{{end}}{{with exemptPosts}} and {{.}}{{end}}`
+
+// maxExpressionLen is Cloudflare's limit on the length of a rule expression.
+const maxExpressionLen = 4096
+
+// exprData is the data passed to the expression template.
+type exprData struct {
+	Domain string // the zone's domain
+}
+
+// expressionText returns the expression template for this zone.
+func (a *app) expressionText() string {
+	if a.zoneConf != nil && a.zoneConf.Expression != "" {
+		return a.zoneConf.Expression
+	}
+	if a.conf.Expression != "" {
+		return a.conf.Expression
+	}
+	return defaultExpression
+}
+
+// exprFuncs returns the helpers available to expression templates. Each
+// returns an expression fragment, or "" if it has nothing to match. postLimit
+// caps the number of posts exemptPosts lists; negative means no cap.
+func (a *app) exprFuncs(postLimit int) template.FuncMap {
+	return template.FuncMap{
+		"quote": quoteExpr,
+		// dates returns the dates to exempt, formatted with dateFormat:
+		// tomorrow, to allow for timezones, through exemptDays-2 days ago.
+		"dates": a.exemptDateList,
+		// exemptDates excludes paths containing any of the dates as a
+		// segment, matched according to dateMatch. See datePaths.
+		"exemptDates": func() (string, error) {
+			var clauses []string
+			for _, p := range datePaths(time.Now(), a.exemptDays, a.dateFormat) {
+				c, err := a.dateClause(p)
+				if err != nil {
+					return "", err
+				}
+				clauses = append(clauses, c)
+			}
+			if len(clauses) == 0 {
+				return "", nil
+			}
+			return "not (" + strings.Join(clauses, " or ") + ")", nil
+		},
+		// paths matches paths containing any of the given strings.
+		"paths": func(ps ...string) string {
+			var clauses []string
+			for _, p := range ps {
+				clauses = append(clauses, "http.request.uri.path contains "+quoteExpr(p))
+			}
+			return anyOf(clauses)
+		},
+		// prefixes matches paths starting with any of the given prefixes.
+		"prefixes": func(ps ...string) string {
+			var clauses []string
+			for _, p := range ps {
+				clauses = append(clauses, fmt.Sprintf("starts_with(http.request.uri.path, %s)", quoteExpr(p)))
+			}
+			return anyOf(clauses)
+		},
+		// exemptCookies excludes requests carrying any of the named cookies.
+		"exemptCookies": func(names ...string) string {
+			var clauses []string
+			for _, n := range names {
+				clauses = append(clauses, "not http.cookie contains "+quoteExpr(n))
+			}
+			return strings.Join(clauses, " and ")
+		},
+		// exemptIPs excludes requests from the given addresses and CIDR ranges.
+		"exemptIPs": func(ips ...string) (string, error) {
+			if len(ips) == 0 {
+				return "", nil
+			}
+			for _, ip := range ips {
+				if _, err := netip.ParsePrefix(ip); err == nil {
+					continue
+				}
+				if _, err := netip.ParseAddr(ip); err != nil {
+					return "", fmt.Errorf("exemptIPs: invalid address %q", ip)
+				}
+			}
+			return "not ip.src in {" + strings.Join(ips, " ") + "}", nil
+		},
+		// exemptPosts excludes the paths of the posts selected by Config.Posts.
+		"exemptPosts": func() string {
+			return postsClause(a.postPaths(), postLimit)
+		},
+		// exemptIPList excludes requests from addresses in a Cloudflare IP list.
+		"exemptIPList": func(name string) string {
+			return "not ip.src in $" + name
+		},
+	}
+}
+
+// exemptDateList returns the dates to exempt from the bot check.
+func (a *app) exemptDateList() []string {
+	now := time.Now()
+	dates := make([]string, a.exemptDays)
+	for i := range a.exemptDays {
+		dates[i] = now.AddDate(0, 0, 1-i).Format(a.dateFormat) // tomorrow through (exemptDays-2) days ago
+	}
+	return dates
+}
+
+// quoteExpr returns s as a string literal in Cloudflare's rule language,
+// which only has escapes for the quote and backslash.
+func quoteExpr(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// anyOf joins clauses with "or", parenthesised if there is more than one.
+func anyOf(clauses []string) string {
+	switch len(clauses) {
+	case 0:
+		return ""
+	case 1:
+		return clauses[0]
+	}
+	return "(" + strings.Join(clauses, " or ") + ")"
+}
+
+// buildExpression renders the rule expression template for this zone and
+// checks the result before it is sent to Cloudflare. If exempted posts push
+// the expression over Cloudflare's length limit, the least important posts
+// are dropped: Cloudflare Lists only hold IPs, hostnames, ASNs and redirects,
+// so there is nowhere else to put the paths.
+func (a *app) buildExpression() (string, error) {
+	expr, err := a.renderExpression(-1)
+	if err != nil {
+		return "", err
+	}
+	if over := len(expr) - maxExpressionLen; over > 0 {
+		paths := a.postPaths()
+		n := len(paths)
+		for n > 0 && over > 0 {
+			n--
+			over -= len(quoteExpr(paths[n])) + 1
+		}
+		if n < len(paths) {
+			slog.Warn("too many posts to exempt within the expression length limit", "kept", n, "posts", len(paths))
+			if expr, err = a.renderExpression(n); err != nil {
+				return "", err
+			}
+		}
+	}
+	if err := validateExpression(expr); err != nil {
+		return "", fmt.Errorf("invalid rule expression %q: %w", expr, err)
+	}
+	return expr, nil
+}
+
+// renderExpression executes the expression template, listing at most
+// postLimit exempted posts.
+func (a *app) renderExpression(postLimit int) (string, error) {
+	t, err := template.New("expression").Funcs(a.exprFuncs(postLimit)).Option("missingkey=error").Parse(a.expressionText())
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, exprData{Domain: a.conf.Domain}); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+// validateExpression catches the mistakes a template is likely to make —
+// empty output, unbalanced brackets or quotes, and dangling operators — before
+// Cloudflare rejects the rule.
+func validateExpression(expr string) error {
+	if expr == "" {
+		return errors.New("empty expression")
+	}
+	if len(expr) > maxExpressionLen {
+		return fmt.Errorf("expression is %d characters, limit %d", len(expr), maxExpressionLen)
+	}
+	if strings.Contains(expr, "<no value>") {
+		return errors.New("template referred to a missing value")
+	}
+	tokens, err := exprTokens(expr)
+	if err != nil {
+		return err
+	}
+	isOp := func(t string) bool { return t == "and" || t == "or" || t == "xor" || t == "&&" || t == "||" }
+	var depth []string
+	prev := "("
+	for _, t := range tokens {
+		switch {
+		case t == "(" || t == "{":
+			depth = append(depth, t)
+		case t == ")" || t == "}":
+			open := map[string]string{")": "(", "}": "{"}[t]
+			if len(depth) == 0 || depth[len(depth)-1] != open {
+				return fmt.Errorf("unbalanced %q", t)
+			}
+			depth = depth[:len(depth)-1]
+			if isOp(prev) || prev == "not" || prev == "(" {
+				return fmt.Errorf("missing operand before %q", t)
+			}
+		case isOp(t):
+			if isOp(prev) || prev == "not" || prev == "(" {
+				return fmt.Errorf("missing operand before %q", t)
+			}
+		}
+		prev = t
+	}
+	if len(depth) > 0 {
+		return fmt.Errorf("unclosed %q", depth[len(depth)-1])
+	}
+	if isOp(prev) || prev == "not" {
+		return fmt.Errorf("expression ends with %q", prev)
+	}
+	return nil
+}
+
+// exprTokens splits expr into brackets, string literals and words.
+func exprTokens(expr string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case strings.IndexByte(" \t\r\n", c) >= 0:
+			i++
+		case strings.IndexByte("(){}", c) >= 0:
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"':
+			j := i + 1
+			for j < len(expr) && expr[j] != '"' {
+				if expr[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(expr) {
+				return nil, errors.New("unterminated string")
+			}
+			tokens = append(tokens, expr[i:j+1])
+			i = j + 1
+		default:
+			j := i
+			for j < len(expr) && strings.IndexByte(" \t\r\n(){}\"", expr[j]) < 0 {
+				j++
+			}
+			tokens = append(tokens, expr[i:j])
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+// expressionCurrent reports whether a rule with expression expr needs no
+// refresh: either it matches the expression we would build now, or it already
+// exempts today's date and there are no exempted posts that may have changed.
+func (a *app) expressionCurrent(expr string) bool {
+	want, err := a.buildExpression()
+	if err == nil && expr == want {
+		return true
+	}
+	return a.exemptDays > 0 && !a.conf.Posts.enabled() && strings.Contains(expr, time.Now().Format(a.dateFormat))
+}
+
+// validateExpressions renders the expression template of every zone, so that
+// mistakes are reported at startup rather than when the server is overloaded.
+func (a *app) validateExpressions() error {
+	zones := a.conf.Zones
+	if len(zones) == 0 {
+		zones = []ZoneConfig{{Domain: a.conf.Domain, RulesetID: a.conf.RulesetID}}
+	}
+	for _, zc := range zones {
+		z := a.zoneApp(zc)
+		z.posts = postCache{at: time.Now()} // don't query the database just to check the template
+		if _, err := z.buildExpression(); err != nil {
+			return fmt.Errorf("zone %s: %w", zc.Domain, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustBuildExpression(t *testing.T, a *app) string {
+	t.Helper()
+	expr, err := a.buildExpression()
+	if err != nil {
+		t.Fatalf("buildExpression: %v", err)
+	}
+	return expr
+}
+
+func TestBuildExpression_DefaultMatchesLegacy(t *testing.T) {
+	a := newApp()
+	a.exemptDays = 2
+	now := time.Now()
+	want := `http.request.uri.path contains "/articles/" and http.request.method eq "GET" and not cf.client.bot and not http.cookie contains "wordpress_logged_in"` +
+		` and not (http.request.uri.path contains "/` + now.AddDate(0, 0, 1).Format(a.dateFormat) + `/" or http.request.uri.path contains "/` + now.Format(a.dateFormat) + `/")`
+	if got := mustBuildExpression(t, a); got != want {
+		t.Errorf("expression =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestBuildExpression_NoExemptDays(t *testing.T) {
+	a := newApp()
+	a.exemptDays = 0
+	expr := mustBuildExpression(t, a)
+	if strings.Contains(expr, "not (") {
+		t.Errorf("expression %q should have no date exemptions", expr)
+	}
+}
+
+func TestBuildExpression_Template(t *testing.T) {
+	a := newApp()
+	a.exemptDays = 1
+	a.dateFormat = "2006/01/02"
+	a.conf.Domain = "news.example"
+	a.conf.Expression = `http.host eq {{quote .Domain}} and {{prefixes "/news/" "/story/"}}
+		and {{exemptCookies "sid" "auth"}} and {{exemptIPs "192.0.2.1" "198.51.100.0/24"}} and {{exemptIPList "office"}}
+		{{with exemptDates}}and {{.}}{{end}}`
+	expr := mustBuildExpression(t, a)
+	for _, want := range []string{
+		`http.host eq "news.example"`,
+		`(starts_with(http.request.uri.path, "/news/") or starts_with(http.request.uri.path, "/story/"))`,
+		`not http.cookie contains "sid" and not http.cookie contains "auth"`,
+		`not ip.src in {192.0.2.1 198.51.100.0/24}`,
+		`not ip.src in $office`,
+		`not (http.request.uri.path contains "/` + time.Now().AddDate(0, 0, 1).Format("2006/01/02") + `/")`,
+	} {
+		if !strings.Contains(expr, want) {
+			t.Errorf("expression missing %q:\n%s", want, expr)
+		}
+	}
+}
+
+func TestBuildExpression_ZoneTemplate(t *testing.T) {
+	a := newApp()
+	a.conf.Expression = `{{paths "/articles/"}}`
+	a.zoneConf = &ZoneConfig{Expression: `{{paths "/news/"}}`}
+	if expr := mustBuildExpression(t, a); expr != `http.request.uri.path contains "/news/"` {
+		t.Errorf("expression = %q, want the zone's template", expr)
+	}
+}
+
+func TestBuildExpression_Errors(t *testing.T) {
+	for _, tmpl := range []string{
+		`{{paths "/a/"`,                // template syntax
+		`{{.Missing}}`,                 // unknown field
+		`{{exemptIPs "not-an-ip"}}`,    // bad address
+		`{{paths}}`,                    // renders empty
+		`{{paths "/a/"}} and`,          // dangling operator
+		`({{paths "/a/"}}`,             // unclosed bracket
+		`http.cookie contains "x`,      // unterminated string
+		`{{paths "/a/"}} and and x`,    // doubled operator
+		`not ({{exemptCookies}}) or x`, // empty group
+	} {
+		a := newApp()
+		a.conf.Expression = tmpl
+		if expr, err := a.buildExpression(); err == nil {
+			t.Errorf("template %q: expected error, got %q", tmpl, expr)
+		}
+	}
+}
+
+func TestValidateExpression_Valid(t *testing.T) {
+	for _, expr := range []string{
+		`http.request.method eq "GET"`,
+		`not (ip.src in {192.0.2.0/24}) and http.cookie contains "a (b"`,
+		`http.request.uri.path contains "\"quoted\""`,
+	} {
+		if err := validateExpression(expr); err != nil {
+			t.Errorf("validateExpression(%q): %v", expr, err)
+		}
+	}
+}
+
+func TestQuoteExpr(t *testing.T) {
+	if got, want := quoteExpr(`a"b\c`), `"a\"b\\c"`; got != want {
+		t.Errorf("quoteExpr = %s, want %s", got, want)
+	}
+}
+
+func TestLoadConfig_InvalidExpression(t *testing.T) {
+	fn := writeTempLoadFile(t, `{"ApiKey": "k", "Domain": "example.com", "RulesetID": "rs1", "Expression": "{{paths}}"}`)
+	if err := newTestApp().loadConfig(fn); err == nil {
+		t.Error("expected error for an expression template that renders empty")
+	}
+}
+
+func TestEnsureBotCheck_NoChurnWithoutDates(t *testing.T) {
+	ts, rules := rulesetServer(t, "ze1", "rs1", nil)
+	a := appForServer(ts, "ze1", "rs1")
+	a.conf.Expression = `{{paths "/news/"}}`
+	for range 2 {
+		if err := a.ensureBotCheck(true, "test"); err != nil {
+			t.Fatalf("ensureBotCheck: %v", err)
+		}
+	}
+	if len(*rules) != 1 || (*rules)[0].ID != "rule-101" {
+		t.Errorf("rules = %+v, want the first rule kept", *rules)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// Level is one step of the escalation ladder. The first level is used as soon
+// as the rule is enabled; later levels are entered when the load reaches Load
+// and the current level has been held for its Dwell time.
+type Level struct {
+	Action string   // Cloudflare rule action, e.g. "managed_challenge"
+	Load   float64  // load (per CPU with -perCPU) needed to enter this level; ignored for the first
+	Dwell  duration // minimum time at this level before moving up or down
+}
+
+var defaultLevels = []Level{{Action: "managed_challenge"}}
+
+var ruleActions = []string{"managed_challenge", "js_challenge", "challenge", "block", "log"}
+
+// levels returns the configured escalation ladder, or defaultLevels.
+func (a *app) levels() []Level {
+	if len(a.conf.Levels) == 0 {
+		return defaultLevels
+	}
+	return a.conf.Levels
+}
+
+// validateLevels checks that every level has a known action and that entry
+// loads increase up the ladder.
+func validateLevels(levels []Level) error {
+	for i, l := range levels {
+		if !slices.Contains(ruleActions, l.Action) {
+			return fmt.Errorf("level %d: unknown action %q", i, l.Action)
+		}
+		if i > 1 && l.Load <= levels[i-1].Load {
+			return fmt.Errorf("level %d: load %v must be above level %d's %v", i, l.Load, i-1, levels[i-1].Load)
+		}
+		if i > 0 && l.Load <= 0 {
+			return errors.New("every level after the first needs a Load")
+		}
+	}
+	return nil
+}
+
+// stepLevel moves zs at most one level up or down the ladder according to
+// load, once the current level's dwell time has passed. It reports whether
+// the level changed.
+func (a *app) stepLevel(zs *zoneState, load float64, now time.Time) bool {
+	levels := a.levels()
+	cur := min(zs.Level, len(levels)-1)
+	if cur != zs.Level {
+		// The ladder was shortened since the level was recorded.
+		zs.Level, zs.LevelSince = cur, now
+		return true
+	}
+	if now.Sub(zs.LevelSince) < time.Duration(levels[cur].Dwell) {
+		return false
+	}
+	switch {
+	case cur+1 < len(levels) && load >= levels[cur+1].Load:
+		zs.Level, zs.LevelSince = cur+1, now
+	case cur > 0 && !(load >= levels[cur].Load):
+		zs.Level, zs.LevelSince = cur-1, now
+	default:
+		return false
+	}
+	slog.Info("changing escalation level", "from", levels[cur].Action, "to", levels[zs.Level].Action, "load", load)
+	return true
+}
+
+// levelAction returns the rule action for zs's current level.
+func (a *app) levelAction(zs *zoneState) string {
+	levels := a.levels()
+	return levels[min(zs.Level, len(levels)-1)].Action
+}
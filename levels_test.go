@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var testLadder = []Level{
+	{Action: "managed_challenge", Dwell: duration(10 * time.Minute)},
+	{Action: "js_challenge", Load: 8, Dwell: duration(10 * time.Minute)},
+	{Action: "block", Load: 12, Dwell: duration(30 * time.Minute)},
+}
+
+func TestLevels_ConfigJSON(t *testing.T) {
+	var c Config
+	err := json.Unmarshal([]byte(`{"Levels": [{"Action": "managed_challenge", "Dwell": "10m"}, {"Action": "block", "Load": 9, "Dwell": "1h"}]}`), &c)
+	if err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if len(c.Levels) != 2 || time.Duration(c.Levels[1].Dwell) != time.Hour || c.Levels[1].Load != 9 {
+		t.Errorf("Levels = %+v", c.Levels)
+	}
+	if err := json.Unmarshal([]byte(`{"Levels": [{"Dwell": "soon"}]}`), &c); err == nil {
+		t.Error("expected error for invalid duration, got nil")
+	}
+}
+
+func TestValidateLevels(t *testing.T) {
+	if err := validateLevels(testLadder); err != nil {
+		t.Errorf("validateLevels(testLadder) error: %v", err)
+	}
+	if err := validateLevels(defaultLevels); err != nil {
+		t.Errorf("validateLevels(defaultLevels) error: %v", err)
+	}
+	bad := [][]Level{
+		{{Action: "tarpit"}},
+		{{Action: "managed_challenge"}, {Action: "block"}},
+		{{Action: "managed_challenge"}, {Action: "js_challenge", Load: 8}, {Action: "block", Load: 6}},
+	}
+	for _, levels := range bad {
+		if err := validateLevels(levels); err == nil {
+			t.Errorf("validateLevels(%+v): expected error, got nil", levels)
+		}
+	}
+}
+
+func TestStepLevel(t *testing.T) {
+	now := time.Date(2026, 4, 19, 12, 0, 0, 0, time.UTC)
+	a := newTestApp()
+	a.conf.Levels = testLadder
+	cases := []struct {
+		name    string
+		level   int
+		since   time.Duration
+		load    float64
+		want    int
+		changed bool
+	}{
+		{"dwell not elapsed", 0, 5 * time.Minute, 20, 0, false},
+		{"up one level", 0, 15 * time.Minute, 9, 1, true},
+		{"only one level at a time", 0, 15 * time.Minute, 20, 1, true},
+		{"stay", 1, 15 * time.Minute, 10, 1, false},
+		{"top of ladder", 2, time.Hour, 50, 2, false},
+		{"down one level", 2, time.Hour, 9, 1, true},
+		{"down dwell not elapsed", 2, 15 * time.Minute, 1, 2, false},
+		{"down to first", 1, time.Hour, 1, 0, true},
+		{"ladder shortened", 5, time.Hour, 1, 2, true},
+	}
+	for _, tc := range cases {
+		zs := &zoneState{Level: tc.level, LevelSince: now.Add(-tc.since)}
+		changed := a.stepLevel(zs, tc.load, now)
+		if zs.Level != tc.want || changed != tc.changed {
+			t.Errorf("%s: level = %d (changed %v), want %d (changed %v)", tc.name, zs.Level, changed, tc.want, tc.changed)
+		}
+	}
+}
+
+func TestEnsureBotCheck_ReplacesRuleWhenActionChanges(t *testing.T) {
+	today := time.Now().Format("02-01-2006")
+	current := testRule{ID: "rule-1", Description: botCheckDescription, Expression: "/" + today + "/"}
+	ts, rules := rulesetServer(t, "zl1", "rs1", []testRule{current})
+	a := appForServer(ts, "zl1", "rs1")
+	a.action = "block"
+	if err := a.ensureBotCheck(true, "test"); err != nil {
+		t.Fatalf("ensureBotCheck(true) error: %v", err)
+	}
+	if len(*rules) != 1 || (*rules)[0].Action != "block" {
+		t.Errorf("rules = %+v, want one rule with action block", *rules)
+	}
+}
+
+func TestRuleAction_DefaultsToFirstConfiguredLevel(t *testing.T) {
+	a := newTestApp()
+	if got := a.ruleAction(); got != defaultLevels[0].Action {
+		t.Errorf("ruleAction = %q, want %q", got, defaultLevels[0].Action)
+	}
+	a.conf.Levels = []Level{{Action: "js_challenge"}, {Action: "block", Load: 8}}
+	if got := a.ruleAction(); got != "js_challenge" {
+		t.Errorf("ruleAction = %q, want the first configured level", got)
+	}
+}
+
+func TestDoIt_EscalatesAndResets(t *testing.T) {
+	ts, rules := rulesetServer(t, "zl2", "rs1", nil)
+	a := newDoItApp(t, ts, "10.00 8.00 6.00 5/200 12345", "zl2", "rs1")
+	a.stateFile = filepath.Join(t.TempDir(), "state")
+	a.conf.Levels = []Level{{Action: "managed_challenge"}, {Action: "js_challenge", Load: 8}}
+
+	a.doIt()
+	if len(*rules) != 1 || (*rules)[0].Action != "managed_challenge" {
+		t.Fatalf("first run: rules = %+v, want managed_challenge", *rules)
+	}
+	a.doIt()
+	if len(*rules) != 1 || (*rules)[0].Action != "js_challenge" {
+		t.Fatalf("second run: rules = %+v, want js_challenge", *rules)
+	}
+
+	os.WriteFile(a.loadFile, []byte("0.10 0.20 0.30 1/100 12345"), 0o644)
+	a.doIt()
+	if len(*rules) != 0 {
+		t.Fatalf("recovery: rules = %+v, want none", *rules)
+	}
+	if zs := a.state.zone(""); zs.Level != 0 {
+		t.Errorf("level after recovery = %d, want 0", zs.Level)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// memorySignal triggers on memory usage from /proc/meminfo and, optionally,
+// on the swap rate measured from /proc/vmstat.
+type memorySignal struct {
+	MemFile     string
+	VmstatFile  string
+	Max         float64 // overload if usage percentage reaches this; 0 reports only
+	Min         float64 // recovered once usage is below this; 0 means Max
+	MaxSwapRate float64 // overload if swap-in plus swap-out pages/sec reaches this; 0 disables
+
+	swapInterval time.Duration
+}
+
+func newMemorySignal(a *app, params json.RawMessage) (Signal, error) {
+	s := &memorySignal{
+		MemFile:      a.memFile,
+		VmstatFile:   a.vmstatFile,
+		Max:          a.maxMem,
+		Min:          a.minMem,
+		MaxSwapRate:  a.maxSwapRate,
+		swapInterval: a.swapInterval,
+	}
+	if err := json.Unmarshal(params, s); err != nil {
+		return nil, err
+	}
+	if s.Min == 0 || s.Min > s.Max {
+		s.Min = s.Max
+	}
+	return s, nil
+}
+
+func (s *memorySignal) Name() string { return "memory" }
+
+func (s *memorySignal) Sample() (Reading, error) {
+	text, err := os.ReadFile(s.MemFile)
+	if err != nil {
+		return Reading{}, err
+	}
+	pct, err := memoryPercent(string(text))
+	if err != nil {
+		return Reading{}, err
+	}
+	r := Reading{Verdict: Recovered, Metrics: map[string]float64{"memory_percent": pct}}
+
+	if s.MaxSwapRate > 0 {
+		in, out, err := s.swapRate()
+		if err != nil {
+			return Reading{}, err
+		}
+		r.Metrics["swap_in_rate"] = in
+		r.Metrics["swap_out_rate"] = out
+		if in+out >= s.MaxSwapRate {
+			r.Verdict, r.Reason = Overload, fmt.Sprintf("swap %.0f pages/s", in+out)
+			return r, nil
+		}
+	}
+
+	switch {
+	case s.Max == 0:
+	case pct >= s.Max:
+		r.Verdict, r.Reason = Overload, fmt.Sprintf("memory %.1f%%", pct)
+	case pct >= s.Min:
+		r.Verdict = Neutral
+	}
+	return r, nil
+}
+
+// swapRate samples the vmstat swap counters twice, swapInterval apart, and
+// returns the swap-in and swap-out rates in pages per second.
+func (s *memorySignal) swapRate() (in, out float64, err error) {
+	in0, out0, err := readSwapCounters(s.VmstatFile)
+	if err != nil {
+		return 0, 0, err
+	}
+	start := time.Now()
+	time.Sleep(s.swapInterval)
+	in1, out1, err := readSwapCounters(s.VmstatFile)
+	if err != nil {
+		return 0, 0, err
+	}
+	secs := time.Since(start).Seconds()
+	return float64(in1-in0) / secs, float64(out1-out0) / secs, nil
+}
+
+func readSwapCounters(fn string) (in, out int64, err error) {
+	text, err := os.ReadFile(fn)
+	if err != nil {
+		return 0, 0, err
+	}
+	return swapCounters(string(text))
+}
+
+// swapCounters returns the pswpin and pswpout counters from the contents of /proc/vmstat.
+func swapCounters(text string) (in, out int64, err error) {
+	var foundIn, foundOut bool
+	for _, line := range strings.Split(text, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "pswpin":
+			in, err = strconv.ParseInt(fields[1], 10, 64)
+			foundIn = true
+		case "pswpout":
+			out, err = strconv.ParseInt(fields[1], 10, 64)
+			foundOut = true
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if !foundIn || !foundOut {
+		return 0, 0, errors.New("pswpin/pswpout not found")
+	}
+	return in, out, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+// meminfoFixture returns /proc/meminfo contents with the given usage percentage.
+func meminfoFixture(usedPct int) string {
+	return fmt.Sprintf("MemTotal:       1000000 kB\nMemFree:         100000 kB\nMemAvailable:   %7d kB\nSwapTotal:            0 kB\n", 1000000-usedPct*10000)
+}
+
+func TestMemoryPercent(t *testing.T) {
+	pct, err := memoryPercent(meminfoFixture(42))
+	if err != nil {
+		t.Fatalf("memoryPercent error: %v", err)
+	}
+	if pct != 42 {
+		t.Errorf("memoryPercent = %v, want 42", pct)
+	}
+}
+
+func TestMemoryPercent_NoTotal(t *testing.T) {
+	if _, err := memoryPercent("MemAvailable: 100 kB\n"); err == nil {
+		t.Error("expected error when MemTotal is missing, got nil")
+	}
+}
+
+func TestMemoryPercent_NoAvailable(t *testing.T) {
+	if _, err := memoryPercent("MemTotal: 1000 kB\nMemFree: 100 kB\n"); err == nil {
+		t.Error("expected error when MemAvailable is missing, got nil")
+	}
+}
+
+func TestSwapCounters(t *testing.T) {
+	in, out, err := swapCounters("nr_free_pages 1\npswpin 123\npswpout 456\npgfault 9\n")
+	if err != nil {
+		t.Fatalf("swapCounters error: %v", err)
+	}
+	if in != 123 || out != 456 {
+		t.Errorf("swapCounters = %d, %d, want 123, 456", in, out)
+	}
+	if _, _, err := swapCounters("pswpin 1\n"); err == nil {
+		t.Error("expected error when pswpout is missing, got nil")
+	}
+}
+
+func newTestMemorySignal(t *testing.T, usedPct int, params string) Signal {
+	t.Helper()
+	a := newTestApp()
+	a.memFile = writeTempLoadFile(t, meminfoFixture(usedPct))
+	a.vmstatFile = writeTempLoadFile(t, "pswpin 10\npswpout 20\n")
+	s, err := newMemorySignal(a, json.RawMessage(params))
+	if err != nil {
+		t.Fatalf("newMemorySignal error: %v", err)
+	}
+	return s
+}
+
+func TestMemorySignal_Verdicts(t *testing.T) {
+	cases := []struct {
+		used   int
+		params string
+		want   Verdict
+	}{
+		{95, `{"Max": 90, "Min": 80}`, Overload},
+		{90, `{"Max": 90, "Min": 80}`, Overload},
+		{85, `{"Max": 90, "Min": 80}`, Neutral},
+		{50, `{"Max": 90, "Min": 80}`, Recovered},
+		{89, `{"Max": 90}`, Recovered},
+		{99, `{"Max": 0}`, Recovered},
+	}
+	for _, tc := range cases {
+		r, err := newTestMemorySignal(t, tc.used, tc.params).Sample()
+		if err != nil {
+			t.Fatalf("Sample error: %v", err)
+		}
+		if r.Verdict != tc.want {
+			t.Errorf("used=%d %s: verdict = %v, want %v", tc.used, tc.params, r.Verdict, tc.want)
+		}
+		if r.Metrics["memory_percent"] != float64(tc.used) {
+			t.Errorf("memory_percent = %v, want %d", r.Metrics["memory_percent"], tc.used)
+		}
+	}
+}
+
+func TestMemorySignal_SwapRate(t *testing.T) {
+	r, err := newTestMemorySignal(t, 50, `{"Max": 90, "MaxSwapRate": 100}`).Sample()
+	if err != nil {
+		t.Fatalf("Sample error: %v", err)
+	}
+	if r.Verdict != Recovered {
+		t.Errorf("verdict = %v, want recovered with no swap activity", r.Verdict)
+	}
+	if v, ok := r.Metrics["swap_in_rate"]; !ok || v != 0 {
+		t.Errorf("swap_in_rate = %v (present %v), want 0", v, ok)
+	}
+}
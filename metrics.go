@@ -5,32 +5,76 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"maps"
 	"net/http"
+	"slices"
 	"time"
 )
 
+// metricSample is a set of metric values sampled at one time.
+type metricSample struct {
+	Time   time.Time
+	Values map[string]float64
+	Attrs  map[string]string // attributes attached to every value, e.g. the zone
+}
+
+// recordMetrics pushes samples immediately under cron, or queues them for the
+// next flushMetrics in daemon mode.
+func (a *app) recordMetrics(samples ...metricSample) {
+	if !a.daemon {
+		a.pushSamples(samples)
+		return
+	}
+	a.pendingMetrics = append(a.pendingMetrics, samples...)
+}
+
+// flushMetrics pushes all queued metric samples as a single request.
+func (a *app) flushMetrics() {
+	if len(a.pendingMetrics) == 0 {
+		return
+	}
+	a.pushSamples(a.pendingMetrics)
+	a.pendingMetrics = nil
+}
+
 // pushMetrics sends metrics to Grafana Cloud via OTLP JSON. It is a no-op if
 // MetricsURL is not configured. values maps metric names to their float64 values.
 func (a *app) pushMetrics(values map[string]float64) {
+	a.pushSamples([]metricSample{{Time: time.Now(), Values: values}})
+}
+
+// pushSamples sends one or more metric samples to Grafana Cloud, with one data
+// point per sample for each metric.
+func (a *app) pushSamples(samples []metricSample) {
 	if a.conf.MetricsURL == "" {
 		return
 	}
 
-	slog.Debug("pushMetrics", "metrics", values)
-
-	now := time.Now().UTC().UnixNano()
-	metrics := make([]any, 0, len(values))
+	var names []string
+	dataPoints := map[string][]any{}
+	for _, s := range samples {
+		slog.Debug("pushMetrics", "metrics", s.Values, "attrs", s.Attrs)
+		for name, val := range s.Values {
+			if _, ok := dataPoints[name]; !ok {
+				names = append(names, name)
+			}
+			dp := map[string]any{
+				"asDouble":     val,
+				"timeUnixNano": fmt.Sprintf("%d", s.Time.UTC().UnixNano()),
+			}
+			if len(s.Attrs) > 0 {
+				dp["attributes"] = otlpAttributes(s.Attrs)
+			}
+			dataPoints[name] = append(dataPoints[name], dp)
+		}
+	}
 
-	for name, val := range values {
+	metrics := make([]any, 0, len(names))
+	for _, name := range names {
 		metrics = append(metrics, map[string]any{
 			"name": name,
 			"gauge": map[string]any{
-				"dataPoints": []any{
-					map[string]any{
-						"asDouble":      val,
-						"timeUnixNano": fmt.Sprintf("%d", now),
-					},
-				},
+				"dataPoints": dataPoints[name],
 			},
 		})
 	}
@@ -74,3 +118,15 @@ func (a *app) pushMetrics(values map[string]float64) {
 		slog.Debug("pushMetrics: sent", "status", resp.Status)
 	}
 }
+
+// otlpAttributes converts attrs to OTLP key/value form, sorted by key.
+func otlpAttributes(attrs map[string]string) []any {
+	var kvs []any
+	for _, k := range slices.Sorted(maps.Keys(attrs)) {
+		kvs = append(kvs, map[string]any{
+			"key":   k,
+			"value": map[string]any{"stringValue": attrs[k]},
+		})
+	}
+	return kvs
+}
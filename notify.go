@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notifier types, for NotifierConfig.Type.
+const (
+	notifyWebhook = "webhook" // the event as JSON
+	notifySlack   = "slack"   // a Slack (or Mattermost, Rocket.Chat) incoming webhook
+	notifyNtfy    = "ntfy"    // an ntfy topic URL
+	notifyEmail   = "email"   // mail sent through an SMTP server
+)
+
+// Event kinds.
+const (
+	eventEnabled  = "enabled"  // a rule was created
+	eventDisabled = "disabled" // a rule was deleted
+	eventError    = "error"    // a Cloudflare call failed
+	eventFailing  = "failing"  // runs have failed -alertAfterFailures times in a row
+)
+
+// notifyWait is how long the process waits on exit for notifications still
+// being sent.
+const notifyWait = 5 * time.Second
+
+// NotifierConfig is an entry in the config file's Notify list.
+type NotifierConfig struct {
+	Type  string // notifyWebhook (default), notifySlack, notifyNtfy or notifyEmail
+	URL   string
+	Token string // sent as a bearer token if set, e.g. for an ntfy access token
+
+	// For notifyEmail.
+	Host     string // SMTP server as host:port; STARTTLS is used if offered
+	Username string // for PLAIN authentication; none if empty
+	Password string
+	From     string
+	To       []string
+}
+
+// validateNotifiers checks the Notify entries in the config file.
+func validateNotifiers(ns []NotifierConfig) error {
+	for i, n := range ns {
+		switch n.Type {
+		case "", notifyWebhook, notifySlack, notifyNtfy:
+		case notifyEmail:
+			if err := n.validateEmail(); err != nil {
+				return fmt.Errorf("Notify[%d]: %w", i, err)
+			}
+			continue
+		default:
+			return fmt.Errorf("Notify[%d]: unknown type %q", i, n.Type)
+		}
+		u, err := url.Parse(n.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("Notify[%d]: URL %q is not an http(s) URL", i, n.URL)
+		}
+	}
+	return nil
+}
+
+// event is a rule state change or failure, as sent to notifiers.
+type event struct {
+	Time    time.Time          `json:"time"`
+	Kind    string             `json:"event"`
+	Zone    string             `json:"zone"`
+	Rule    string             `json:"rule"`
+	RuleID  string             `json:"ruleId,omitempty"`
+	Action  string             `json:"action,omitempty"`
+	Reason  string             `json:"reason,omitempty"`
+	URL     string             `json:"url,omitempty"`
+	Error   string             `json:"error,omitempty"`
+	Signals map[string]float64 `json:"signals,omitempty"`
+
+	EnabledFor duration `json:"enabledFor,omitempty"` // how long a deleted rule was on
+	FailedRuns int      `json:"failedRuns,omitempty"` // consecutive failed runs, for eventFailing
+
+	Suppressed int `json:"suppressed,omitempty"` // similar events not sent since the last one
+}
+
+// text returns the event as a one-line message.
+func (e event) text() string {
+	var b strings.Builder
+	switch e.Kind {
+	case eventEnabled:
+		fmt.Fprintf(&b, "%s rule enabled on %s", e.Rule, e.Zone)
+	case eventDisabled:
+		fmt.Fprintf(&b, "%s rule disabled on %s", e.Rule, e.Zone)
+		if e.EnabledFor > 0 {
+			fmt.Fprintf(&b, " after %s", time.Duration(e.EnabledFor).Round(time.Second))
+		}
+	case eventFailing:
+		fmt.Fprintf(&b, "%d runs in a row have failed", e.FailedRuns)
+	default:
+		fmt.Fprintf(&b, "Cloudflare call failed for %s", e.Zone)
+	}
+	if e.Reason != "" {
+		fmt.Fprintf(&b, ": %s", e.Reason)
+	}
+	if e.Error != "" {
+		fmt.Fprintf(&b, ": %s", e.Error)
+	}
+	for _, k := range slices.Sorted(maps.Keys(e.Signals)) {
+		fmt.Fprintf(&b, " %s=%.4g", k, e.Signals[k])
+	}
+	if e.URL != "" {
+		fmt.Fprintf(&b, " (%s)", e.URL)
+	}
+	if e.Suppressed > 0 {
+		fmt.Fprintf(&b, " [%d similar suppressed]", e.Suppressed)
+	}
+	return b.String()
+}
+
+// notifications delivers events to the configured notifiers in the
+// background. Delivery failures are logged and otherwise ignored.
+type notifications struct {
+	notifiers []NotifierConfig
+	client    *http.Client
+	tlsConfig *tls.Config // for STARTTLS; nil to verify the SMTP server's certificate
+	wg        sync.WaitGroup
+}
+
+// newNotifications returns a notifications for ns, or nil if there are none.
+func newNotifications(ns []NotifierConfig) *notifications {
+	if len(ns) == 0 {
+		return nil
+	}
+	return &notifications{
+		notifiers: ns,
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// send delivers e to every notifier without waiting.
+func (n *notifications) send(e event) {
+	if n == nil {
+		return
+	}
+	for _, nc := range n.notifiers {
+		if nc.kind() == notifyEmail && e.Kind == eventError {
+			continue // mail only once runs keep failing; see eventFailing
+		}
+		n.wg.Go(func() {
+			if err := n.deliver(nc, e); err != nil {
+				slog.Warn("sending notification", "type", nc.kind(), "err", err)
+			}
+		})
+	}
+}
+
+// wait waits up to timeout for notifications still being sent, so that they
+// are not lost when the process exits.
+func (n *notifications) wait(timeout time.Duration) {
+	if n == nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		n.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		slog.Warn("gave up waiting for notifications", "timeout", timeout)
+	}
+}
+
+// kind returns the notifier type, with the default filled in.
+func (nc NotifierConfig) kind() string {
+	if nc.Type == "" {
+		return notifyWebhook
+	}
+	return nc.Type
+}
+
+// deliver sends e to one notifier in its format.
+func (n *notifications) deliver(nc NotifierConfig, e event) error {
+	if nc.kind() == notifyEmail {
+		return n.sendMail(nc, e)
+	}
+	var body []byte
+	header := http.Header{}
+	switch nc.kind() {
+	case notifySlack:
+		body, _ = json.Marshal(map[string]string{"text": "underattack: " + e.text()})
+		header.Set("Content-Type", "application/json")
+	case notifyNtfy:
+		body = []byte(e.text())
+		header.Set("Title", "underattack: "+e.Zone)
+		switch e.Kind {
+		case eventEnabled:
+			header.Set("Tags", "shield")
+		case eventDisabled:
+			header.Set("Tags", "white_check_mark")
+		default:
+			header.Set("Tags", "warning")
+			header.Set("Priority", "high")
+		}
+	default:
+		body, _ = json.Marshal(e)
+		header.Set("Content-Type", "application/json")
+	}
+	if nc.Token != "" {
+		header.Set("Authorization", "Bearer "+nc.Token)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, nc.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header = header
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New("HTTP " + resp.Status)
+	}
+	return nil
+}
+
+// notify sends an event about this zone's rule, with the signal values from
+// the current check. What has been sent is recorded in the state file, so
+// that separate cron runs do not repeat themselves: a rule's creation or
+// deletion is only reported if it differs from what was last reported for
+// it, and an event of the same kind for the same zone and rule is sent at
+// most once per a.notifyInterval, with later ones counted and mentioned in
+// the next message. Nothing is sent in a dry run.
+func (a *app) notify(e event) {
+	if a.notifications == nil || a.plan != nil {
+		return
+	}
+	e.Time = time.Now()
+	e.Zone = a.conf.Domain
+	st, zs := a.loadStateOnce(), a.zoneState()
+	if (e.Kind == eventEnabled || e.Kind == eventDisabled) && zs.Notified[e.Rule] == e.Kind {
+		slog.Debug("already notified", "event", e.Kind, "zone", e.Zone, "rule", e.Rule)
+		return
+	}
+	key := e.Kind + " " + e.Zone + " " + e.Rule
+	if last, ok := st.NotifiedAt[key]; ok && e.Time.Sub(last) < a.notifyInterval {
+		if st.Suppressed == nil {
+			st.Suppressed = map[string]int{}
+		}
+		st.Suppressed[key]++
+		slog.Debug("notification suppressed", "event", e.Kind, "zone", e.Zone, "rule", e.Rule)
+		return
+	}
+	if st.NotifiedAt == nil {
+		st.NotifiedAt = map[string]time.Time{}
+	}
+	st.NotifiedAt[key] = e.Time
+	e.Suppressed = st.Suppressed[key]
+	delete(st.Suppressed, key)
+	if e.Kind == eventEnabled || e.Kind == eventDisabled {
+		if zs.Notified == nil {
+			zs.Notified = map[string]string{}
+		}
+		zs.Notified[e.Rule] = e.Kind
+		if e.Kind == eventDisabled && !zs.EnabledAt.IsZero() {
+			e.EnabledFor = duration(e.Time.Sub(zs.EnabledAt))
+		}
+	}
+	for _, r := range st.LastSignals {
+		if e.Signals == nil && len(r.Metrics) > 0 {
+			e.Signals = map[string]float64{}
+		}
+		maps.Copy(e.Signals, r.Metrics)
+	}
+	a.notifications.send(e)
+}
+
+// recordRun counts consecutive failed runs in the state file and, the first
+// time the count reaches a.alertAfterFailures, sends an eventFailing. A
+// successful run resets the count.
+func (a *app) recordRun(err error) {
+	if a.plan != nil {
+		return
+	}
+	st := a.loadStateOnce()
+	if err == nil {
+		if st.FailedRuns > 0 {
+			slog.Info("run succeeded after failures", "failedRuns", st.FailedRuns)
+		}
+		st.FailedRuns, st.FailureNotified = 0, false
+		return
+	}
+	st.FailedRuns++
+	if a.alertAfterFailures <= 0 || st.FailedRuns < a.alertAfterFailures || st.FailureNotified {
+		return
+	}
+	st.FailureNotified = true
+	if a.notifications != nil {
+		a.notifications.send(event{Time: time.Now(), Kind: eventFailing, Zone: a.conf.Domain, Error: err.Error(), FailedRuns: st.FailedRuns})
+	}
+}
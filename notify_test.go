@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// notifyRequest is a request received by a notifyServer.
+type notifyRequest struct {
+	header http.Header
+	body   string
+}
+
+// notifyServer returns a server recording the requests it receives and
+// replying with status.
+func notifyServer(t *testing.T, status int) (*httptest.Server, func() []notifyRequest) {
+	t.Helper()
+	var mu sync.Mutex
+	var reqs []notifyRequest
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		reqs = append(reqs, notifyRequest{r.Header, string(body)})
+		mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(ts.Close)
+	return ts, func() []notifyRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return reqs
+	}
+}
+
+func TestValidateNotifiers(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		n       NotifierConfig
+		wantErr bool
+	}{
+		{"webhook", NotifierConfig{URL: "https://hooks.example/x"}, false},
+		{"ntfy", NotifierConfig{Type: notifyNtfy, URL: "https://ntfy.sh/topic"}, false},
+		{"unknown type", NotifierConfig{Type: "pager", URL: "https://hooks.example/x"}, true},
+		{"missing URL", NotifierConfig{Type: notifySlack}, true},
+		{"not http", NotifierConfig{URL: "mailto:ops@example.com"}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := validateNotifiers([]NotifierConfig{tc.n}); (err != nil) != tc.wantErr {
+				t.Errorf("validateNotifiers = %v, want error %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestNotifications_Payloads(t *testing.T) {
+	ts, got := notifyServer(t, http.StatusOK)
+	n := newNotifications([]NotifierConfig{
+		{URL: ts.URL + "/webhook"},
+		{Type: notifySlack, URL: ts.URL + "/slack"},
+		{Type: notifyNtfy, URL: ts.URL + "/ntfy", Token: "tk"},
+	})
+	n.send(event{Time: time.Now(), Kind: eventEnabled, Zone: "example.com", Rule: botCheckDescription,
+		Reason: "load 10.00", URL: "https://api.example/rules/r1", Signals: map[string]float64{"load_average": 10}})
+	n.wait(time.Second)
+
+	reqs := got()
+	if len(reqs) != 3 {
+		t.Fatalf("got %d requests, want 3", len(reqs))
+	}
+	for _, r := range reqs {
+		switch {
+		case strings.HasPrefix(r.body, `{"time"`):
+			var e event
+			if err := json.Unmarshal([]byte(r.body), &e); err != nil || e.Kind != eventEnabled || e.URL == "" || e.Signals["load_average"] != 10 {
+				t.Errorf("webhook event = %+v, %v", e, err)
+			}
+		case strings.HasPrefix(r.body, `{"text"`):
+			if !strings.Contains(r.body, "Bot check rule enabled on example.com: load 10.00") {
+				t.Errorf("slack body = %s", r.body)
+			}
+		default:
+			if r.header.Get("Authorization") != "Bearer tk" || r.header.Get("Title") == "" {
+				t.Errorf("ntfy headers = %v", r.header)
+			}
+			if !strings.Contains(r.body, "load_average=10") || !strings.Contains(r.body, "https://api.example/rules/r1") {
+				t.Errorf("ntfy body = %s", r.body)
+			}
+		}
+	}
+}
+
+func TestRunOnce_NotificationsRateLimitedAcrossRuns(t *testing.T) {
+	hook, got := notifyServer(t, http.StatusOK)
+	f := newFakeCF(t, "z1", "rs1", nil)
+	f.fail[http.MethodGet] = true
+	stateFile := filepath.Join(t.TempDir(), "state")
+
+	// Each cron run is a new process that reads the state file.
+	run := func() {
+		t.Helper()
+		a := newDoItApp(t, f.ts, "10.00 8.00 6.00 5/200 12345", "z1", "rs1")
+		a.stateFile = stateFile
+		a.notifyInterval = time.Hour
+		a.notifications = newNotifications([]NotifierConfig{{URL: hook.URL}})
+		if _, err := a.runOnce(); err == nil {
+			t.Fatal("runOnce succeeded, want the Cloudflare failure")
+		}
+		a.notifications.wait(time.Second)
+	}
+	run()
+	run()
+	run()
+	if n := len(got()); n != 1 {
+		t.Fatalf("got %d notifications from three failing runs within the interval, want 1", n)
+	}
+
+	// Once the interval has passed the next one goes out, counting the others.
+	st, err := loadState(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k := range st.NotifiedAt {
+		st.NotifiedAt[k] = st.NotifiedAt[k].Add(-2 * time.Hour)
+	}
+	if err := saveState(stateFile, st); err != nil {
+		t.Fatal(err)
+	}
+	run()
+	reqs := got()
+	if len(reqs) != 2 {
+		t.Fatalf("got %d notifications, want 2 after the interval", len(reqs))
+	}
+	var e event
+	json.Unmarshal([]byte(reqs[1].body), &e)
+	if e.Kind != eventError || e.Suppressed != 2 {
+		t.Errorf("event = %s %d suppressed, want error with 2", e.Kind, e.Suppressed)
+	}
+}
+
+func TestRunOnce_Notifies(t *testing.T) {
+	hook, got := notifyServer(t, http.StatusInternalServerError)
+	f := newFakeCF(t, "z1", "rs1", nil)
+	a := newDoItApp(t, f.ts, "10.00 8.00 6.00 5/200 12345", "z1", "rs1")
+	a.notifications = newNotifications([]NotifierConfig{{URL: hook.URL}})
+
+	// A failing webhook does not fail the run.
+	if enabled, err := a.runOnce(); err != nil || !enabled {
+		t.Fatalf("runOnce = %v, %v; want enabled", enabled, err)
+	}
+	a.notifications.wait(time.Second)
+	reqs := got()
+	if len(reqs) != 1 {
+		t.Fatalf("got %d notifications, want 1", len(reqs))
+	}
+	var e event
+	json.Unmarshal([]byte(reqs[0].body), &e)
+	if e.Kind != eventEnabled || e.RuleID != "rule-101" || e.Reason != "load 10.00" || !strings.Contains(e.URL, "/rules/rule-101") || e.Signals["load_average"] != 10 {
+		t.Errorf("event = %+v", e)
+	}
+
+	f.fail[http.MethodGet] = true
+	a.forgetRule()
+	if _, err := a.runOnce(); err == nil {
+		t.Fatal("runOnce succeeded, want the Cloudflare failure")
+	}
+	a.notifications.wait(time.Second)
+	if reqs := got(); len(reqs) != 2 || !strings.Contains(reqs[1].body, `"event":"error"`) {
+		t.Errorf("after failure got %d notifications, want an error event", len(reqs))
+	}
+}
+
+func TestNotify_DryRunSendsNothing(t *testing.T) {
+	hook, got := notifyServer(t, http.StatusOK)
+	a := newTestApp()
+	a.notifications = newNotifications([]NotifierConfig{{URL: hook.URL}})
+	a.plan = &plan{}
+	a.notify(event{Kind: eventEnabled})
+	a.notifications.wait(time.Second)
+	if len(got()) != 0 {
+		t.Error("a dry run sent a notification")
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/amnonbc/underattack/cloudflare"
+)
+
+// Manual overrides, set by the enable and disable commands.
+const (
+	overrideEnable  = "enable"  // keep the rule on whatever the signals say
+	overrideDisable = "disable" // keep the rule off whatever the signals say
+)
+
+// applyOverride replaces the verdict while a manual override is in force,
+// and clears the override once it has expired.
+func (a *app) applyOverride(zs *zoneState, verdict Verdict, reason string, now time.Time) (Verdict, string) {
+	if zs.Override == "" {
+		return verdict, reason
+	}
+	if !now.Before(zs.OverrideUntil) {
+		slog.Info("manual override expired", "zone", a.conf.Domain, "override", zs.Override, "reason", zs.OverrideReason)
+		zs.Override, zs.OverrideUntil, zs.OverrideReason = "", time.Time{}, ""
+		return verdict, reason
+	}
+	why := "manual override until " + zs.OverrideUntil.Format(time.RFC3339)
+	if zs.OverrideReason != "" {
+		why += ": " + zs.OverrideReason
+	}
+	if zs.Override == overrideEnable {
+		return Overload, why
+	}
+	return Recovered, why
+}
+
+// overrideMetric returns the bot_check_override metric: 1 while the rule is
+// forced on, -1 while it is forced off, and 0 otherwise.
+func overrideMetric(zs *zoneState) float64 {
+	switch zs.Override {
+	case overrideEnable:
+		return 1
+	case overrideDisable:
+		return -1
+	}
+	return 0
+}
+
+// reloadOverrides copies the manual overrides from the state file into the
+// state held in memory, so that a running daemon picks up overrides set by
+// the enable and disable commands.
+func (a *app) reloadOverrides() {
+	st, err := loadState(a.stateFile)
+	if err != nil {
+		slog.Warn("reading overrides from state file", "err", err)
+		return
+	}
+	for _, z := range a.zones {
+		file, cur := st.zone(z.conf.Domain), z.zoneState()
+		if file.Override != cur.Override || !file.OverrideUntil.Equal(cur.OverrideUntil) {
+			slog.Info("manual override changed", "zone", z.conf.Domain, "override", file.Override, "until", file.OverrideUntil, "reason", file.OverrideReason)
+		}
+		cur.Override, cur.OverrideUntil, cur.OverrideReason, cur.OverrideSetAt = file.Override, file.OverrideUntil, file.OverrideReason, file.OverrideSetAt
+	}
+}
+
+// command runs one of the subcommands given after the flags.
+func (a *app) command(w io.Writer, args []string) error {
+	switch args[0] {
+	case "status":
+		return a.statusCommand(w, args[1:])
+	case overrideEnable, overrideDisable, "clear":
+		if a.dryRun {
+			return fmt.Errorf("%s cannot be combined with -dry-run", args[0])
+		}
+		return a.overrideCommand(args[0], args[1:])
+	}
+	return fmt.Errorf("unknown command %q, want status, enable, disable or clear", args[0])
+}
+
+// selectZones returns the zones named domain, or every zone if it is empty.
+func (a *app) selectZones(domain string) ([]*app, error) {
+	if domain == "" {
+		return a.zones, nil
+	}
+	for _, z := range a.zones {
+		if z.conf.Domain == domain {
+			return []*app{z}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown zone %q", domain)
+}
+
+// overrideCommand sets (enable, disable) or removes (clear) a manual
+// override. Only the override fields of the state file are changed, so that
+// a check running at the same time keeps its own state; the next check, from
+// cron or a running daemon, applies the override.
+//
+//	underattack enable -for 2h -reason "product launch"
+//	underattack disable -for 30m
+//	underattack clear
+func (a *app) overrideCommand(cmd string, args []string) error {
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	dur := fs.Duration("for", 0, "how long the override lasts")
+	reason := fs.String("reason", "", "why, for the logs and status")
+	zone := fs.String("zone", "", "zone to override (default all)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if cmd != "clear" && *dur <= 0 {
+		return fmt.Errorf("%s needs -for, e.g. -for 2h", cmd)
+	}
+	zones, err := a.selectZones(*zone)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	return updateState(a.stateFile, func(st *state) {
+		for _, z := range zones {
+			zs := st.zone(z.conf.Domain)
+			if cmd == "clear" {
+				slog.Info("manual override cleared", "zone", z.conf.Domain, "override", zs.Override)
+				zs.Override, zs.OverrideUntil, zs.OverrideReason = "", time.Time{}, ""
+			} else {
+				slog.Info("manual override", "zone", z.conf.Domain, "override", cmd, "until", now.Add(*dur), "reason", *reason)
+				zs.Override, zs.OverrideUntil, zs.OverrideReason = cmd, now.Add(*dur), *reason
+			}
+			zs.OverrideSetAt = now
+		}
+	})
+}
+
+// zoneStatus is the status command's report for one zone.
+type zoneStatus struct {
+	Zone           string    `json:"zone"`
+	RuleID         string    `json:"ruleId,omitempty"` // empty if the rule is off
+	Action         string    `json:"action,omitempty"`
+	Expression     string    `json:"expression,omitempty"`
+	EnabledAt      time.Time `json:"enabledAt,omitzero"`
+	EnabledReason  string    `json:"enabledReason,omitempty"`
+	Override       string    `json:"override,omitempty"`
+	OverrideUntil  time.Time `json:"overrideUntil,omitzero"`
+	OverrideReason string    `json:"overrideReason,omitempty"`
+	Error          string    `json:"error,omitempty"`
+}
+
+// statusReport is the output of the status command.
+type statusReport struct {
+	Zones     []zoneStatus    `json:"zones"`
+	LastCheck time.Time       `json:"lastCheck,omitzero"`
+	Signals   []readingReport `json:"signals"` // as of LastCheck
+}
+
+// statusCommand writes each zone's rule, as found in Cloudflare, with what
+// the state file records about it and the signals at the last check.
+func (a *app) statusCommand(w io.Writer, args []string) error {
+	fs := flag.NewFlagSet("status", flag.ContinueOnError)
+	zone := fs.String("zone", "", "zone to report (default all)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	zones, err := a.selectZones(*zone)
+	if err != nil {
+		return err
+	}
+	st := a.loadStateOnce()
+	report := statusReport{LastCheck: st.LastCheck, Signals: st.LastSignals}
+	var errs []error
+	for _, z := range zones {
+		zs := z.zoneState()
+		s := zoneStatus{
+			Zone:           z.conf.Domain,
+			EnabledAt:      zs.EnabledAt,
+			EnabledReason:  zs.EnabledReason,
+			Override:       zs.Override,
+			OverrideUntil:  zs.OverrideUntil,
+			OverrideReason: zs.OverrideReason,
+		}
+		if r, err := z.lookupRule(); err != nil {
+			s.Error = err.Error()
+			errs = append(errs, fmt.Errorf("%s: %w", z.conf.Domain, err))
+		} else if r != nil {
+			s.RuleID, s.Action, s.Expression = r.ID, r.Action, r.Expression
+		}
+		report.Zones = append(report.Zones, s)
+	}
+	if a.jsonOutput {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else if err := report.write(w, time.Now()); err != nil {
+		return err
+	}
+	return errors.Join(errs...)
+}
+
+// lookupRule returns the rule the mode manages, or nil if there is none,
+// without changing anything in Cloudflare: a missing entrypoint ruleset is
+// not created and duplicate rules are not deleted, unlike managedRule.
+func (a *app) lookupRule() (*cloudflare.Rule, error) {
+	zs := a.zoneState()
+	rulesetID, phase := cmp.Or(a.conf.RulesetID, zs.RulesetID), customRulesPhase
+	ref, description := botCheckRef, botCheckDescription
+	if a.mode() == modeRateLimit {
+		rulesetID, phase = zs.RateLimitRulesetID, rateLimitPhase
+		ref, description = rateLimitRef, rateLimitDescription
+	}
+	var rules []cloudflare.Rule
+	if rulesetID != "" {
+		rs, err := a.cf().Ruleset(a.apiContext(), a.zoneId, rulesetID)
+		if err != nil {
+			return nil, err
+		}
+		rules = rs.Rules
+	} else {
+		rs, err := a.cf().PhaseEntrypoint(a.apiContext(), a.zoneId, phase)
+		if cloudflare.IsNotFound(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		rules = rs.Rules
+	}
+	if matches := matchRules(rules, ref, description); len(matches) > 0 {
+		return &matches[0], nil
+	}
+	return nil, nil
+}
+
+// write prints r for people.
+func (r statusReport) write(w io.Writer, now time.Time) error {
+	ago := func(t time.Time) string { return now.Sub(t).Round(time.Second).String() }
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, z := range r.Zones {
+		fmt.Fprintf(tw, "Zone %s\n", z.Zone)
+		switch {
+		case z.Error != "":
+			fmt.Fprintf(tw, "  Rule:\terror: %s\n", z.Error)
+		case z.RuleID == "":
+			fmt.Fprintf(tw, "  Rule:\toff\n")
+		default:
+			fmt.Fprintf(tw, "  Rule:\t%s (%s)\n", z.RuleID, z.Action)
+			if !z.EnabledAt.IsZero() {
+				fmt.Fprintf(tw, "  Enabled:\t%s ago: %s\n", ago(z.EnabledAt), z.EnabledReason)
+			}
+			fmt.Fprintf(tw, "  Expression:\t%s\n", z.Expression)
+		}
+		if z.Override != "" {
+			fmt.Fprintf(tw, "  Override:\t%s for %s more", z.Override, z.OverrideUntil.Sub(now).Round(time.Second))
+			if z.OverrideReason != "" {
+				fmt.Fprintf(tw, ": %s", z.OverrideReason)
+			}
+			fmt.Fprintln(tw)
+		}
+	}
+	if r.LastCheck.IsZero() {
+		fmt.Fprintln(tw, "\nNo checks recorded")
+		return tw.Flush()
+	}
+	fmt.Fprintf(tw, "\nSignals at last check, %s ago:\n", ago(r.LastCheck))
+	for _, s := range r.Signals {
+		reason := s.Reason
+		if s.Error != "" {
+			reason = "error: " + s.Error
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\n", s.Signal, s.Verdict, reason)
+	}
+	return tw.Flush()
+}
+
+// usage describes the command line, including the subcommands.
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "usage: %s [flags] [command]\n\n", os.Args[0])
+	fmt.Fprintln(out, "With no command, checks the signals and enables or disables the rule.")
+	fmt.Fprintln(out, "Commands:")
+	fmt.Fprintln(out, "  status [-zone domain]                                show the rule, any override and the last signals")
+	fmt.Fprintln(out, "  enable -for duration [-reason text] [-zone domain]   keep the rule on for duration")
+	fmt.Fprintln(out, "  disable -for duration [-reason text] [-zone domain]  keep the rule off for duration")
+	fmt.Fprintln(out, "  clear [-zone domain]                                 remove an override")
+	fmt.Fprintln(out, "\nFlags:")
+	flag.PrintDefaults()
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApplyOverride(t *testing.T) {
+	a := newTestApp()
+	now := time.Now()
+	zs := &zoneState{Override: overrideEnable, OverrideUntil: now.Add(time.Hour), OverrideReason: "launch"}
+	if v, reason := a.applyOverride(zs, Recovered, "all signals healthy", now); v != Overload || !strings.Contains(reason, "launch") {
+		t.Errorf("enable override = %v, %q; want overload with the reason", v, reason)
+	}
+	zs.Override = overrideDisable
+	if v, _ := a.applyOverride(zs, Overload, "load 10", now); v != Recovered {
+		t.Errorf("disable override = %v, want recovered", v)
+	}
+	if v, reason := a.applyOverride(zs, Overload, "load 10", now.Add(2*time.Hour)); v != Overload || reason != "load 10" {
+		t.Errorf("expired override = %v, %q; want the signals' verdict", v, reason)
+	}
+	if zs.Override != "" || !zs.OverrideUntil.IsZero() || zs.OverrideReason != "" {
+		t.Errorf("expired override not cleared: %+v", zs)
+	}
+}
+
+func TestOverrideCommand_EnableDespiteLowLoad(t *testing.T) {
+	f := newFakeCF(t, "z1", "rs1", nil)
+	stateFile := filepath.Join(t.TempDir(), "state")
+	// Each command and cron run is a new process that reads the state file.
+	run := func(args ...string) {
+		t.Helper()
+		a := newDoItApp(t, f.ts, "0.10 0.20 0.30 1/100 12345", "z1", "rs1")
+		a.conf.Domain = "example.com"
+		a.stateFile = stateFile
+		a.initZones()
+		if len(args) > 0 {
+			if err := a.command(nil, args); err != nil {
+				t.Fatalf("%s: %v", args[0], err)
+			}
+			return
+		}
+		if _, err := a.runOnce(); err != nil {
+			t.Fatalf("runOnce: %v", err)
+		}
+	}
+
+	run("enable", "--for", "2h", "--reason", "product launch")
+	if len(f.rules) != 0 {
+		t.Fatalf("rules = %d, want the command to leave Cloudflare to the next check", len(f.rules))
+	}
+	st, err := loadState(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zs := st.zone("example.com")
+	if zs.Override != overrideEnable || zs.OverrideReason != "product launch" || time.Until(zs.OverrideUntil) < 119*time.Minute {
+		t.Errorf("saved override = %+v", zs)
+	}
+
+	run()
+	if len(f.rules) != 1 {
+		t.Fatalf("rules = %d, want the next check to enable the rule", len(f.rules))
+	}
+	if st, _ := loadState(stateFile); !strings.Contains(st.zone("example.com").EnabledReason, "product launch") {
+		t.Errorf("enabled reason = %q, want the override reason", st.zone("example.com").EnabledReason)
+	}
+
+	run("clear")
+	run()
+	if len(f.rules) != 0 {
+		t.Errorf("rules = %d after clear, want the signals to decide again", len(f.rules))
+	}
+}
+
+func TestOverrideCommand_DisableDespiteHighLoad(t *testing.T) {
+	f := newFakeCF(t, "z1", "rs1", []testRule{{ID: "rule-1", Ref: botCheckRef, Description: botCheckDescription}})
+	cmd := newDoItApp(t, f.ts, "10.00 8.00 6.00 5/200 12345", "z1", "rs1")
+	cmd.conf.Domain = "example.com"
+	cmd.stateFile = filepath.Join(t.TempDir(), "state")
+	cmd.initZones()
+	if err := cmd.command(nil, []string{"disable", "-for", "30m"}); err != nil {
+		t.Fatalf("disable: %v", err)
+	}
+	a := newDoItApp(t, f.ts, "10.00 8.00 6.00 5/200 12345", "z1", "rs1")
+	a.conf.Domain = "example.com"
+	a.stateFile = cmd.stateFile
+	a.minOn = time.Hour
+	if _, err := a.runOnce(); err != nil {
+		t.Fatalf("runOnce: %v", err)
+	}
+	if len(f.rules) != 0 {
+		t.Errorf("rules = %d, want the rule removed despite high load", len(f.rules))
+	}
+}
+
+func TestOverrideCommand_KeptByRunningCheck(t *testing.T) {
+	f := newFakeCF(t, "z1", "rs1", nil)
+	check := newDoItApp(t, f.ts, "0.10 0.20 0.30 1/100 12345", "z1", "rs1")
+	check.conf.Domain = "example.com"
+	check.stateFile = filepath.Join(t.TempDir(), "state")
+	check.initZones() // has read the state file
+
+	cmd := newDoItApp(t, f.ts, "0.10 0.20 0.30 1/100 12345", "z1", "rs1")
+	cmd.conf.Domain = "example.com"
+	cmd.stateFile = check.stateFile
+	cmd.initZones()
+	if err := cmd.command(nil, []string{"enable", "-for", "1h"}); err != nil {
+		t.Fatalf("enable: %v", err)
+	}
+	if _, err := check.runOnce(); err != nil {
+		t.Fatalf("runOnce: %v", err)
+	}
+	st, err := loadState(check.stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zs := st.zone("example.com"); zs.Override != overrideEnable || st.LastCheck.IsZero() {
+		t.Errorf("state after the check = %+v, last check %v; want the override and the check's own state", zs, st.LastCheck)
+	}
+}
+
+func TestOverrideCommand_Errors(t *testing.T) {
+	f := newFakeCF(t, "z1", "rs1", nil)
+	a := newDoItApp(t, f.ts, "0.10 0.20 0.30 1/100 12345", "z1", "rs1")
+	a.conf.Domain = "example.com"
+	a.stateFile = filepath.Join(t.TempDir(), "state")
+	a.initZones()
+	for _, args := range [][]string{
+		{"enable"},
+		{"disable", "-for", "-1h"},
+		{"enable", "-for", "1h", "-zone", "other.example"},
+		{"reboot"},
+	} {
+		if err := a.command(nil, args); err == nil {
+			t.Errorf("command(%q): expected error", args)
+		}
+	}
+	a.dryRun = true
+	for _, cmd := range []string{"enable", "disable", "clear"} {
+		if err := a.command(nil, []string{cmd, "-for", "1h"}); err == nil {
+			t.Errorf("%s with -dry-run: expected error", cmd)
+		}
+	}
+	if st, _ := loadState(a.stateFile); len(st.Zones) != 0 {
+		t.Errorf("state after failed commands = %+v", st.Zones)
+	}
+}
+
+func TestReloadOverrides(t *testing.T) {
+	f := newFakeCF(t, "z1", "rs1", nil)
+	a := newDoItApp(t, f.ts, "0.10 0.20 0.30 1/100 12345", "z1", "rs1")
+	a.conf.Domain = "example.com"
+	a.stateFile = filepath.Join(t.TempDir(), "state")
+	a.initZones()
+	a.daemon = true
+
+	// Another process sets an override in the state file.
+	st := &state{}
+	until := time.Now().Add(time.Hour).Round(0)
+	*st.zone("example.com") = zoneState{Override: overrideEnable, OverrideUntil: until}
+	if err := saveState(a.stateFile, st); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.runOnce(); err != nil {
+		t.Fatalf("runOnce: %v", err)
+	}
+	if len(f.rules) != 1 {
+		t.Errorf("rules = %d, want the daemon to apply the override", len(f.rules))
+	}
+}
+
+func TestStatusCommand(t *testing.T) {
+	f := newFakeCF(t, "z1", "rs1", nil)
+	a := newDoItApp(t, f.ts, "10.00 8.00 6.00 5/200 12345", "z1", "rs1")
+	a.conf.Domain = "example.com"
+	a.stateFile = filepath.Join(t.TempDir(), "state")
+	a.initZones()
+	if _, err := a.runOnce(); err != nil {
+		t.Fatalf("runOnce: %v", err)
+	}
+	a.zoneState().Override, a.zoneState().OverrideUntil = overrideEnable, time.Now().Add(time.Hour)
+
+	var out bytes.Buffer
+	if err := a.command(&out, []string{"status"}); err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	text := out.String()
+	for _, s := range []string{"Zone example.com", "rule-101 (managed_challenge)", "ago: load 10.00", "Override:", "load", "overload"} {
+		if !strings.Contains(text, s) {
+			t.Errorf("status missing %q:\n%s", s, text)
+		}
+	}
+
+	a.jsonOutput = true
+	out.Reset()
+	if err := a.command(&out, []string{"status"}); err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	var report statusReport
+	if err := json.Unmarshal(out.Bytes(), &report); err != nil {
+		t.Fatalf("status JSON: %v\n%s", err, out.String())
+	}
+	if len(report.Zones) != 1 || report.Zones[0].RuleID != "rule-101" || report.Zones[0].Override != overrideEnable || len(report.Signals) == 0 {
+		t.Errorf("report = %+v", report)
+	}
+}
+
+func TestStatusCommand_ChangesNothing(t *testing.T) {
+	dups := []testRule{
+		{ID: "rule-1", Description: botCheckDescription},
+		{ID: "rule-2", Description: botCheckDescription},
+	}
+	f := newFakeCF(t, "z1", "rs1", dups)
+	a := newDoItApp(t, f.ts, "10.00 8.00 6.00 5/200 12345", "z1", "rs1")
+	a.conf.Domain = "example.com"
+	a.stateFile = filepath.Join(t.TempDir(), "state")
+	a.initZones()
+	var out bytes.Buffer
+	if err := a.command(&out, []string{"status"}); err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	if len(f.rules) != 2 {
+		t.Errorf("rules = %d, want the duplicate left alone", len(f.rules))
+	}
+	if !strings.Contains(out.String(), "rule-1") {
+		t.Errorf("status does not show the rule:\n%s", out.String())
+	}
+
+	// Without a configured ruleset, a missing entrypoint is not created.
+	a.zones[0].conf.RulesetID = ""
+	out.Reset()
+	if err := a.command(&out, []string{"status"}); err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	if len(f.phases) != 0 {
+		t.Errorf("status created entrypoints %v", f.phases)
+	}
+}
+
+func TestApplyZone_OverrideMetric(t *testing.T) {
+	f := newFakeCF(t, "z1", "rs1", nil)
+	a := newDoItApp(t, f.ts, "0.10 0.20 0.30 1/100 12345", "z1", "rs1")
+	a.conf.Domain = "example.com"
+	a.stateFile = filepath.Join(t.TempDir(), "state")
+	a.initZones()
+	a.zoneState().Override, a.zoneState().OverrideUntil = overrideDisable, time.Now().Add(time.Hour)
+	_, metrics, err := a.applyZone(a.sampleSignals(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metrics["bot_check_override"] != -1 {
+		t.Errorf("bot_check_override = %v, want -1", metrics["bot_check_override"])
+	}
+}
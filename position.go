@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/amnonbc/underattack/cloudflare"
+)
+
+// parsePosition parses a rule position from the config: "" (leave it where
+// Cloudflare puts it: last when created, unchanged when updated), "first",
+// "last", "before:<ref>" or "after:<ref>", where ref identifies another rule
+// in the same ruleset.
+func parsePosition(pos string) (where, ref string, err error) {
+	switch pos {
+	case "", "first", "last":
+		return pos, "", nil
+	}
+	where, ref, ok := strings.Cut(pos, ":")
+	if !ok || (where != "before" && where != "after") || ref == "" {
+		return "", "", fmt.Errorf("invalid position %q, want first, last, before:<ref> or after:<ref>", pos)
+	}
+	return where, ref, nil
+}
+
+// withPosition sets payload's position for pos. Cloudflare
+// places rules relative to rule IDs, so a ref is looked up in rulesetID. If it
+// cannot be found the rule is placed without a position, rather than not at
+// all.
+func (a *app) withPosition(payload *cloudflare.Rule, rulesetID, pos string) error {
+	where, ref, err := parsePosition(pos)
+	if err != nil {
+		return err
+	}
+	switch where {
+	case "":
+		return nil
+	case "first":
+		payload.Position = cloudflare.First()
+		return nil
+	case "last":
+		payload.Position = cloudflare.Last()
+		return nil
+	}
+	rules, err := a.rulesetRules(rulesetID)
+	if err != nil {
+		slog.Warn("looking up rule position", "position", pos, "err", err)
+		return nil
+	}
+	for _, r := range rules {
+		if r.Ref == ref {
+			if where == "before" {
+				payload.Position = cloudflare.Before(r.ID)
+			} else {
+				payload.Position = cloudflare.After(r.ID)
+			}
+			return nil
+		}
+	}
+	slog.Warn("no rule with ref for position, leaving position unchanged", "position", pos)
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestParsePosition(t *testing.T) {
+	for _, tc := range []struct {
+		pos, where, ref string
+		ok              bool
+	}{
+		{"", "", "", true},
+		{"first", "first", "", true},
+		{"last", "last", "", true},
+		{"before:waf_allow", "before", "waf_allow", true},
+		{"after:waf_allow", "after", "waf_allow", true},
+		{"after:", "", "", false},
+		{"top", "", "", false},
+		{"under:x", "", "", false},
+	} {
+		where, ref, err := parsePosition(tc.pos)
+		if (err == nil) != tc.ok || where != tc.where || ref != tc.ref {
+			t.Errorf("parsePosition(%q) = %q, %q, %v", tc.pos, where, ref, err)
+		}
+	}
+}
+
+func TestFindRule_ByRefAfterDescriptionEdited(t *testing.T) {
+	edited := testRule{ID: "rule-1", Ref: botCheckRef, Description: "renamed in the dashboard"}
+	ts, _ := rulesetServer(t, "zp1", "rs1", []testRule{edited})
+	info, err := appForServer(ts, "zp1", "rs1").findRule()
+	if err != nil {
+		t.Fatalf("findRule: %v", err)
+	}
+	if info == nil || info.ID != "rule-1" {
+		t.Errorf("findRule = %+v, want rule-1 found by its ref", info)
+	}
+}
+
+func TestFindRule_DeletesDuplicates(t *testing.T) {
+	ts, rules := rulesetServer(t, "zp2", "rs1", []testRule{
+		{ID: "legacy", Description: botCheckDescription},
+		{ID: "other", Description: "someone else's rule"},
+		{ID: "current", Ref: botCheckRef, Description: botCheckDescription},
+		{ID: "legacy-2", Description: botCheckDescription},
+	})
+	info, err := appForServer(ts, "zp2", "rs1").findRule()
+	if err != nil {
+		t.Fatalf("findRule: %v", err)
+	}
+	if info == nil || info.ID != "current" {
+		t.Errorf("findRule = %+v, want the rule with our ref", info)
+	}
+	if len(*rules) != 2 || (*rules)[0].ID != "other" || (*rules)[1].ID != "current" {
+		t.Errorf("rules = %+v, want duplicates deleted and other rules left alone", *rules)
+	}
+}
+
+func TestEnsureBotCheck_AddsRefToLegacyRule(t *testing.T) {
+	legacy := testRule{ID: "rule-1", Description: botCheckDescription}
+	ts, rules := rulesetServer(t, "zp3", "rs1", []testRule{legacy})
+	a := appForServer(ts, "zp3", "rs1")
+	if err := a.ensureBotCheck(true, "test"); err != nil {
+		t.Fatalf("ensureBotCheck: %v", err)
+	}
+	if len(*rules) != 1 || (*rules)[0].ID != "rule-1" || (*rules)[0].Ref != botCheckRef {
+		t.Errorf("rules = %+v, want rule-1 given our ref in place", *rules)
+	}
+}
+
+func TestEnsureBotCheck_CreatesWithRef(t *testing.T) {
+	ts, rules := rulesetServer(t, "zp4", "rs1", nil)
+	if err := appForServer(ts, "zp4", "rs1").ensureBotCheck(true, "test"); err != nil {
+		t.Fatalf("ensureBotCheck: %v", err)
+	}
+	if len(*rules) != 1 || (*rules)[0].Ref != botCheckRef {
+		t.Errorf("rules = %+v, want one rule with ref %s", *rules, botCheckRef)
+	}
+}
+
+func positionedRules() []testRule {
+	return []testRule{
+		{ID: "allow", Ref: "allow_office", Description: "Allow office"},
+		{ID: "block", Ref: "block_asn", Description: "Block ASN"},
+	}
+}
+
+func TestEnsureBotCheck_Position(t *testing.T) {
+	for _, tc := range []struct {
+		position string
+		want     []string
+	}{
+		{"", []string{"allow", "block", "new"}},
+		{"first", []string{"new", "allow", "block"}},
+		{"last", []string{"allow", "block", "new"}},
+		{"after:allow_office", []string{"allow", "new", "block"}},
+		{"before:allow_office", []string{"new", "allow", "block"}},
+		{"before:missing", []string{"allow", "block", "new"}},
+	} {
+		t.Run(tc.position, func(t *testing.T) {
+			ts, rules := rulesetServer(t, "zp5", "rs1", positionedRules())
+			a := appForServer(ts, "zp5", "rs1")
+			a.conf.Position = tc.position
+			if err := a.ensureBotCheck(true, "test"); err != nil {
+				t.Fatalf("ensureBotCheck: %v", err)
+			}
+			var got []string
+			for _, r := range *rules {
+				if r.Ref == botCheckRef {
+					got = append(got, "new")
+				} else {
+					got = append(got, r.ID)
+				}
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("rules = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestEnsureBotCheck_PositionAppliedOnUpdate(t *testing.T) {
+	rules := append(positionedRules(), testRule{ID: "ours", Ref: botCheckRef, Description: botCheckDescription, Expression: "old expression"})
+	f := newFakeCF(t, "zp6", "rs1", rules)
+	a := appForServer(f.ts, "zp6", "rs1")
+	a.conf.Position = "first"
+	if err := a.ensureBotCheck(true, "test"); err != nil {
+		t.Fatalf("ensureBotCheck: %v", err)
+	}
+	if f.rules[0].ID != "ours" || f.rules[0].Expression == "old expression" {
+		t.Errorf("rules = %+v, want ours updated and moved first", f.rules)
+	}
+}
+
+func TestEnsureBotCheck_FallbackReplacementFoundByDescription(t *testing.T) {
+	stale := testRule{ID: "old-rule", Ref: botCheckRef, Description: botCheckDescription, Expression: "old expression"}
+	f := newFakeCF(t, "zp7", "rs1", []testRule{stale})
+	f.fail[http.MethodPatch] = true
+	a := appForServer(f.ts, "zp7", "rs1")
+	if err := a.ensureBotCheck(true, "test"); err != nil {
+		t.Fatalf("ensureBotCheck: %v", err)
+	}
+	info, err := a.findRule()
+	if err != nil || info == nil || info.ID != f.rules[0].ID || info.ID == "old-rule" {
+		t.Errorf("findRule = %+v, %v; want the replacement", info, err)
+	}
+}
+
+func TestLoadConfig_InvalidPosition(t *testing.T) {
+	fn := writeTempLoadFile(t, `{"ApiKey": "k", "Domain": "example.com", "RulesetID": "rs1", "Position": "middle"}`)
+	if err := newTestApp().loadConfig(fn); err == nil {
+		t.Error("expected error for an invalid position")
+	}
+}
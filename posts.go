@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PostsConfig configures exemptions for individual WordPress posts, looked up
+// in the database, for sites whose article URLs carry no date. Posts published
+// in the last Days days are exempted, along with the Trending most viewed
+// posts if ViewsKey names a view counter in wp_postmeta.
+type PostsConfig struct {
+	Days        int      // exempt posts published within this many days; 0 to disable
+	Limit       int      // most recent posts to exempt; default 500
+	ViewsKey    string   // postmeta key holding a view count, e.g. "post_views_count"
+	Trending    int      // number of most viewed posts to exempt
+	Permalink   string   // permalink structure; defaults to the site's permalink_structure option
+	TablePrefix string   // WordPress table prefix; default "wp_"
+	Refresh     duration // how long a looked-up post list is reused; default 10m
+}
+
+// enabled reports whether any post exemption is configured.
+func (pc PostsConfig) enabled() bool {
+	return pc.Days > 0 || (pc.ViewsKey != "" && pc.Trending > 0)
+}
+
+var tablePrefixRE = regexp.MustCompile(`^[A-Za-z0-9_]*$`)
+
+// validate checks the settings that end up in SQL or URLs.
+func (pc PostsConfig) validate() error {
+	if !tablePrefixRE.MatchString(pc.TablePrefix) {
+		return fmt.Errorf("posts: invalid table prefix %q", pc.TablePrefix)
+	}
+	if pc.Permalink != "" {
+		if _, err := permalinkPath(pc.Permalink, post{}); err != nil {
+			return fmt.Errorf("posts: %w", err)
+		}
+	}
+	return nil
+}
+
+// post is a published WordPress post.
+type post struct {
+	ID   int64
+	Name string // the slug
+	Date time.Time
+}
+
+// postCache holds the exempted post paths between lookups.
+type postCache struct {
+	paths []string
+	at    time.Time
+}
+
+// postPaths returns the paths of the posts to exempt, most important first:
+// recent posts newest first, then trending posts by views. The list is
+// reused for Posts.Refresh. If the database cannot be queried the previous
+// list is kept, since the database is often what is overloaded.
+func (a *app) postPaths() []string {
+	pc := a.conf.Posts
+	if !pc.enabled() {
+		return nil
+	}
+	refresh := time.Duration(pc.Refresh)
+	if refresh == 0 {
+		refresh = 10 * time.Minute
+	}
+	if !a.posts.at.IsZero() && time.Since(a.posts.at) < refresh {
+		return a.posts.paths
+	}
+	paths, err := a.queryPostPaths()
+	if err != nil {
+		slog.Warn("looking up posts to exempt", "err", err, "kept", len(a.posts.paths))
+		return a.posts.paths
+	}
+	a.posts = postCache{paths: paths, at: time.Now()}
+	return paths
+}
+
+// queryPostPaths reads the posts to exempt from the WordPress database.
+func (a *app) queryPostPaths() ([]string, error) {
+	pc := a.conf.Posts
+	prefix := pc.TablePrefix
+	if prefix == "" {
+		prefix = "wp_"
+	}
+	limit := pc.Limit
+	if limit == 0 {
+		limit = 500
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), a.dbTimeout)
+	defer cancel()
+	db, err := a.openDb()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	permalink := pc.Permalink
+	if permalink == "" {
+		q := fmt.Sprintf("SELECT option_value FROM %soptions WHERE option_name = 'permalink_structure'", prefix)
+		if err := db.QueryRowContext(ctx, q).Scan(&permalink); err != nil {
+			return nil, fmt.Errorf("reading permalink structure: %w", err)
+		}
+		if permalink == "" {
+			return nil, fmt.Errorf("site uses plain permalinks, which cannot be matched by path")
+		}
+	}
+
+	var posts []post
+	if pc.Days > 0 {
+		q := fmt.Sprintf(`SELECT ID, post_name, post_date FROM %sposts
+			WHERE post_type = 'post' AND post_status = 'publish' AND post_date_gmt >= ?
+			ORDER BY post_date_gmt DESC LIMIT ?`, prefix)
+		since := time.Now().UTC().AddDate(0, 0, -pc.Days)
+		p, err := queryPosts(ctx, db, q, since.Format(time.DateTime), limit)
+		if err != nil {
+			return nil, fmt.Errorf("reading recent posts: %w", err)
+		}
+		if len(p) == limit {
+			slog.Warn("more recent posts than the limit; exempting only the newest", "limit", limit, "days", pc.Days)
+		}
+		posts = append(posts, p...)
+	}
+	if pc.ViewsKey != "" && pc.Trending > 0 {
+		q := fmt.Sprintf(`SELECT p.ID, p.post_name, p.post_date FROM %[1]sposts p
+			JOIN %[1]spostmeta m ON m.post_id = p.ID AND m.meta_key = ?
+			WHERE p.post_type = 'post' AND p.post_status = 'publish'
+			ORDER BY CAST(m.meta_value AS UNSIGNED) DESC LIMIT ?`, prefix)
+		p, err := queryPosts(ctx, db, q, pc.ViewsKey, pc.Trending)
+		if err != nil {
+			return nil, fmt.Errorf("reading trending posts: %w", err)
+		}
+		posts = append(posts, p...)
+	}
+
+	var paths []string
+	seen := map[string]bool{}
+	for _, p := range posts {
+		path, err := permalinkPath(permalink, p)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+	slog.Debug("posts to exempt", "count", len(paths))
+	return paths, nil
+}
+
+// queryPosts runs a query returning ID, post_name and post_date columns.
+func queryPosts(ctx context.Context, db *sql.DB, q string, args ...any) ([]post, error) {
+	rows, err := db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var posts []post
+	for rows.Next() {
+		var p post
+		var date string
+		if err := rows.Scan(&p.ID, &p.Name, &date); err != nil {
+			return nil, err
+		}
+		if p.Date, err = time.Parse(time.DateTime, date); err != nil {
+			return nil, fmt.Errorf("post %d: %w", p.ID, err)
+		}
+		posts = append(posts, p)
+	}
+	return posts, rows.Err()
+}
+
+var permalinkTagRE = regexp.MustCompile(`%[a-z_]+%`)
+
+// permalinkPath expands a WordPress permalink structure such as
+// "/%year%/%monthnum%/%postname%/" for p. Tags that need other tables, such as
+// %category% and %author%, are not supported.
+func permalinkPath(structure string, p post) (string, error) {
+	var err error
+	path := permalinkTagRE.ReplaceAllStringFunc(structure, func(tag string) string {
+		switch tag {
+		case "%year%":
+			return p.Date.Format("2006")
+		case "%monthnum%":
+			return p.Date.Format("01")
+		case "%day%":
+			return p.Date.Format("02")
+		case "%hour%":
+			return p.Date.Format("15")
+		case "%minute%":
+			return p.Date.Format("04")
+		case "%second%":
+			return p.Date.Format("05")
+		case "%postname%":
+			return p.Name
+		case "%post_id%":
+			return strconv.FormatInt(p.ID, 10)
+		}
+		err = fmt.Errorf("unsupported permalink tag %s", tag)
+		return tag
+	})
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path, nil
+}
+
+// postsClause returns the expression excluding the first n of paths, or all
+// of them if n is negative.
+func postsClause(paths []string, n int) string {
+	if n >= 0 && n < len(paths) {
+		paths = paths[:n]
+	}
+	if len(paths) == 0 {
+		return ""
+	}
+	quoted := make([]string, len(paths))
+	for i, p := range paths {
+		quoted[i] = quoteExpr(p)
+	}
+	return "not http.request.uri.path in {" + strings.Join(quoted, " ") + "}"
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPermalinkPath(t *testing.T) {
+	p := post{ID: 42, Name: "big-story", Date: time.Date(2026, 4, 9, 7, 5, 3, 0, time.UTC)}
+	for _, tc := range []struct {
+		structure, want string
+	}{
+		{"/%postname%/", "/big-story/"},
+		{"/%year%/%monthnum%/%day%/%postname%/", "/2026/04/09/big-story/"},
+		{"/articles/%post_id%", "/articles/42"},
+		{"%year%/%hour%%minute%%second%-%postname%", "/2026/070503-big-story"},
+	} {
+		got, err := permalinkPath(tc.structure, p)
+		if err != nil {
+			t.Errorf("permalinkPath(%q): %v", tc.structure, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("permalinkPath(%q) = %q, want %q", tc.structure, got, tc.want)
+		}
+	}
+	if _, err := permalinkPath("/%category%/%postname%/", p); err == nil {
+		t.Error("expected error for the category tag")
+	}
+}
+
+func TestPostsConfig_Validate(t *testing.T) {
+	if err := (PostsConfig{TablePrefix: "wp_; DROP TABLE x"}).validate(); err == nil {
+		t.Error("expected error for a table prefix that is not an identifier")
+	}
+	if err := (PostsConfig{Permalink: "/%author%/%postname%/"}).validate(); err == nil {
+		t.Error("expected error for an unsupported permalink tag")
+	}
+	if err := (PostsConfig{TablePrefix: "wp2_", Permalink: "/%postname%/"}).validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestLoadConfig_PostsWithZones(t *testing.T) {
+	fn := writeTempLoadFile(t, `{"ApiKey": "k", "Posts": {"Days": 7}, "Zones": [{"Domain": "a.example"}, {"Domain": "b.example"}]}`)
+	if err := newTestApp().loadConfig(fn); err == nil {
+		t.Error("expected error for Posts with Zones")
+	}
+}
+
+func TestPostsClause(t *testing.T) {
+	paths := []string{"/a/", "/b/", "/c/"}
+	if got, want := postsClause(paths, -1), `not http.request.uri.path in {"/a/" "/b/" "/c/"}`; got != want {
+		t.Errorf("postsClause = %s, want %s", got, want)
+	}
+	if got, want := postsClause(paths, 1), `not http.request.uri.path in {"/a/"}`; got != want {
+		t.Errorf("postsClause(1) = %s, want %s", got, want)
+	}
+	if got := postsClause(nil, -1); got != "" {
+		t.Errorf("postsClause(nil) = %q, want empty", got)
+	}
+}
+
+// withPosts returns an app exempting paths, as if just read from the database.
+func withPosts(paths ...string) *app {
+	a := newApp()
+	a.conf.Posts = PostsConfig{Days: 7}
+	a.posts = postCache{paths: paths, at: time.Now()}
+	return a
+}
+
+func TestBuildExpression_ExemptsPosts(t *testing.T) {
+	expr := mustBuildExpression(t, withPosts("/big-story/", "/other-story/"))
+	if want := `and not http.request.uri.path in {"/big-story/" "/other-story/"}`; !strings.Contains(expr, want) {
+		t.Errorf("expression missing %q:\n%s", want, expr)
+	}
+}
+
+func TestBuildExpression_NoPostsConfigured(t *testing.T) {
+	a := newApp()
+	a.posts = postCache{paths: []string{"/big-story/"}, at: time.Now()}
+	if expr := mustBuildExpression(t, a); strings.Contains(expr, "big-story") {
+		t.Errorf("posts exempted without Config.Posts: %s", expr)
+	}
+}
+
+func TestBuildExpression_TruncatesPostsToLengthLimit(t *testing.T) {
+	var paths []string
+	for i := range 500 {
+		paths = append(paths, fmt.Sprintf("/story-number-%d/", i))
+	}
+	expr := mustBuildExpression(t, withPosts(paths...))
+	if len(expr) > maxExpressionLen {
+		t.Errorf("expression is %d characters, limit %d", len(expr), maxExpressionLen)
+	}
+	if !strings.Contains(expr, `"/story-number-0/"`) {
+		t.Error("the most important post should be kept")
+	}
+	if strings.Contains(expr, `"/story-number-499/"`) {
+		t.Error("the least important post should be dropped")
+	}
+	if !strings.Contains(expr, "not (http.request.uri.path contains") {
+		t.Error("date exemptions should be kept when posts are truncated")
+	}
+}
+
+func TestPostPaths_KeepsListWhenDatabaseFails(t *testing.T) {
+	a := withPosts("/big-story/")
+	a.conf.DbName, a.conf.DbUser = "nodb", "nobody"
+	a.dbTimeout = 100 * time.Millisecond
+	a.posts.at = time.Now().Add(-time.Hour)
+	if got := a.postPaths(); len(got) != 1 || got[0] != "/big-story/" {
+		t.Errorf("postPaths = %q, want the previous list", got)
+	}
+}
+
+func TestExpressionCurrent_PostsChanged(t *testing.T) {
+	a := withPosts("/new-story/")
+	today := time.Now().Format(a.dateFormat)
+	if a.expressionCurrent(`http.request.uri.path contains "/` + today + `/" and not http.request.uri.path in {"/old-story/"}`) {
+		t.Error("a rule listing old posts should be refreshed even if it exempts today")
+	}
+	if !a.expressionCurrent(mustBuildExpression(t, a)) {
+		t.Error("a rule matching the built expression should be kept")
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	registerSignal("psi", newPSISignal)
+}
+
+// psiSignal triggers on Linux pressure stall information for one resource
+// (cpu, memory or io). Thresholds are keyed by line and window, e.g.
+// "some_avg10" or "full_avg60", and are percentages of wall time stalled.
+type psiSignal struct {
+	Resource string
+	File     string
+	Enable   map[string]float64 // overload if any value reaches its threshold
+	Disable  map[string]float64 // recovered once every value is below its threshold
+}
+
+func newPSISignal(a *app, params json.RawMessage) (Signal, error) {
+	s := &psiSignal{Resource: "cpu"}
+	if err := json.Unmarshal(params, s); err != nil {
+		return nil, err
+	}
+	if s.File == "" {
+		switch s.Resource {
+		case "cpu":
+			s.File = a.psiCPUFile
+		case "memory":
+			s.File = a.psiMemoryFile
+		case "io":
+			s.File = a.psiIOFile
+		default:
+			return nil, fmt.Errorf("unknown PSI resource %q", s.Resource)
+		}
+	}
+	if len(s.Enable) == 0 {
+		s.Enable = map[string]float64{"some_avg60": 50}
+	}
+	if len(s.Disable) == 0 {
+		s.Disable = map[string]float64{"some_avg60": 10}
+	}
+	for _, k := range slices.Concat(slices.Collect(maps.Keys(s.Enable)), slices.Collect(maps.Keys(s.Disable))) {
+		if !validPSIKey(k) {
+			return nil, fmt.Errorf("invalid PSI threshold %q (want some_avg10, full_avg60, ...)", k)
+		}
+	}
+	return s, nil
+}
+
+func (s *psiSignal) Name() string { return "psi_" + s.Resource }
+
+func (s *psiSignal) Sample() (Reading, error) {
+	text, err := os.ReadFile(s.File)
+	if err != nil {
+		return Reading{}, err
+	}
+	vals, err := parsePSI(string(text))
+	if err != nil {
+		return Reading{}, fmt.Errorf("%s: %w", s.File, err)
+	}
+	r := Reading{Verdict: Recovered, Metrics: map[string]float64{}}
+	for k, v := range vals {
+		r.Metrics["psi_"+s.Resource+"_"+k] = v
+	}
+	for _, k := range slices.Sorted(maps.Keys(s.Enable)) {
+		v, ok := vals[k]
+		if !ok {
+			return Reading{}, fmt.Errorf("%s: no %s value", s.File, k)
+		}
+		if v >= s.Enable[k] {
+			r.Verdict, r.Reason = Overload, fmt.Sprintf("%s pressure %s %.2f", s.Resource, k, v)
+			return r, nil
+		}
+	}
+	for k, limit := range s.Disable {
+		v, ok := vals[k]
+		if !ok {
+			return Reading{}, fmt.Errorf("%s: no %s value", s.File, k)
+		}
+		if v >= limit {
+			r.Verdict = Neutral
+		}
+	}
+	return r, nil
+}
+
+// parsePSI parses the contents of a /proc/pressure file, returning the avg
+// values keyed by line and window, e.g. "some_avg10". Totals are ignored.
+func parsePSI(text string) (map[string]float64, error) {
+	vals := map[string]float64{}
+	for line := range strings.Lines(text) {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		kind := fields[0]
+		if kind != "some" && kind != "full" {
+			return nil, fmt.Errorf("unexpected line %q", strings.TrimSpace(line))
+		}
+		for _, f := range fields[1:] {
+			name, value, ok := strings.Cut(f, "=")
+			if !ok {
+				return nil, fmt.Errorf("malformed field %q", f)
+			}
+			if !strings.HasPrefix(name, "avg") {
+				continue
+			}
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, err
+			}
+			vals[kind+"_"+name] = v
+		}
+	}
+	if len(vals) == 0 {
+		return nil, fmt.Errorf("no pressure values found")
+	}
+	return vals, nil
+}
+
+// validPSIKey reports whether k names a PSI value, e.g. "some_avg10".
+func validPSIKey(k string) bool {
+	kind, window, ok := strings.Cut(k, "_")
+	return ok && (kind == "some" || kind == "full") && slices.Contains([]string{"avg10", "avg60", "avg300"}, window)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+const psiFixture = `some avg10=12.50 avg60=8.00 avg300=3.25 total=123456
+full avg10=4.00 avg60=2.00 avg300=0.50 total=65432
+`
+
+func TestParsePSI(t *testing.T) {
+	vals, err := parsePSI(psiFixture)
+	if err != nil {
+		t.Fatalf("parsePSI error: %v", err)
+	}
+	want := map[string]float64{
+		"some_avg10": 12.5, "some_avg60": 8, "some_avg300": 3.25,
+		"full_avg10": 4, "full_avg60": 2, "full_avg300": 0.5,
+	}
+	if len(vals) != len(want) {
+		t.Errorf("parsePSI returned %d values, want %d: %v", len(vals), len(want), vals)
+	}
+	for k, w := range want {
+		if vals[k] != w {
+			t.Errorf("%s = %v, want %v", k, vals[k], w)
+		}
+	}
+}
+
+func TestParsePSI_Invalid(t *testing.T) {
+	for _, in := range []string{"", "bogus avg10=1", "some avg10=x", "some avg10"} {
+		if _, err := parsePSI(in); err == nil {
+			t.Errorf("parsePSI(%q): expected error, got nil", in)
+		}
+	}
+}
+
+func newTestPSISignal(t *testing.T, params string) Signal {
+	t.Helper()
+	a := newTestApp()
+	a.psiCPUFile = writeTempLoadFile(t, psiFixture)
+	s, err := newPSISignal(a, json.RawMessage(params))
+	if err != nil {
+		t.Fatalf("newPSISignal error: %v", err)
+	}
+	return s
+}
+
+func TestPSISignal_Verdicts(t *testing.T) {
+	cases := []struct {
+		params string
+		want   Verdict
+	}{
+		{`{"Enable": {"some_avg10": 10}, "Disable": {"some_avg10": 5}}`, Overload},
+		{`{"Enable": {"full_avg10": 50}, "Disable": {"some_avg60": 10}}`, Recovered},
+		{`{"Enable": {"some_avg10": 50}, "Disable": {"some_avg10": 10, "full_avg60": 5}}`, Neutral},
+	}
+	for _, tc := range cases {
+		r, err := newTestPSISignal(t, tc.params).Sample()
+		if err != nil {
+			t.Fatalf("%s: Sample error: %v", tc.params, err)
+		}
+		if r.Verdict != tc.want {
+			t.Errorf("%s: verdict = %v, want %v", tc.params, r.Verdict, tc.want)
+		}
+	}
+}
+
+func TestPSISignal_Metrics(t *testing.T) {
+	r, err := newTestPSISignal(t, `{}`).Sample()
+	if err != nil {
+		t.Fatalf("Sample error: %v", err)
+	}
+	if r.Metrics["psi_cpu_some_avg10"] != 12.5 || r.Metrics["psi_cpu_full_avg60"] != 2 {
+		t.Errorf("metrics = %v", r.Metrics)
+	}
+}
+
+func TestPSISignal_OverloadReason(t *testing.T) {
+	r, _ := newTestPSISignal(t, `{"Enable": {"some_avg60": 5}}`).Sample()
+	if r.Reason != "cpu pressure some_avg60 8.00" {
+		t.Errorf("reason = %q", r.Reason)
+	}
+}
+
+func TestPSISignal_InvalidConfig(t *testing.T) {
+	a := newTestApp()
+	for _, params := range []string{`{"Resource": "disk"}`, `{"Enable": {"avg10": 1}}`, `{"Disable": {"some_avg5": 1}}`} {
+		if _, err := newPSISignal(a, json.RawMessage(params)); err == nil {
+			t.Errorf("newPSISignal(%s): expected error, got nil", params)
+		}
+	}
+}
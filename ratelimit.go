@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"github.com/amnonbc/underattack/cloudflare"
+)
+
+const (
+	rateLimitDescription = "Bot rate limit"
+	rateLimitRef         = "underattack_rate_limit"
+	rateLimitPhase       = "http_ratelimit"
+)
+
+// Mitigation modes, selected by Config.Mode.
+const (
+	modeChallenge = "challenge" // manage the custom challenge rule (default)
+	modeRateLimit = "ratelimit" // manage a rate limiting rule instead
+	modeBoth      = "both"      // manage both rules together
+)
+
+// RateLimitConfig configures the rate limiting rule used in the ratelimit and
+// both modes. Zero fields take the defaults in defaultRateLimit.
+type RateLimitConfig struct {
+	Characteristics string // "ip" or "ip+ua": what requests are counted by
+	Period          int    // seconds; one of 10, 60, 120, 300, 600 or 3600
+	Requests        int    // requests allowed per Period
+	Timeout         int    // seconds a client stays blocked once over the limit
+	Action          string // e.g. "block" or "managed_challenge"
+	Position        string // where the rule goes in the phase entrypoint; see parsePosition
+}
+
+var defaultRateLimit = RateLimitConfig{Characteristics: "ip", Period: 60, Requests: 60, Timeout: 600, Action: "block"}
+
+var rateLimitPeriods = []int{10, 60, 120, 300, 600, 3600}
+
+// mode returns the configured mitigation mode.
+func (a *app) mode() string {
+	if a.conf.Mode == "" {
+		return modeChallenge
+	}
+	return a.conf.Mode
+}
+
+// rateLimit returns the rate limit settings with defaults filled in.
+func (a *app) rateLimit() RateLimitConfig {
+	rl := a.conf.RateLimit
+	if rl.Characteristics == "" {
+		rl.Characteristics = defaultRateLimit.Characteristics
+	}
+	if rl.Period == 0 {
+		rl.Period = defaultRateLimit.Period
+	}
+	if rl.Requests == 0 {
+		rl.Requests = defaultRateLimit.Requests
+	}
+	if rl.Timeout == 0 {
+		rl.Timeout = defaultRateLimit.Timeout
+	}
+	if rl.Action == "" {
+		rl.Action = defaultRateLimit.Action
+	}
+	return rl
+}
+
+// validateMode checks the mitigation mode and rate limit settings.
+func (a *app) validateMode() error {
+	switch a.mode() {
+	case modeChallenge:
+		return nil
+	case modeRateLimit, modeBoth:
+	default:
+		return fmt.Errorf("unknown mode %q (want %s, %s or %s)", a.conf.Mode, modeChallenge, modeRateLimit, modeBoth)
+	}
+	rl := a.rateLimit()
+	if rl.Characteristics != "ip" && rl.Characteristics != "ip+ua" {
+		return fmt.Errorf("rate limit characteristics %q (want ip or ip+ua)", rl.Characteristics)
+	}
+	if !slices.Contains(rateLimitPeriods, rl.Period) {
+		return fmt.Errorf("rate limit period %d (want one of %v)", rl.Period, rateLimitPeriods)
+	}
+	if rl.Requests < 0 || rl.Timeout < 0 {
+		return fmt.Errorf("rate limit requests and timeout must be positive")
+	}
+	return nil
+}
+
+// characteristics returns the Cloudflare counting characteristics for rl.
+// cf.colo.id is mandatory.
+func (rl RateLimitConfig) characteristics() []string {
+	c := []string{"cf.colo.id", "ip.src"}
+	if rl.Characteristics == "ip+ua" {
+		c = append(c, `http.request.headers["user-agent"]`)
+	}
+	return c
+}
+
+// params returns the Cloudflare rate limit parameters for rl.
+func (rl RateLimitConfig) params() *cloudflare.RateLimit {
+	return &cloudflare.RateLimit{
+		Characteristics:   rl.characteristics(),
+		Period:            rl.Period,
+		RequestsPerPeriod: rl.Requests,
+		MitigationTimeout: rl.Timeout,
+	}
+}
+
+// matches reports whether r has rl's action and rate limit parameters.
+func (rl RateLimitConfig) matches(r *cloudflare.Rule) bool {
+	want := rl.params()
+	got := r.RateLimit
+	return r.Action == rl.Action && got != nil &&
+		got.Period == want.Period && got.RequestsPerPeriod == want.RequestsPerPeriod &&
+		got.MitigationTimeout == want.MitigationTimeout &&
+		slices.Equal(got.Characteristics, want.Characteristics)
+}
+
+// phaseEntrypoint returns the ID of the zone's entrypoint ruleset for phase,
+// creating an empty one if it does not exist yet.
+func (a *app) phaseEntrypoint(phase string) (string, error) {
+	rs, err := a.cf().PhaseEntrypoint(a.apiContext(), a.zoneId, phase)
+	if err == nil {
+		return rs.ID, nil
+	}
+	if !cloudflare.IsNotFound(err) {
+		return "", err
+	}
+	if a.plan != nil {
+		a.plan.change(a.conf.Domain, plannedChange{Action: "create_entrypoint", Value: phase})
+		return plannedRuleset, nil
+	}
+	// PUT on a missing entrypoint creates it.
+	rs, err = a.cf().UpdatePhaseEntrypoint(a.apiContext(), a.zoneId, phase, nil)
+	if err != nil {
+		return "", fmt.Errorf("creating %s entrypoint: %w", phase, err)
+	}
+	slog.Info("created entrypoint ruleset", "phase", phase, "id", rs.ID)
+	return rs.ID, nil
+}
+
+// rateLimitRuleset returns the ID of the zone's http_ratelimit entrypoint
+// ruleset, discovering it on first use and remembering it in the state file.
+func (a *app) rateLimitRuleset() (string, error) {
+	zs := a.zoneState()
+	if zs.RateLimitRulesetID != "" {
+		return zs.RateLimitRulesetID, nil
+	}
+	id, err := a.phaseEntrypoint(rateLimitPhase)
+	if err != nil {
+		return "", fmt.Errorf("finding rate limit ruleset: %w", err)
+	}
+	zs.RateLimitRulesetID = id
+	return id, nil
+}
+
+// currentRateLimitRule returns the rate limiting rule, using the result of an
+// earlier lookup if it is less than a.ruleRefresh old.
+func (a *app) currentRateLimitRule(rulesetID string) (*cloudflare.Rule, error) {
+	if info, ok := a.rateLimitRule.get(a.ruleRefresh); ok {
+		return info, nil
+	}
+	info, err := a.findRuleIn(rulesetID, rateLimitRef, rateLimitDescription)
+	if err != nil {
+		return nil, err
+	}
+	a.rateLimitRule.set(info)
+	return info, nil
+}
+
+// ensureRateLimit creates the rate limiting rule (active=true) or removes it
+// (active=false). Like ensureBotCheck, an existing rule is only updated, in
+// place, when its expression, action or rate limit settings are out of date.
+func (a *app) ensureRateLimit(active bool, reason string) error {
+	rulesetID, err := a.rateLimitRuleset()
+	if err != nil {
+		return err
+	}
+	info, err := a.currentRateLimitRule(rulesetID)
+	if err != nil {
+		a.zoneState().RateLimitRulesetID = "" // rediscover next time in case it was replaced
+		return fmt.Errorf("finding rate limit rule: %w", err)
+	}
+	if info != nil && !active {
+		if err := a.deleteRuleIn(rulesetID, info.ID); err != nil {
+			a.rateLimitRule.forget()
+			return err
+		}
+		a.rateLimitRule.set(nil)
+		slog.Info("deleted rate limit rule", "id", info.ID, "reason", reason)
+		a.notify(event{Kind: eventDisabled, Rule: rateLimitDescription, RuleID: info.ID, Reason: reason})
+		return nil
+	}
+	rl := a.rateLimit()
+	if !active || (info != nil && info.Ref == rateLimitRef && a.expressionCurrent(info.Expression) && rl.matches(info)) {
+		return nil
+	}
+
+	expr, err := a.buildExpression()
+	if err != nil {
+		return err
+	}
+	payload := cloudflare.Rule{
+		Action:      rl.Action,
+		Description: rateLimitDescription,
+		Ref:         rateLimitRef,
+		Enabled:     true,
+		Expression:  expr,
+		RateLimit:   rl.params(),
+	}
+	if err := a.withPosition(&payload, rulesetID, rl.Position); err != nil {
+		return err
+	}
+	var r *cloudflare.Rule
+	if info != nil {
+		r, err = a.updateRuleIn(rulesetID, info, payload)
+	} else {
+		r, err = a.postRule(rulesetID, payload)
+	}
+	a.rateLimitRule.forget()
+	if err != nil {
+		return err
+	}
+	if r != nil {
+		a.rateLimitRule.set(r)
+		verb := "created"
+		if info != nil {
+			verb = "updated"
+		}
+		ruleURL := a.cf().URL("zones", a.zoneId, "rulesets", rulesetID, "rules", r.ID)
+		slog.Info(verb+" rate limit rule", "reason", reason, "id", r.ID, "url", ruleURL)
+		if info == nil {
+			a.notify(event{Kind: eventEnabled, Rule: rateLimitDescription, RuleID: r.ID, Action: r.Action, Reason: reason, URL: ruleURL})
+		}
+	}
+	return nil
+}
+
+// ensureMitigation enables or disables whichever rules the mode calls for.
+func (a *app) ensureMitigation(active bool, reason string) error {
+	if a.mode() != modeRateLimit {
+		if err := a.ensureBotCheck(active, reason); err != nil {
+			return err
+		}
+	}
+	if a.mode() != modeChallenge {
+		if err := a.ensureRateLimit(active, reason); err != nil {
+			return fmt.Errorf("rate limit rule: %w", err)
+		}
+	}
+	return nil
+}
+
+// mitigationActive reports whether the managed rules are currently in place.
+func (a *app) mitigationActive() (bool, error) {
+	if a.mode() == modeRateLimit {
+		rulesetID, err := a.rateLimitRuleset()
+		if err != nil {
+			return false, err
+		}
+		info, err := a.currentRateLimitRule(rulesetID)
+		return info != nil, err
+	}
+	info, err := a.currentRule()
+	return info != nil, err
+}
+
+// managedRule looks up the rule whose expression we manage: the rate limiting
+// rule in ratelimit mode, else the bot check rule. It returns nil if the rule
+// does not exist.
+func (a *app) managedRule() (*cloudflare.Rule, error) {
+	if a.mode() == modeRateLimit {
+		rulesetID, err := a.rateLimitRuleset()
+		if err != nil {
+			return nil, err
+		}
+		return a.findRuleIn(rulesetID, rateLimitRef, rateLimitDescription)
+	}
+	return a.findRule()
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPhaseEntrypoint_CreatesWhenMissing(t *testing.T) {
+	f := newFakeCF(t, "zr1", "rs1", nil)
+	a := appForServer(f.ts, "zr1", "rs1")
+	a.conf.Mode = modeRateLimit
+	id, err := a.phaseEntrypoint(rateLimitPhase)
+	if err != nil {
+		t.Fatalf("phaseEntrypoint error: %v", err)
+	}
+	if id == "" || f.phases[rateLimitPhase] != id {
+		t.Errorf("phaseEntrypoint = %q, server has %q", id, f.phases[rateLimitPhase])
+	}
+	again, err := a.phaseEntrypoint(rateLimitPhase)
+	if err != nil || again != id {
+		t.Errorf("second phaseEntrypoint = %q, %v, want %q", again, err, id)
+	}
+}
+
+func TestEnsureRateLimit_CreatesAndDeletes(t *testing.T) {
+	f := newFakeCF(t, "zr1", "rs1", nil)
+	a := appForServer(f.ts, "zr1", "rs1")
+	a.conf.Mode = modeRateLimit
+	a.conf.RateLimit = RateLimitConfig{Characteristics: "ip+ua", Period: 10, Requests: 5}
+	if err := a.ensureRateLimit(true, "test"); err != nil {
+		t.Fatalf("ensureRateLimit(true) error: %v", err)
+	}
+	rules := *f.rulesets[f.phases[rateLimitPhase]]
+	if len(rules) != 1 {
+		t.Fatalf("expected 1 rate limit rule, got %d", len(rules))
+	}
+	r := rules[0]
+	if r.Description != rateLimitDescription || r.Action != "block" {
+		t.Errorf("rule = %+v", r)
+	}
+	if r.Expression != mustBuildExpression(t, a) {
+		t.Errorf("expression = %q, want buildExpression", r.Expression)
+	}
+	if r.RateLimit["period"] != 10.0 || r.RateLimit["requests_per_period"] != 5.0 || r.RateLimit["mitigation_timeout"] != 600.0 {
+		t.Errorf("ratelimit = %v", r.RateLimit)
+	}
+	if c, _ := r.RateLimit["characteristics"].([]any); len(c) != 3 {
+		t.Errorf("characteristics = %v, want colo, ip and user agent", r.RateLimit["characteristics"])
+	}
+	if len(f.rules) != 0 {
+		t.Errorf("challenge rule should not be created in ratelimit mode, got %d", len(f.rules))
+	}
+
+	// Already current: no churn.
+	if err := a.ensureRateLimit(true, "test"); err != nil {
+		t.Fatalf("ensureRateLimit(true) error: %v", err)
+	}
+	if rules := *f.rulesets[f.phases[rateLimitPhase]]; len(rules) != 1 || rules[0].ID != r.ID {
+		t.Errorf("rule should not have been replaced, got %+v", rules)
+	}
+
+	if err := a.ensureRateLimit(false, "test"); err != nil {
+		t.Fatalf("ensureRateLimit(false) error: %v", err)
+	}
+	if rules := *f.rulesets[f.phases[rateLimitPhase]]; len(rules) != 0 {
+		t.Errorf("expected rate limit rule deleted, got %d", len(rules))
+	}
+}
+
+func TestEnsureRateLimit_UpdatesStaleRuleInPlace(t *testing.T) {
+	f := newFakeCF(t, "zr1", "rs1", nil)
+	a := appForServer(f.ts, "zr1", "rs1")
+	a.conf.Mode = modeRateLimit
+	if err := a.ensureRateLimit(true, "test"); err != nil {
+		t.Fatalf("ensureRateLimit(true) error: %v", err)
+	}
+	rules := f.rulesets[f.phases[rateLimitPhase]]
+	id := (*rules)[0].ID
+	(*rules)[0].Expression = "old expression"
+	a.rateLimitRule.forget()
+
+	if err := a.ensureRateLimit(true, "test"); err != nil {
+		t.Fatalf("ensureRateLimit(true) error: %v", err)
+	}
+	if len(*rules) != 1 || (*rules)[0].ID != id || (*rules)[0].Expression == "old expression" {
+		t.Errorf("rules = %+v, want rule %s updated in place", *rules, id)
+	}
+}
+
+func TestEnsureRateLimit_UpdatesChangedSettings(t *testing.T) {
+	f := newFakeCF(t, "zr1", "rs1", nil)
+	a := appForServer(f.ts, "zr1", "rs1")
+	a.conf.Mode = modeRateLimit
+	if err := a.ensureRateLimit(true, "test"); err != nil {
+		t.Fatalf("ensureRateLimit(true) error: %v", err)
+	}
+	rules := f.rulesets[f.phases[rateLimitPhase]]
+	id := (*rules)[0].ID
+
+	a.conf.RateLimit = RateLimitConfig{Requests: 30, Action: "managed_challenge"}
+	a.rateLimitRule.forget()
+	if err := a.ensureRateLimit(true, "test"); err != nil {
+		t.Fatalf("ensureRateLimit(true) error: %v", err)
+	}
+	r := (*rules)[0]
+	if len(*rules) != 1 || r.ID != id || r.Action != "managed_challenge" || r.RateLimit["requests_per_period"] != 30.0 {
+		t.Errorf("rules = %+v, want rule %s updated with the new settings", *rules, id)
+	}
+}
+
+func TestDoIt_BothModesCreateBothRules(t *testing.T) {
+	f := newFakeCF(t, "zr2", "rs1", nil)
+	a := newDoItApp(t, f.ts, "10.00 8.00 6.00 5/200 12345", "zr2", "rs1")
+	a.conf.Mode = modeBoth
+	a.doIt()
+	if len(f.rules) != 1 {
+		t.Errorf("expected 1 challenge rule, got %d", len(f.rules))
+	}
+	if rs := f.phases[rateLimitPhase]; rs == "" || len(*f.rulesets[rs]) != 1 {
+		t.Errorf("expected 1 rate limit rule")
+	}
+}
+
+func TestValidateMode(t *testing.T) {
+	good := []Config{
+		{},
+		{Mode: modeRateLimit},
+		{Mode: modeBoth, RateLimit: RateLimitConfig{Characteristics: "ip+ua", Period: 3600}},
+	}
+	for _, c := range good {
+		a := newTestApp()
+		a.conf = c
+		if err := a.validateMode(); err != nil {
+			t.Errorf("validateMode(%+v) error: %v", c, err)
+		}
+	}
+	bad := []Config{
+		{Mode: "tarpit"},
+		{Mode: modeRateLimit, RateLimit: RateLimitConfig{Characteristics: "asn"}},
+		{Mode: modeRateLimit, RateLimit: RateLimitConfig{Period: 30}},
+	}
+	for _, c := range bad {
+		a := newTestApp()
+		a.conf = c
+		if err := a.validateMode(); err == nil {
+			t.Errorf("validateMode(%+v): expected error, got nil", c)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// retryTransport retries failed API requests with capped exponential backoff
+// and full jitter. Transport errors are retried only for idempotent methods,
+// since a POST may have reached Cloudflare; 429 and 5xx responses are retried
+// for any method. A Retry-After header is honoured. No attempt is started,
+// and no backoff runs, past the deadline set for the current run.
+type retryTransport struct {
+	base           http.RoundTripper
+	maxRetries     int
+	baseDelay      time.Duration
+	maxDelay       time.Duration
+	attemptTimeout time.Duration // per attempt; 0 for none
+	statsHost      string        // only requests to this host are counted in stats
+
+	// wait sleeps for d, returning early with an error if ctx is done.
+	wait func(ctx context.Context, d time.Duration) error
+
+	mu       sync.Mutex
+	deadline time.Time // zero for none
+	stats    apiStats
+}
+
+// apiStats accumulates API request statistics between metrics samples.
+type apiStats struct {
+	requests   int
+	retries    int
+	failures   int
+	latency    time.Duration // total over all requests, including retries
+	maxLatency time.Duration
+}
+
+// newRetryTransport wraps base (http.DefaultTransport if nil) with a.maxRetries
+// retries, counting requests to the Cloudflare API.
+func (a *app) newRetryTransport(base http.RoundTripper) *retryTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	host := ""
+	if u, err := url.Parse(a.baseURL); err == nil {
+		host = u.Host
+	}
+	return &retryTransport{
+		base:           base,
+		maxRetries:     a.maxRetries,
+		baseDelay:      500 * time.Millisecond,
+		maxDelay:       8 * time.Second,
+		attemptTimeout: 10 * time.Second,
+		statsHost:      host,
+		wait:           sleepCtx,
+	}
+}
+
+// installRetry gives the Cloudflare calls their own copy of a's HTTP client
+// that retries failed requests. The copy's timeout is replaced by the
+// per-attempt timeout, so that it does not cut retries short. a.client, used
+// for metrics pushes, keeps its timeout and makes a single attempt.
+func (a *app) installRetry() {
+	a.retry = a.newRetryTransport(a.client.Transport)
+	c := *a.client
+	c.Transport = a.retry
+	c.Timeout = 0
+	a.cfClient = &c
+}
+
+// startRun sets the deadline for API requests made from now on: a.apiTimeout
+// from now, or none if that is 0.
+func (a *app) startRun() {
+	if a.retry == nil {
+		return
+	}
+	var deadline time.Time
+	if a.apiTimeout > 0 {
+		deadline = time.Now().Add(a.apiTimeout)
+	}
+	a.retry.mu.Lock()
+	a.retry.deadline = deadline
+	a.retry.mu.Unlock()
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+var errDeadline = errors.New("API deadline for this run exceeded")
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	deadline := t.deadline
+	t.mu.Unlock()
+	ctx, cancel := req.Context(), context.CancelFunc(func() {})
+	if !deadline.IsZero() {
+		ctx, cancel = context.WithDeadlineCause(ctx, deadline, errDeadline)
+	}
+	resp, err := t.roundTrip(ctx, req, deadline)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+func (t *retryTransport) roundTrip(ctx context.Context, req *http.Request, deadline time.Time) (*http.Response, error) {
+	start := time.Now()
+	var resp *http.Response
+	var err error
+	retries := 0
+	for attempt := 0; ; attempt++ {
+		if err := context.Cause(ctx); err != nil {
+			return nil, fmt.Errorf("%s %s: %w", req.Method, req.URL.Redacted(), err)
+		}
+		resp, err = t.attempt(ctx, req, attempt)
+		if attempt >= t.maxRetries || !t.retryable(req, resp, err) {
+			break
+		}
+		delay := t.backoff(attempt)
+		if resp != nil {
+			if ra, ok := retryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+				delay = ra
+			}
+		}
+		if !deadline.IsZero() && time.Now().Add(delay).After(deadline) {
+			slog.Warn("not retrying API request past the run deadline", "method", req.Method, "url", req.URL.Redacted(), "delay", delay)
+			break
+		}
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		slog.Debug("retrying API request", "method", req.Method, "url", req.URL.Redacted(), "attempt", attempt+1, "delay", delay, "status", statusOf(resp), "err", err)
+		if t.wait(ctx, delay) != nil {
+			return nil, fmt.Errorf("%s %s: %w", req.Method, req.URL.Redacted(), context.Cause(ctx))
+		}
+		retries++
+	}
+	t.record(req, time.Since(start), retries, err != nil || resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests)
+	return resp, err
+}
+
+// attempt sends one try of req. The request body is replayed for retries.
+func (t *retryTransport) attempt(ctx context.Context, req *http.Request, n int) (*http.Response, error) {
+	r := req.Clone(ctx)
+	if n > 0 && req.Body != nil {
+		if req.GetBody == nil {
+			return nil, errors.New("cannot retry request without GetBody")
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		r.Body = body
+	}
+	if t.attemptTimeout <= 0 {
+		return t.base.RoundTrip(r)
+	}
+	actx, cancel := context.WithTimeout(ctx, t.attemptTimeout)
+	resp, err := t.base.RoundTrip(r.WithContext(actx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelOnClose releases an attempt's context once its body has been read.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+// retryable reports whether a request that got resp or err should be retried.
+func (t *retryTransport) retryable(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		return idempotent(req.Method) && !errors.Is(err, errDeadline)
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// backoff returns the delay before retry attempt+1: a random duration up to
+// baseDelay doubled attempt times, capped at maxDelay.
+func (t *retryTransport) backoff(attempt int) time.Duration {
+	ceiling := t.maxDelay
+	if d := t.baseDelay << attempt; d > 0 && d < ceiling {
+		ceiling = d
+	}
+	return rand.N(ceiling) + 1
+}
+
+// retryAfter parses a Retry-After header, which is either a number of seconds
+// or an HTTP date.
+func retryAfter(h string, now time.Time) (time.Duration, bool) {
+	if h == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(h); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(h); err == nil {
+		return max(t.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+func statusOf(resp *http.Response) int {
+	if resp == nil {
+		return 0
+	}
+	return resp.StatusCode
+}
+
+// record adds a request to the statistics if it went to the counted host.
+func (t *retryTransport) record(req *http.Request, latency time.Duration, retries int, failed bool) {
+	if req.URL.Host != t.statsHost {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stats.requests++
+	t.stats.retries += retries
+	t.stats.latency += latency
+	t.stats.maxLatency = max(t.stats.maxLatency, latency)
+	if failed {
+		t.stats.failures++
+	}
+}
+
+// apiMetrics returns, and resets, the API statistics since the last call. It
+// returns nil if retries are not installed.
+func (a *app) apiMetrics() map[string]float64 {
+	if a.retry == nil {
+		return nil
+	}
+	a.retry.mu.Lock()
+	s := a.retry.stats
+	a.retry.stats = apiStats{}
+	a.retry.mu.Unlock()
+	m := map[string]float64{
+		"cf_api_requests": float64(s.requests),
+		"cf_api_retries":  float64(s.retries),
+		"cf_api_failures": float64(s.failures),
+	}
+	if s.requests > 0 {
+		m["cf_api_latency_ms"] = float64(s.latency.Microseconds()) / 1000 / float64(s.requests)
+		m["cf_api_latency_max_ms"] = float64(s.maxLatency.Microseconds()) / 1000
+	}
+	return m
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyServer fails the first failures requests with status, then succeeds.
+func flakyServer(t *testing.T, failures int32, status int, header http.Header) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if calls.Add(1) <= failures {
+			for k, v := range header {
+				w.Header()[k] = v
+			}
+			writeCFError(w, status, 10000, "try again")
+			return
+		}
+		writeCFResult(w, map[string]string{"body": string(body)})
+	}))
+	t.Cleanup(ts.Close)
+	return ts, &calls
+}
+
+func TestRetry_RetriesServerErrors(t *testing.T) {
+	ts, calls := flakyServer(t, 2, http.StatusServiceUnavailable, nil)
+	a := appForServer(ts, "z1", "rs1")
+	a.maxRetries = 3
+	a.installRetry()
+	var waits []time.Duration
+	a.retry.wait = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return ctx.Err()
+	}
+	req, _ := a.cf().NewRequest(context.Background(), http.MethodPost, a.cf().URL("x"), strings.NewReader(`{"a":1}`))
+	resp, err := a.cfClient.Do(req)
+	if err != nil {
+		t.Fatalf("Do error: %v", err)
+	}
+	defer resp.Body.Close()
+	var env struct{ Result map[string]string }
+	if err := json.NewDecoder(resp.Body).Decode(&env); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	got := env.Result
+	if calls.Load() != 3 || len(waits) != 2 {
+		t.Errorf("calls = %d, waits = %v, want 3 calls and 2 waits", calls.Load(), waits)
+	}
+	if got["body"] != `{"a":1}` {
+		t.Errorf("body on final attempt = %q, want it replayed", got["body"])
+	}
+	m := a.apiMetrics()
+	if m["cf_api_requests"] != 1 || m["cf_api_retries"] != 2 || m["cf_api_failures"] != 0 {
+		t.Errorf("metrics = %v", m)
+	}
+	if m := a.apiMetrics(); m["cf_api_requests"] != 0 {
+		t.Errorf("metrics not reset: %v", m)
+	}
+}
+
+func TestRetry_GivesUpAfterMaxRetries(t *testing.T) {
+	ts, calls := flakyServer(t, 100, http.StatusBadGateway, nil)
+	a := appForServer(ts, "z1", "rs1")
+	a.maxRetries = 3
+	a.installRetry()
+	a.retry.wait = func(ctx context.Context, _ time.Duration) error { return ctx.Err() }
+	resp, err := a.cfClient.Get(a.cf().URL("x"))
+	if err != nil {
+		t.Fatalf("Get error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway || calls.Load() != 4 {
+		t.Errorf("status %d after %d calls, want 502 after 4", resp.StatusCode, calls.Load())
+	}
+	if m := a.apiMetrics(); m["cf_api_failures"] != 1 {
+		t.Errorf("metrics = %v, want 1 failure", m)
+	}
+}
+
+func TestRetry_DoesNotRetryClientErrors(t *testing.T) {
+	ts, calls := flakyServer(t, 100, http.StatusBadRequest, nil)
+	a := appForServer(ts, "z1", "rs1")
+	a.maxRetries = 3
+	a.installRetry()
+	a.retry.wait = func(ctx context.Context, _ time.Duration) error { return ctx.Err() }
+	resp, err := a.cfClient.Get(a.cf().URL("x"))
+	if err != nil {
+		t.Fatalf("Get error: %v", err)
+	}
+	resp.Body.Close()
+	if calls.Load() != 1 {
+		t.Errorf("calls = %d, want 1", calls.Load())
+	}
+}
+
+func TestRetry_HonoursRetryAfter(t *testing.T) {
+	ts, _ := flakyServer(t, 1, http.StatusTooManyRequests, http.Header{"Retry-After": {"7"}})
+	a := appForServer(ts, "z1", "rs1")
+	a.maxRetries = 3
+	a.installRetry()
+	var waits []time.Duration
+	a.retry.wait = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return ctx.Err()
+	}
+	resp, err := a.cfClient.Get(a.cf().URL("x"))
+	if err != nil {
+		t.Fatalf("Get error: %v", err)
+	}
+	resp.Body.Close()
+	if len(waits) != 1 || waits[0] != 7*time.Second {
+		t.Errorf("waits = %v, want [7s]", waits)
+	}
+}
+
+func TestRetry_StopsAtRunDeadline(t *testing.T) {
+	ts, calls := flakyServer(t, 100, http.StatusTooManyRequests, http.Header{"Retry-After": {"60"}})
+	a := appForServer(ts, "z1", "rs1")
+	a.maxRetries = 3
+	a.installRetry()
+	var waits []time.Duration
+	a.retry.wait = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return ctx.Err()
+	}
+	a.apiTimeout = 10 * time.Second
+	a.startRun()
+	resp, err := a.cfClient.Get(a.cf().URL("x"))
+	if err != nil {
+		t.Fatalf("Get error: %v", err)
+	}
+	resp.Body.Close()
+	if calls.Load() != 1 || len(waits) != 0 {
+		t.Errorf("calls = %d, waits = %v, want no retry past the deadline", calls.Load(), waits)
+	}
+}
+
+func TestRetry_MetricsPushesNotRetried(t *testing.T) {
+	ts, calls := flakyServer(t, 100, http.StatusServiceUnavailable, nil)
+	a := appForServer(ts, "z1", "rs1")
+	a.maxRetries = 3
+	a.installRetry()
+	var waits []time.Duration
+	a.retry.wait = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return ctx.Err()
+	}
+	a.client.Timeout = 10 * time.Second
+	a.apiTimeout = time.Nanosecond
+	a.startRun()
+	time.Sleep(time.Millisecond)
+	a.conf.MetricsURL = ts.URL
+	a.pushMetrics(map[string]float64{"load_average": 1})
+	if calls.Load() != 1 || len(waits) != 0 {
+		t.Errorf("calls = %d, waits = %v, want one attempt past the API deadline", calls.Load(), waits)
+	}
+	if a.client.Transport == a.retry || a.client.Timeout != 10*time.Second {
+		t.Error("installRetry changed the metrics client")
+	}
+}
+
+// failingTransport fails every request with a network error.
+type failingTransport struct{ calls int }
+
+func (f *failingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	f.calls++
+	return nil, errors.New("connection reset")
+}
+
+func TestRetry_NetworkErrorsRetriedOnlyWhenIdempotent(t *testing.T) {
+	for _, tt := range []struct {
+		method string
+		calls  int
+	}{
+		{http.MethodGet, 4},
+		{http.MethodDelete, 4},
+		{http.MethodPatch, 1},
+		{http.MethodPost, 1},
+	} {
+		a := newTestApp()
+		a.baseURL = "https://api.example.com"
+		a.maxRetries = 3
+		base := &failingTransport{}
+		a.client = &http.Client{Transport: base}
+		a.installRetry()
+		a.retry.wait = func(context.Context, time.Duration) error { return nil }
+		req, _ := a.cf().NewRequest(context.Background(), tt.method, a.baseURL+"/x", strings.NewReader("{}"))
+		if _, err := a.cfClient.Do(req); err == nil {
+			t.Errorf("%s: expected error", tt.method)
+		}
+		if base.calls != tt.calls {
+			t.Errorf("%s: %d attempts, want %d", tt.method, base.calls, tt.calls)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2026, 4, 19, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		h    string
+		want time.Duration
+		ok   bool
+	}{
+		{"", 0, false},
+		{"5", 5 * time.Second, true},
+		{"-1", 0, false},
+		{"soon", 0, false},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second, true},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0, true},
+	}
+	for _, tt := range tests {
+		got, ok := retryAfter(tt.h, now)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("retryAfter(%q) = %v, %v, want %v, %v", tt.h, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestBackoff_CappedWithJitter(t *testing.T) {
+	rt := &retryTransport{baseDelay: 100 * time.Millisecond, maxDelay: time.Second}
+	for attempt := range 10 {
+		ceiling := min(100*time.Millisecond<<attempt, time.Second)
+		for range 20 {
+			if d := rt.backoff(attempt); d <= 0 || d > ceiling {
+				t.Fatalf("backoff(%d) = %v, want in (0, %v]", attempt, d, ceiling)
+			}
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+const underAttackLevel = "under_attack"
+
+// securityLevel returns the zone's security_level setting, e.g. "medium".
+func (a *app) securityLevel() (string, error) {
+	return a.cf().SecurityLevel(a.apiContext(), a.zoneId)
+}
+
+// setSecurityLevel changes the zone's security_level setting.
+func (a *app) setSecurityLevel(level string) error {
+	if a.plan != nil {
+		a.plan.change(a.conf.Domain, plannedChange{Action: "set_security_level", Value: level})
+		return nil
+	}
+	return a.cf().SetSecurityLevel(a.apiContext(), a.zoneId, level)
+}
+
+// escalate switches the zone into "I'm Under Attack" mode when the bot check
+// rule has been on for a.underAttackAfter and the load is still at or above
+// a.criticalLoad, and restores the previous security level once the rule has
+// been removed. The previous level is kept in zs so it survives restarts. A
+// zone found already in under_attack mode is left alone, and not looked up
+// again, until the rule is removed.
+// load is the 1-minute load (per CPU if -perCPU is set), or NaN if unknown.
+func (a *app) escalate(zs *zoneState, ruleEnabled bool, load float64, now time.Time) error {
+	if zs.PreviousSecurityLevel != "" {
+		if ruleEnabled {
+			return nil
+		}
+		if err := a.setSecurityLevel(zs.PreviousSecurityLevel); err != nil {
+			return fmt.Errorf("restoring security level %s: %w", zs.PreviousSecurityLevel, err)
+		}
+		slog.Info("restored security level", "level", zs.PreviousSecurityLevel, "underAttackFor", now.Sub(zs.UnderAttackSince).Round(time.Second))
+		zs.PreviousSecurityLevel, zs.UnderAttackSince = "", time.Time{}
+		return nil
+	}
+
+	if !zs.UnderAttackFoundAt.IsZero() {
+		// Already found in under_attack mode: not looked up again while the
+		// rule stays on.
+		if !ruleEnabled {
+			zs.UnderAttackFoundAt = time.Time{}
+		}
+		return nil
+	}
+	if a.underAttackAfter == 0 || !ruleEnabled || zs.EnabledAt.IsZero() {
+		return nil
+	}
+	if now.Sub(zs.EnabledAt) < a.underAttackAfter || !(load >= a.criticalLoad) {
+		return nil
+	}
+	current, err := a.securityLevel()
+	if err != nil {
+		return fmt.Errorf("reading security level: %w", err)
+	}
+	if current == underAttackLevel {
+		// Someone else turned it on; leave it for them to turn off.
+		slog.Info("zone already in under attack mode, leaving it alone")
+		zs.UnderAttackFoundAt = now
+		return nil
+	}
+	if err := a.setSecurityLevel(underAttackLevel); err != nil {
+		return fmt.Errorf("enabling under attack mode: %w", err)
+	}
+	slog.Info("enabled under attack mode", "load", load, "previous", current, "ruleEnabledFor", now.Sub(zs.EnabledAt).Round(time.Second))
+	zs.PreviousSecurityLevel, zs.UnderAttackSince = current, now
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSecurityLevel_GetAndSet(t *testing.T) {
+	f := newFakeCF(t, "zs1", "rs1", nil)
+	a := appForServer(f.ts, "zs1", "rs1")
+	level, err := a.securityLevel()
+	if err != nil {
+		t.Fatalf("securityLevel error: %v", err)
+	}
+	if level != "medium" {
+		t.Errorf("securityLevel = %q, want medium", level)
+	}
+	if err := a.setSecurityLevel("high"); err != nil {
+		t.Fatalf("setSecurityLevel error: %v", err)
+	}
+	if f.securityLevel != "high" {
+		t.Errorf("server level = %q, want high", f.securityLevel)
+	}
+}
+
+func TestEscalate_EnablesAndRestores(t *testing.T) {
+	f := newFakeCF(t, "zs1", "rs1", nil)
+	a := appForServer(f.ts, "zs1", "rs1")
+	a.underAttackAfter = 30 * time.Minute
+	a.criticalLoad = 10
+	now := time.Now()
+	zs := &zoneState{EnabledAt: now.Add(-time.Hour)}
+
+	if err := a.escalate(zs, true, 12, now); err != nil {
+		t.Fatalf("escalate error: %v", err)
+	}
+	if f.securityLevel != underAttackLevel {
+		t.Fatalf("level = %q, want %q", f.securityLevel, underAttackLevel)
+	}
+	if zs.PreviousSecurityLevel != "medium" {
+		t.Errorf("previous level = %q, want medium", zs.PreviousSecurityLevel)
+	}
+
+	// Still on: stays escalated even if load has dropped.
+	if err := a.escalate(zs, true, 2, now); err != nil {
+		t.Fatalf("escalate error: %v", err)
+	}
+	if f.securityLevel != underAttackLevel {
+		t.Errorf("level = %q, want still %q while rule is on", f.securityLevel, underAttackLevel)
+	}
+
+	if err := a.escalate(zs, false, 0.5, now); err != nil {
+		t.Fatalf("escalate error: %v", err)
+	}
+	if f.securityLevel != "medium" {
+		t.Errorf("level = %q, want medium restored", f.securityLevel)
+	}
+	if zs.PreviousSecurityLevel != "" {
+		t.Errorf("previous level should be cleared, got %q", zs.PreviousSecurityLevel)
+	}
+}
+
+func TestEscalate_NotYet(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		name    string
+		zs      zoneState
+		enabled bool
+		load    float64
+	}{
+		{"rule off", zoneState{}, false, 20},
+		{"rule on too briefly", zoneState{EnabledAt: now.Add(-time.Minute)}, true, 20},
+		{"load below critical", zoneState{EnabledAt: now.Add(-time.Hour)}, true, 9},
+		{"load unknown", zoneState{EnabledAt: now.Add(-time.Hour)}, true, math.NaN()},
+	}
+	for _, tc := range cases {
+		f := newFakeCF(t, "zs1", "rs1", nil)
+		a := appForServer(f.ts, "zs1", "rs1")
+		a.underAttackAfter = 30 * time.Minute
+		a.criticalLoad = 10
+		if err := a.escalate(&tc.zs, tc.enabled, tc.load, now); err != nil {
+			t.Fatalf("%s: escalate error: %v", tc.name, err)
+		}
+		if f.securityLevel != "medium" {
+			t.Errorf("%s: level = %q, want unchanged", tc.name, f.securityLevel)
+		}
+	}
+}
+
+func TestEscalate_LeavesManualUnderAttackAlone(t *testing.T) {
+	f := newFakeCF(t, "zs1", "rs1", nil)
+	a := appForServer(f.ts, "zs1", "rs1")
+	a.underAttackAfter = 30 * time.Minute
+	a.criticalLoad = 10
+	f.securityLevel = underAttackLevel
+	now := time.Now()
+	zs := &zoneState{EnabledAt: now.Add(-time.Hour)}
+	if err := a.escalate(zs, true, 20, now); err != nil {
+		t.Fatalf("escalate error: %v", err)
+	}
+	if zs.PreviousSecurityLevel != "" {
+		t.Errorf("should not take ownership of a manually set level, previous = %q", zs.PreviousSecurityLevel)
+	}
+
+	// The level is not read again while the rule stays on.
+	f.fail[http.MethodGet] = true
+	if err := a.escalate(zs, true, 20, now.Add(time.Minute)); err != nil {
+		t.Errorf("escalate looked up the security level again: %v", err)
+	}
+
+	// Once the rule is removed the zone is checked again next time.
+	if err := a.escalate(zs, false, 0.5, now.Add(2*time.Minute)); err != nil || !zs.UnderAttackFoundAt.IsZero() {
+		t.Errorf("escalate = %v, found at %v; want it forgotten with the rule", err, zs.UnderAttackFoundAt)
+	}
+	if f.securityLevel != underAttackLevel {
+		t.Errorf("level = %q, want the manual setting kept", f.securityLevel)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Verdict is a signal's opinion on whether the bot check rule is needed.
+type Verdict int
+
+const (
+	Neutral   Verdict = iota // between thresholds: leave the rule as it is
+	Overload                 // the server is under stress: enable the rule
+	Recovered                // the server is healthy: the rule may be removed
+)
+
+func (v Verdict) String() string {
+	switch v {
+	case Overload:
+		return "overload"
+	case Recovered:
+		return "recovered"
+	}
+	return "neutral"
+}
+
+// Reading is the result of sampling a Signal.
+type Reading struct {
+	Signal  string // name of the signal that produced the reading
+	Verdict Verdict
+	Reason  string             // why, used in logs and as the rule creation reason
+	Metrics map[string]float64 // values to push via pushMetrics
+	Err     error              // set if the signal could not be sampled
+
+	load *loadSample // raw load behind a load signal's verdict
+}
+
+// loadSample is the raw load average behind a load signal's reading, kept so
+// that the verdict can be recomputed with other thresholds.
+type loadSample struct {
+	la   []float64
+	cpus float64 // CPU count if thresholds are per CPU, else 0
+}
+
+// verdict judges the load against absolute thresholds.
+func (l *loadSample) verdict(max, min float64) (Verdict, string) {
+	switch {
+	case l.la[0] >= max:
+		return Overload, fmt.Sprintf("load %.2f", l.la[0])
+	case allBelow(l.la, min):
+		return Recovered, "load average below threshold"
+	}
+	return Neutral, ""
+}
+
+// withLoadThresholds returns a copy of readings with the load verdict
+// recomputed against max and min, which are per CPU if the load signal's
+// thresholds are.
+func withLoadThresholds(readings []Reading, max, min float64) []Reading {
+	out := slices.Clone(readings)
+	for i, r := range out {
+		if r.load == nil {
+			continue
+		}
+		scale := 1.0
+		if r.load.cpus > 0 {
+			scale = r.load.cpus
+		}
+		out[i].Verdict, out[i].Reason = r.load.verdict(max*scale, min*scale)
+	}
+	return out
+}
+
+// Signal is a source of server health information.
+type Signal interface {
+	Name() string
+	Sample() (Reading, error)
+}
+
+// SignalConfig is an entry in the config file's Signals list. Type selects the
+// implementation from the registry; the remaining fields of the entry are
+// passed to its factory as raw JSON.
+type SignalConfig struct {
+	Type   string
+	Params json.RawMessage `json:"-"`
+}
+
+func (c *SignalConfig) UnmarshalJSON(b []byte) error {
+	var t struct{ Type string }
+	if err := json.Unmarshal(b, &t); err != nil {
+		return err
+	}
+	c.Type = t.Type
+	c.Params = slices.Clone(b)
+	return nil
+}
+
+// signalFactory builds a Signal from its config entry. Fields absent from
+// params default to the values set by command line flags.
+type signalFactory func(a *app, params json.RawMessage) (Signal, error)
+
+var signalRegistry = map[string]signalFactory{}
+
+// registerSignal makes a signal implementation available under typ.
+func registerSignal(typ string, f signalFactory) {
+	signalRegistry[typ] = f
+}
+
+// defaultSignals is used when the config file has no Signals list.
+var defaultSignals = []string{"db", "lsphp", "load", "memory"}
+
+// initSignals builds a.signals from the config file, or from defaultSignals
+// if the config does not list any.
+func (a *app) initSignals() error {
+	cfgs := a.conf.Signals
+	if len(cfgs) == 0 {
+		for _, typ := range defaultSignals {
+			cfgs = append(cfgs, SignalConfig{Type: typ, Params: json.RawMessage("{}")})
+		}
+	}
+	a.signals = nil
+	for _, c := range cfgs {
+		f, ok := signalRegistry[c.Type]
+		if !ok {
+			return fmt.Errorf("unknown signal type %q", c.Type)
+		}
+		params := c.Params
+		if len(params) == 0 {
+			params = json.RawMessage("{}")
+		}
+		s, err := f(a, params)
+		if err != nil {
+			return fmt.Errorf("signal %s: %w", c.Type, err)
+		}
+		a.signals = append(a.signals, s)
+	}
+	return nil
+}
+
+// sampleSignals samples every configured signal. A signal that fails to
+// sample is logged and recorded with its error; decide leaves it out, so that
+// a broken probe neither enables the rule nor keeps it on.
+func (a *app) sampleSignals() []Reading {
+	readings := make([]Reading, 0, len(a.signals))
+	for _, s := range a.signals {
+		r, err := s.Sample()
+		r.Signal = s.Name()
+		if err != nil {
+			slog.Warn("sampling signal", "signal", s.Name(), "err", err)
+			r = Reading{Signal: s.Name(), Verdict: Neutral, Err: err}
+		}
+		slog.Debug("signal", "name", r.Signal, "verdict", r.Verdict, "reason", r.Reason)
+		readings = append(readings, r)
+	}
+	return readings
+}
+
+// decide combines readings into a single verdict: any Overload enables the
+// rule, all Recovered removes it, and anything else leaves it unchanged. The
+// reason is that of the first overloaded signal. Readings of signals that
+// failed to sample are ignored, unless every signal failed, in which case
+// nothing is known and the rule is left as it is.
+func decide(readings []Reading) (Verdict, string) {
+	verdict := Recovered
+	failed := 0
+	for _, r := range readings {
+		if r.Err != nil {
+			failed++
+			continue
+		}
+		switch r.Verdict {
+		case Overload:
+			return Overload, r.Reason
+		case Neutral:
+			verdict = Neutral
+		}
+	}
+	if verdict == Recovered && (len(readings) == 0 || failed < len(readings)) {
+		return Recovered, "all signals healthy"
+	}
+	return Neutral, ""
+}
+
+// readingMetrics merges the metrics of all readings.
+func readingMetrics(readings []Reading) map[string]float64 {
+	m := map[string]float64{}
+	for _, r := range readings {
+		maps.Copy(m, r.Metrics)
+	}
+	return m
+}
+
+func init() {
+	registerSignal("load", newLoadSignal)
+	registerSignal("memory", newMemorySignal)
+	registerSignal("lsphp", newProcessSignal)
+	registerSignal("db", newDbSignal)
+}
+
+// loadSignal triggers on the load average read from File. If PerCPU is set,
+// Max and Min are per CPU and are scaled by the CPU count when the signal is
+// built.
+type loadSignal struct {
+	File        string
+	Max         float64 // overload if the 1-minute load reaches this
+	Min         float64 // recovered once all three load averages are below this
+	PerCPU      bool
+	CPUInfoFile string
+	CPUMaxFile  string
+
+	cpus float64 // CPU count used to normalise load; 0 if PerCPU is off
+}
+
+func newLoadSignal(a *app, params json.RawMessage) (Signal, error) {
+	s := &loadSignal{
+		File:        a.loadFile,
+		Max:         a.maxLoad,
+		Min:         a.minLoad,
+		PerCPU:      a.perCPU,
+		CPUInfoFile: a.cpuinfoFile,
+		CPUMaxFile:  a.cpuMaxFile,
+	}
+	if err := json.Unmarshal(params, s); err != nil {
+		return nil, err
+	}
+	if s.PerCPU {
+		cpus, err := cpuCount(s.CPUInfoFile, s.CPUMaxFile)
+		if err != nil {
+			return nil, fmt.Errorf("counting CPUs: %w", err)
+		}
+		s.cpus = cpus
+		s.Max *= cpus
+		s.Min *= cpus
+		slog.Info("effective load thresholds", "max", s.Max, "min", s.Min, "cpus", cpus)
+	}
+	return s, nil
+}
+
+func (s *loadSignal) Name() string { return "load" }
+
+func (s *loadSignal) Sample() (Reading, error) {
+	text, err := os.ReadFile(s.File)
+	if err != nil {
+		return Reading{}, err
+	}
+	la, err := loadAvg(string(text))
+	if err != nil {
+		return Reading{}, err
+	}
+	r := Reading{Metrics: map[string]float64{"load_average": la[0]}, load: &loadSample{la: la, cpus: s.cpus}}
+	if s.cpus > 0 {
+		r.Metrics["load_per_cpu"] = la[0] / s.cpus
+	}
+	r.Verdict, r.Reason = r.load.verdict(s.Max, s.Min)
+	return r, nil
+}
+
+// processSignal triggers when too many copies of Executable are running.
+type processSignal struct {
+	Executable string
+	Metric     string
+	Max        int
+}
+
+func newProcessSignal(a *app, params json.RawMessage) (Signal, error) {
+	s := &processSignal{Executable: "lsphp", Max: a.maxProcs}
+	if err := json.Unmarshal(params, s); err != nil {
+		return nil, err
+	}
+	if s.Metric == "" {
+		s.Metric = "php_process_count"
+		if s.Executable != "lsphp" {
+			s.Metric = strings.ReplaceAll(s.Executable, "-", "_") + "_process_count"
+		}
+	}
+	return s, nil
+}
+
+func (s *processSignal) Name() string { return s.Executable }
+
+func (s *processSignal) Sample() (Reading, error) {
+	n, err := countProcesses(s.Executable)
+	if err != nil {
+		return Reading{}, err
+	}
+	r := Reading{Verdict: Recovered, Metrics: map[string]float64{s.Metric: float64(n)}}
+	if n > s.Max {
+		r.Verdict, r.Reason = Overload, fmt.Sprintf("%s count %d", s.Executable, n)
+	}
+	return r, nil
+}
+
+// dbSignal probes the WordPress database. It is a no-op if no database is
+// configured.
+type dbSignal struct {
+	a *app
+}
+
+func newDbSignal(a *app, params json.RawMessage) (Signal, error) {
+	return &dbSignal{a: a}, nil
+}
+
+func (s *dbSignal) Name() string { return "db" }
+
+func (s *dbSignal) Sample() (Reading, error) {
+	if s.a.conf.DbName == "" {
+		slog.Debug("no database configured, skipping db check")
+		return Reading{Verdict: Recovered}, nil
+	}
+	st, err := s.a.checkDb()
+	if err != nil {
+		slog.Warn("cannot connect to db", "err", err)
+		return Reading{Verdict: Overload, Reason: "db unavailable", Metrics: dbMetrics(nil)}, nil
+	}
+	slog.Debug("db probe", "latency", st.Latency, "threadsRunning", st.ThreadsRunning, "threadsConnected", st.ThreadsConnected)
+	r := Reading{Verdict: Recovered, Metrics: dbMetrics(st)}
+	if reason := s.a.dbOverload(st); reason != "" {
+		r.Verdict, r.Reason = Overload, reason
+	}
+	return r, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+type fakeSignal struct {
+	name string
+	r    Reading
+	err  error
+}
+
+func (s *fakeSignal) Name() string             { return s.name }
+func (s *fakeSignal) Sample() (Reading, error) { return s.r, s.err }
+
+func TestDecide(t *testing.T) {
+	cases := []struct {
+		name       string
+		verdicts   []Verdict
+		want       Verdict
+		wantReason string
+	}{
+		{"all recovered", []Verdict{Recovered, Recovered}, Recovered, "all signals healthy"},
+		{"one neutral holds", []Verdict{Recovered, Neutral}, Neutral, ""},
+		{"overload wins", []Verdict{Recovered, Neutral, Overload}, Overload, "signal 2"},
+		{"no signals", nil, Recovered, "all signals healthy"},
+	}
+	for _, tc := range cases {
+		var readings []Reading
+		for i, v := range tc.verdicts {
+			readings = append(readings, Reading{Verdict: v, Reason: "signal " + string(rune('0'+i))})
+		}
+		got, reason := decide(readings)
+		if got != tc.want || reason != tc.wantReason {
+			t.Errorf("%s: decide = %v %q, want %v %q", tc.name, got, reason, tc.want, tc.wantReason)
+		}
+	}
+}
+
+func TestSampleSignals_ErrorIsIgnored(t *testing.T) {
+	a := newTestApp()
+	a.signals = []Signal{
+		&fakeSignal{name: "ok", r: Reading{Verdict: Recovered, Metrics: map[string]float64{"ok_value": 1}}},
+		&fakeSignal{name: "broken", err: errors.New("boom")},
+	}
+	readings := a.sampleSignals()
+	if len(readings) != 2 {
+		t.Fatalf("got %d readings, want 2", len(readings))
+	}
+	if readings[1].Verdict != Neutral || readings[1].Err == nil {
+		t.Errorf("failed signal reading = %+v, want Neutral with error", readings[1])
+	}
+	if v, _ := decide(readings); v != Recovered {
+		t.Errorf("decide = %v, want recovered when the signals that could be sampled are healthy", v)
+	}
+	if v, _ := decide(readings[1:]); v != Neutral {
+		t.Errorf("decide = %v, want neutral when every signal fails", v)
+	}
+	if m := readingMetrics(readings); m["ok_value"] != 1 || len(m) != 1 {
+		t.Errorf("readingMetrics = %v", m)
+	}
+}
+
+func TestInitSignals_Defaults(t *testing.T) {
+	a := newTestApp()
+	if err := a.initSignals(); err != nil {
+		t.Fatalf("initSignals error: %v", err)
+	}
+	var names []string
+	for _, s := range a.signals {
+		names = append(names, s.Name())
+	}
+	if len(names) != len(defaultSignals) {
+		t.Errorf("signals = %v, want %d defaults", names, len(defaultSignals))
+	}
+}
+
+func TestInitSignals_FromConfig(t *testing.T) {
+	a := newTestApp()
+	a.loadFile = writeTempLoadFile(t, "3.00 1.00 1.00 1/100 1")
+	if err := json.Unmarshal([]byte(`{"Signals": [{"Type": "load", "Max": 2.5}]}`), &a.conf); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.initSignals(); err != nil {
+		t.Fatalf("initSignals error: %v", err)
+	}
+	if len(a.signals) != 1 {
+		t.Fatalf("got %d signals, want 1", len(a.signals))
+	}
+	r, err := a.signals[0].Sample()
+	if err != nil {
+		t.Fatalf("Sample error: %v", err)
+	}
+	if r.Verdict != Overload {
+		t.Errorf("verdict = %v, want overload with Max from config", r.Verdict)
+	}
+	if s := a.signals[0].(*loadSignal); s.Min != a.minLoad || s.File != a.loadFile {
+		t.Errorf("unset params should default to flags, got %+v", s)
+	}
+}
+
+func TestInitSignals_UnknownType(t *testing.T) {
+	a := newTestApp()
+	a.conf.Signals = []SignalConfig{{Type: "nonsense"}}
+	if err := a.initSignals(); err == nil {
+		t.Error("expected error for unknown signal type, got nil")
+	}
+}
+
+func TestProcessSignal_Threshold(t *testing.T) {
+	s := &processSignal{Executable: "no-such-process-xyz", Metric: "x", Max: -1}
+	r, err := s.Sample()
+	if err != nil {
+		t.Skipf("cannot list processes: %v", err)
+	}
+	if r.Verdict != Overload {
+		t.Errorf("verdict = %v, want overload when count exceeds Max", r.Verdict)
+	}
+}
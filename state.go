@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// state is persisted between runs in a.stateFile so that decisions can take
+// account of what happened on earlier runs.
+type state struct {
+	Zones map[string]*zoneState `json:",omitempty"` // keyed by domain
+
+	LastCheck   time.Time       `json:",omitzero"` // when the signals were last sampled
+	LastSignals []readingReport `json:",omitempty"`
+
+	FailedRuns      int  `json:",omitempty"` // consecutive runs that ended in an error
+	FailureNotified bool `json:",omitempty"` // whether eventFailing has been sent for them
+
+	NotifiedAt map[string]time.Time `json:",omitempty"` // when each kind of notification was last sent, by kind, zone and rule
+	Suppressed map[string]int       `json:",omitempty"` // notifications held back since then
+}
+
+// zoneState records the bot check rule's history for one zone.
+type zoneState struct {
+	EnabledAt     time.Time `json:",omitzero"` // when we created the rule; zero if it is off
+	EnabledReason string    `json:",omitempty"`
+	DisabledAt    time.Time `json:",omitzero"`  // when we last removed the rule
+	HealthyStreak int       `json:",omitempty"` // consecutive samples with every signal recovered
+	Level         int       `json:",omitempty"` // index into the escalation ladder while the rule is on
+	LevelSince    time.Time `json:",omitzero"`
+
+	ZoneID             string    `json:",omitempty"` // looked up from the domain
+	ZoneIDCheckedAt    time.Time `json:",omitzero"`
+	RulesetID          string    `json:",omitempty"` // discovered http_request_firewall_custom entrypoint
+	RateLimitRulesetID string    `json:",omitempty"` // discovered http_ratelimit entrypoint
+
+	PreviousSecurityLevel string    `json:",omitempty"` // level to restore; set while we hold the zone in under_attack
+	UnderAttackSince      time.Time `json:",omitzero"`
+	UnderAttackFoundAt    time.Time `json:",omitzero"` // when the zone was found in under_attack set by someone else; cleared with the rule
+
+	Override       string    `json:",omitempty"` // overrideEnable or overrideDisable while a manual override is in force
+	OverrideUntil  time.Time `json:",omitzero"`
+	OverrideReason string    `json:",omitempty"`
+	OverrideSetAt  time.Time `json:",omitzero"` // when the enable, disable or clear command last ran
+
+	Notified map[string]string `json:",omitempty"` // last event (eventEnabled or eventDisabled) sent for each rule
+}
+
+// zone returns the state for domain, creating it if necessary.
+func (s *state) zone(domain string) *zoneState {
+	if s.Zones == nil {
+		s.Zones = map[string]*zoneState{}
+	}
+	zs, ok := s.Zones[domain]
+	if !ok {
+		zs = &zoneState{}
+		s.Zones[domain] = zs
+	}
+	return zs
+}
+
+// loadState reads the state file. A missing file, or no state file configured,
+// yields an empty state.
+func loadState(fn string) (*state, error) {
+	st := &state{}
+	if fn == "" {
+		return st, nil
+	}
+	data, err := os.ReadFile(fn)
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return st, err
+	}
+	if err := json.Unmarshal(data, st); err != nil {
+		return &state{}, err
+	}
+	return st, nil
+}
+
+// saveState atomically replaces the state file. It is a no-op if fn is empty.
+func saveState(fn string, st *state) error {
+	if fn == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(fn), filepath.Base(fn)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), fn)
+}
+
+// lockState takes an exclusive lock on fn, through a lock file beside it,
+// for a read-modify-write of the state file. It returns the function that
+// releases the lock.
+func lockState(fn string) (unlock func(), err error) {
+	if fn == "" {
+		return func() {}, nil
+	}
+	f, err := os.OpenFile(fn+".lock", os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() { f.Close() }, nil
+}
+
+// updateState applies update to the state file under its lock.
+func updateState(fn string, update func(*state)) error {
+	unlock, err := lockState(fn)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	st, err := loadState(fn)
+	if err != nil {
+		return err
+	}
+	update(st)
+	return saveState(fn, st)
+}
+
+// writeState saves the state held in memory at the end of a run. A manual
+// override set in the file since this process read it, by the enable,
+// disable or clear command, is kept rather than overwritten.
+func (a *app) writeState() error {
+	st := a.loadStateOnce()
+	return updateState(a.stateFile, func(file *state) {
+		for domain, zs := range st.Zones {
+			if f, ok := file.Zones[domain]; ok && f.OverrideSetAt.After(zs.OverrideSetAt) {
+				zs.Override, zs.OverrideUntil, zs.OverrideReason, zs.OverrideSetAt = f.Override, f.OverrideUntil, f.OverrideReason, f.OverrideSetAt
+			}
+		}
+		*file = *st
+	})
+}
+
+// loadStateOnce returns the persisted state, reading the state file on first use.
+func (a *app) loadStateOnce() *state {
+	if a.state == nil {
+		st, err := loadState(a.stateFile)
+		if err != nil {
+			slog.Warn("reading state file, starting afresh", "err", err)
+		}
+		a.state = st
+	}
+	return a.state
+}
+
+// zoneState returns the persisted state for the configured zone.
+func (a *app) zoneState() *zoneState {
+	return a.loadStateOnce().zone(a.conf.Domain)
+}
+
+// applyHysteresis damps the combined signal verdict using the rule's history:
+// the rule is not re-enabled within a.cooldown of being removed, and is not
+// removed until it has been on for a.minOn and a.healthySamples consecutive
+// samples have been healthy. Suppressed changes become Neutral.
+func (a *app) applyHysteresis(zs *zoneState, verdict Verdict, reason string, now time.Time) (Verdict, string) {
+	switch verdict {
+	case Overload:
+		zs.HealthyStreak = 0
+		if zs.EnabledAt.IsZero() && a.cooldown > 0 && !zs.DisabledAt.IsZero() && now.Sub(zs.DisabledAt) < a.cooldown {
+			slog.Info("in cooldown, not enabling bot check rule", "reason", reason, "disabledAt", zs.DisabledAt)
+			return Neutral, ""
+		}
+	case Recovered:
+		zs.HealthyStreak++
+		if zs.HealthyStreak < a.healthySamples {
+			slog.Debug("waiting for consecutive healthy samples", "streak", zs.HealthyStreak, "need", a.healthySamples)
+			return Neutral, ""
+		}
+		if !zs.EnabledAt.IsZero() && now.Sub(zs.EnabledAt) < a.minOn {
+			slog.Debug("bot check rule within minimum on time", "enabledAt", zs.EnabledAt, "minOn", a.minOn)
+			return Neutral, ""
+		}
+	default:
+		zs.HealthyStreak = 0
+	}
+	return verdict, reason
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadState_MissingFile(t *testing.T) {
+	st, err := loadState(filepath.Join(t.TempDir(), "missing"))
+	if err != nil {
+		t.Fatalf("loadState error: %v", err)
+	}
+	if len(st.Zones) != 0 {
+		t.Errorf("expected empty state, got %+v", st)
+	}
+}
+
+func TestLoadState_Corrupt(t *testing.T) {
+	st, err := loadState(writeTempLoadFile(t, "{not json"))
+	if err == nil {
+		t.Error("expected error for corrupt state file, got nil")
+	}
+	if st == nil {
+		t.Error("loadState should return a usable empty state on error")
+	}
+}
+
+func TestSaveState_RoundTrip(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "state")
+	enabled := time.Date(2026, 4, 19, 10, 0, 0, 0, time.UTC)
+	st := &state{}
+	zs := st.zone("example.com")
+	zs.EnabledAt, zs.EnabledReason, zs.HealthyStreak = enabled, "load 5.00", 2
+	if err := saveState(fn, st); err != nil {
+		t.Fatalf("saveState error: %v", err)
+	}
+	got, err := loadState(fn)
+	if err != nil {
+		t.Fatalf("loadState error: %v", err)
+	}
+	gz := got.zone("example.com")
+	if !gz.EnabledAt.Equal(enabled) || gz.EnabledReason != "load 5.00" || gz.HealthyStreak != 2 {
+		t.Errorf("round trip = %+v, want %+v", gz, zs)
+	}
+}
+
+func TestApplyHysteresis(t *testing.T) {
+	now := time.Date(2026, 4, 19, 12, 0, 0, 0, time.UTC)
+	a := newTestApp()
+	a.minOn = 10 * time.Minute
+	a.cooldown = 30 * time.Minute
+	a.healthySamples = 3
+
+	cases := []struct {
+		name    string
+		zs      zoneState
+		verdict Verdict
+		want    Verdict
+		streak  int
+	}{
+		{"overload when off", zoneState{}, Overload, Overload, 0},
+		{"overload in cooldown", zoneState{DisabledAt: now.Add(-5 * time.Minute)}, Overload, Neutral, 0},
+		{"overload after cooldown", zoneState{DisabledAt: now.Add(-time.Hour)}, Overload, Overload, 0},
+		{"overload while on resets streak", zoneState{EnabledAt: now.Add(-time.Hour), HealthyStreak: 2}, Overload, Overload, 0},
+		{"first healthy sample", zoneState{EnabledAt: now.Add(-time.Hour)}, Recovered, Neutral, 1},
+		{"enough healthy samples", zoneState{EnabledAt: now.Add(-time.Hour), HealthyStreak: 2}, Recovered, Recovered, 3},
+		{"within minimum on time", zoneState{EnabledAt: now.Add(-5 * time.Minute), HealthyStreak: 5}, Recovered, Neutral, 6},
+		{"neutral resets streak", zoneState{EnabledAt: now.Add(-time.Hour), HealthyStreak: 2}, Neutral, Neutral, 0},
+	}
+	for _, tc := range cases {
+		zs := tc.zs
+		got, _ := a.applyHysteresis(&zs, tc.verdict, "reason", now)
+		if got != tc.want {
+			t.Errorf("%s: verdict = %v, want %v", tc.name, got, tc.want)
+		}
+		if zs.HealthyStreak != tc.streak {
+			t.Errorf("%s: streak = %d, want %d", tc.name, zs.HealthyStreak, tc.streak)
+		}
+	}
+}
+
+func TestDoIt_MinOnKeepsRule(t *testing.T) {
+	ts, rules := rulesetServer(t, "z20", "rs2", nil)
+	a := newDoItApp(t, ts, "10.00 8.00 6.00 5/200 12345", "z20", "rs2")
+	a.stateFile = filepath.Join(t.TempDir(), "state")
+	a.minOn = time.Hour
+	a.doIt()
+	if len(*rules) != 1 {
+		t.Fatalf("expected 1 rule after high load, got %d", len(*rules))
+	}
+
+	os.WriteFile(a.loadFile, []byte("0.10 0.20 0.30 1/100 12345"), 0o644)
+	a.doIt()
+	if len(*rules) != 1 {
+		t.Errorf("rule should be kept within minimum on time, got %d rules", len(*rules))
+	}
+
+	st, _ := loadState(a.stateFile)
+	if zs := st.zone(""); zs.EnabledAt.IsZero() || zs.EnabledReason != "load 10.00" {
+		t.Errorf("state = %+v, want enabled with reason", zs)
+	}
+}
@@ -1,22 +1,26 @@
 package main
 
 import (
-	"bytes"
+	"cmp"
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"log/slog"
+	"maps"
+	"math"
 	"net/http"
-	"net/url"
 	"os"
+	"os/signal"
 	"slices"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/amnonbc/underattack/cloudflare"
 	"github.com/mitchellh/go-ps"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -28,9 +32,47 @@ type Config struct {
 	DbName       string
 	DbUser       string
 	DbPassword   string
-	RulesetID    string
+	ZoneID       string // looked up from Domain if empty
+	RulesetID    string // custom rules ruleset; discovered if empty
 	MetricsURL   string // Grafana Cloud InfluxDB write endpoint (optional)
 	MetricsToken string // Grafana Cloud API token
+
+	Signals []SignalConfig // health signals to sample; defaults to defaultSignals
+	Levels  []Level        // escalation ladder for the rule action; defaults to defaultLevels
+
+	Mode      string          // challenge (default), ratelimit or both
+	RateLimit RateLimitConfig // rate limiting rule settings for the ratelimit and both modes
+
+	Zones []ZoneConfig // zones to manage; if empty, the single Domain above
+
+	Expression string      // text/template for the rule expression; defaults to defaultExpression
+	Posts      PostsConfig // posts to exempt, looked up in the WordPress database
+	Position   string      // where the bot check rule goes in its ruleset; see parsePosition
+
+	Windows []Window // scheduled periods that force the rule on or off or change thresholds
+
+	Notify []NotifierConfig // webhooks told when a rule is created or deleted, or a Cloudflare call fails
+}
+
+// duration is a time.Duration that is written as a string such as "10m" in
+// the config file.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
 }
 
 type app struct {
@@ -44,6 +86,64 @@ type app struct {
 	baseURL    string // override for testing; defaults to cloudflare base
 	exemptDays int
 	dateFormat string
+	dateMatch  string // how exempted dates are matched: dateContains or datePrefix
+
+	perCPU      bool
+	cpuinfoFile string
+	cpuMaxFile  string
+
+	psiCPUFile    string
+	psiMemoryFile string
+	psiIOFile     string
+
+	memFile      string
+	vmstatFile   string
+	maxMem       float64
+	minMem       float64
+	maxSwapRate  float64
+	swapInterval time.Duration
+
+	dbTimeout           time.Duration
+	maxDbLatency        time.Duration
+	maxThreadsRunning   int
+	maxThreadsConnected int
+
+	stateFile      string
+	minOn          time.Duration
+	cooldown       time.Duration
+	healthySamples int
+
+	underAttackAfter time.Duration
+	criticalLoad     float64
+
+	daemon             bool
+	interval           time.Duration
+	metricsInterval    time.Duration
+	ruleRefresh        time.Duration
+	zoneCacheTTL       time.Duration
+	maxRetries         int
+	apiTimeout         time.Duration
+	dryRun             bool
+	jsonOutput         bool // write the dry run plan or status as JSON
+	notifyInterval     time.Duration
+	alertAfterFailures int // consecutive failed runs before eventFailing is sent
+
+	signals  []Signal
+	state    *state
+	zones    []*app      // one per managed zone; see initZones
+	zoneConf *ZoneConfig // this zone's config entry, for the copies in zones
+
+	action        string    // rule action for the current escalation level
+	rule          ruleCache // the bot check rule
+	rateLimitRule ruleCache // the rate limiting rule
+	posts         postCache // paths of posts to exempt
+
+	pendingMetrics []metricSample  // batched in daemon mode until the next flush
+	retry          *retryTransport // cfClient's transport, if retries are installed
+	cfClient       *http.Client    // for Cloudflare calls; a.client if nil
+	ctx            context.Context // see apiContext
+	plan           *plan           // changes not made, in a dry run; nil otherwise
+	notifications  *notifications  // nil if no notifiers are configured
 }
 
 // loadConfig reads and validates the JSON config file at fn.
@@ -60,16 +160,42 @@ func (a *app) loadConfig(fn string) error {
 	if a.conf.ApiKey == "" {
 		missing = append(missing, "apiKey")
 	}
-	if a.conf.Domain == "" {
+	if a.conf.Domain == "" && len(a.conf.Zones) == 0 {
 		missing = append(missing, "domain")
 	}
-	if a.conf.RulesetID == "" {
-		missing = append(missing, "RulesetID")
-	}
 	if len(missing) > 0 {
 		return fmt.Errorf("config missing required fields: %s", strings.Join(missing, ", "))
 	}
-	return nil
+	if err := validateZones(a.conf.Zones); err != nil {
+		return err
+	}
+	if _, _, err := parsePosition(a.conf.Position); err != nil {
+		return err
+	}
+	if _, _, err := parsePosition(a.conf.RateLimit.Position); err != nil {
+		return fmt.Errorf("RateLimit: %w", err)
+	}
+	if err := validateWindows(a.conf.Windows); err != nil {
+		return err
+	}
+	if err := validateNotifiers(a.conf.Notify); err != nil {
+		return err
+	}
+	if err := a.conf.Posts.validate(); err != nil {
+		return err
+	}
+	if a.conf.Posts.enabled() && len(a.conf.Zones) > 0 {
+		// The posts come from the one database in DbName, so they would be
+		// exempted on every zone.
+		return errors.New("Posts cannot be used with Zones")
+	}
+	if err := a.validateExpressions(); err != nil {
+		return err
+	}
+	if err := validateLevels(a.levels()); err != nil {
+		return err
+	}
+	return a.validateMode()
 }
 
 // loadAvg parses the first three space-separated floats from a /proc/loadavg string.
@@ -92,37 +218,6 @@ func loadAvg(text string) ([]float64, error) {
 	return res, nil
 }
 
-// getZoneID looks up the Cloudflare zone ID for the configured domain, and stores the result in
-// a.zoneId.
-func (a *app) getZoneID() error {
-	req, err := a.NewRequest(http.MethodGet, a.cfURL("zones"), nil)
-	if err != nil {
-		return err
-	}
-
-	resp, err := a.client.Do(req)
-	if err != nil {
-		return err
-	}
-
-	var zones []struct {
-		ID   string `json:"id"`
-		Name string `json:"name"`
-	}
-	if err := decodeCF(resp, &zones); err != nil {
-		return err
-	}
-
-	for _, z := range zones {
-		if z.Name == a.conf.Domain {
-			a.zoneId = z.ID
-			return nil
-		}
-	}
-
-	return errors.New("zone ID not found for domain " + a.conf.Domain)
-}
-
 // countProcesses returns the number of running processes whose executable name matches pattern.
 func countProcesses(pattern string) (int, error) {
 	procs, err := ps.Processes()
@@ -138,14 +233,13 @@ func countProcesses(pattern string) (int, error) {
 	return n, nil
 }
 
-// memoryPercent returns memory usage as a percentage (0-100).
-func memoryPercent() (float64, error) {
-	text, err := os.ReadFile("/proc/meminfo")
-	if err != nil {
-		return 0, err
-	}
+// memoryPercent returns memory usage as a percentage (0-100) from the contents
+// of /proc/meminfo. It fails if MemAvailable is missing, as it is on older
+// kernels and some containers, rather than reporting the memory as all used.
+func memoryPercent(text string) (float64, error) {
 	var memTotal, memAvail int64
-	for _, line := range strings.Split(string(text), "\n") {
+	haveAvail := false
+	for _, line := range strings.Split(text, "\n") {
 		fields := strings.Fields(line)
 		if len(fields) < 2 {
 			continue
@@ -155,215 +249,369 @@ func memoryPercent() (float64, error) {
 		case "MemTotal:":
 			memTotal = val
 		case "MemAvailable:":
-			memAvail = val
+			memAvail, haveAvail = val, true
 		}
 	}
 	if memTotal == 0 {
 		return 0, errors.New("MemTotal not found")
 	}
+	if !haveAvail {
+		return 0, errors.New("MemAvailable not found")
+	}
 	return float64(memTotal-memAvail) / float64(memTotal) * 100, nil
 }
 
-// cfURL builds a Cloudflare API URL by joining baseURL with the given path segments.
-func (a *app) cfURL(segments ...string) string {
-	u, err := url.JoinPath(a.baseURL, segments...)
-	if err != nil {
-		panic(err) // only fires if baseURL is malformed
+// cf returns a Cloudflare API client using a's HTTP client and API key.
+func (a *app) cf() *cloudflare.Client {
+	return &cloudflare.Client{BaseURL: a.baseURL, Token: a.conf.ApiKey, HTTPClient: cmp.Or(a.cfClient, a.client)}
+}
+
+// apiContext returns the context for Cloudflare API requests, which is cancelled
+// when the process is asked to stop.
+func (a *app) apiContext() context.Context {
+	if a.ctx == nil {
+		return context.Background()
 	}
-	return u
+	return a.ctx
 }
 
-// NewRequest creates an HTTP request with Cloudflare authentication headers set.
-func (a *app) NewRequest(method, endpoint string, body io.Reader) (*http.Request, error) {
-	req, err := http.NewRequest(method, endpoint, body)
+const (
+	botCheckDescription = "Bot check"
+	botCheckRef         = "underattack_bot_check" // identifies the rule, whatever its description
+	customRulesPhase    = "http_request_firewall_custom"
+)
+
+// findRule returns the bot check rule's ID and expression, or nil if it doesn't exist.
+func (a *app) findRule() (*cloudflare.Rule, error) {
+	rulesetID, err := a.botCheckRuleset()
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Authorization", "Bearer "+a.conf.ApiKey)
-	req.Header.Set("Content-Type", "application/json")
-	return req, nil
+	info, err := a.findRuleIn(rulesetID, botCheckRef, botCheckDescription)
+	if err != nil {
+		a.zoneState().RulesetID = "" // rediscover next time in case it was replaced
+	}
+	return info, err
 }
 
-// buildExpression returns the Cloudflare WAF rule expression that challenges bots
-// on article pages, exempting articles published within the configured date window.
-func (a *app) buildExpression() string {
-	base := `http.request.uri.path contains "/articles/" and http.request.method eq "GET" and not cf.client.bot and not http.cookie contains "wordpress_logged_in"`
-	if a.exemptDays == 0 {
-		return base
+// botCheckRuleset returns the ID of the ruleset holding the bot check rule:
+// RulesetID from the config if set, or else the zone's custom rules phase
+// entrypoint, discovered (and created if need be) on first use and remembered
+// in the state file.
+func (a *app) botCheckRuleset() (string, error) {
+	if a.conf.RulesetID != "" {
+		return a.conf.RulesetID, nil
 	}
-	now := time.Now()
-	clauses := make([]string, a.exemptDays)
-	for i := range a.exemptDays {
-		d := now.AddDate(0, 0, 1-i).Format(a.dateFormat) // tomorrow through (exemptDays-2) days ago
-		clauses[i] = fmt.Sprintf(`http.request.uri.path contains "/%s/"`, d)
+	zs := a.zoneState()
+	if zs.RulesetID != "" {
+		return zs.RulesetID, nil
 	}
-	return base + " and not (" + strings.Join(clauses, " or ") + ")"
-}
-
-const botCheckDescription = "Bot check"
-
-type cfError struct {
-	Code    int    `json:"code"`
-	Message string `json:"message"`
+	id, err := a.phaseEntrypoint(customRulesPhase)
+	if err != nil {
+		return "", fmt.Errorf("finding custom rules ruleset: %w", err)
+	}
+	slog.Info("discovered custom rules ruleset", "id", id)
+	zs.RulesetID = id
+	return id, nil
 }
 
-func (e cfError) Error() string {
-	return fmt.Sprintf("cloudflare error %d: %s", e.Code, e.Message)
+// rulesetRules returns the rules in rulesetID, in evaluation order.
+func (a *app) rulesetRules(rulesetID string) ([]cloudflare.Rule, error) {
+	if rulesetID == plannedRuleset {
+		return nil, nil
+	}
+	rs, err := a.cf().Ruleset(a.apiContext(), a.zoneId, rulesetID)
+	if err != nil {
+		return nil, err
+	}
+	return rs.Rules, nil
 }
 
-// decodeCF checks the HTTP status and decodes a Cloudflare JSON envelope into
-// dst (the result field), returning an error if the status is non-2xx or
-// success=false.
-func decodeCF(resp *http.Response, dst any) error {
-	defer resp.Body.Close()
-	var env struct {
-		Success bool      `json:"success"`
-		Errors  []cfError `json:"errors"`
-		Result  any       `json:"result"`
+// findRuleIn returns our rule in rulesetID, or nil if there is none. The rule
+// is identified by ref; a rule with the given description and no ref, as
+// created by older versions or by the fallback in updateRuleIn, also matches.
+// If there are several matches, the one with the ref (or else the first) is
+// kept and the others are deleted.
+func (a *app) findRuleIn(rulesetID, ref, description string) (*cloudflare.Rule, error) {
+	rules, err := a.rulesetRules(rulesetID)
+	if err != nil {
+		return nil, err
 	}
-	if dst != nil {
-		env.Result = dst
+	matches := matchRules(rules, ref, description)
+	if len(matches) == 0 {
+		return nil, nil
 	}
-	if resp.StatusCode/100 != 2 {
-		if len(env.Errors) > 0 {
-			return env.Errors[0]
+	for _, dup := range matches[1:] {
+		slog.Warn("deleting duplicate rule", "id", dup.ID, "ref", dup.Ref, "description", dup.Description, "kept", matches[0].ID)
+		if err := a.deleteRuleIn(rulesetID, dup.ID); err != nil {
+			slog.Warn("deleting duplicate rule", "id", dup.ID, "err", err)
 		}
-		return fmt.Errorf("HTTP %d", resp.StatusCode)
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&env); err != nil {
-		return fmt.Errorf("HTTP %d: could not decode CF response - %w", resp.StatusCode, err)
 	}
-	if !env.Success {
-		if len(env.Errors) > 0 {
-			return env.Errors[0]
+	return &matches[0], nil
+}
+
+// matchRules returns the rules identified by ref or, lacking a ref, by
+// description, with the first rule carrying ref (if any) first.
+func matchRules(rules []cloudflare.Rule, ref, description string) []cloudflare.Rule {
+	var matches []cloudflare.Rule
+	for _, r := range rules {
+		if r.Ref == ref {
+			matches = append([]cloudflare.Rule{r}, matches...)
+		} else if r.Ref == "" && r.Description == description {
+			matches = append(matches, r)
 		}
-		return fmt.Errorf("cloudflare API returned success=false")
 	}
-	return nil
+	return matches
 }
 
-type ruleInfo struct {
-	ID         string
-	Expression string
+// ruleCache holds the result of an earlier rule lookup, so that in daemon
+// mode Cloudflare is only asked again when the rule changes or the entry
+// expires.
+type ruleCache struct {
+	info      *cloudflare.Rule // nil if the rule does not exist
+	known     bool
+	checkedAt time.Time
 }
 
-// findRule returns the bot check rule's ID and expression, or nil if it doesn't exist.
-func (a *app) findRule() (*ruleInfo, error) {
-	req, err := a.NewRequest(http.MethodGet, a.cfURL("zones", a.zoneId, "rulesets", a.conf.RulesetID), nil)
+// get returns the cached rule if it is less than maxAge old.
+func (c *ruleCache) get(maxAge time.Duration) (*cloudflare.Rule, bool) {
+	if c.known && time.Since(c.checkedAt) < maxAge {
+		return c.info, true
+	}
+	return nil, false
+}
+
+// set records the current rule (nil if none) after a lookup or change.
+func (c *ruleCache) set(info *cloudflare.Rule) {
+	c.info, c.known, c.checkedAt = info, true, time.Now()
+}
+
+// forget discards the cached rule, forcing the next lookup to ask Cloudflare.
+func (c *ruleCache) forget() {
+	c.info, c.known = nil, false
+}
+
+// currentRule returns the bot check rule, using the result of an earlier
+// lookup if it is less than a.ruleRefresh old.
+func (a *app) currentRule() (*cloudflare.Rule, error) {
+	if info, ok := a.rule.get(a.ruleRefresh); ok {
+		return info, nil
+	}
+	info, err := a.findRule()
 	if err != nil {
 		return nil, err
 	}
-	resp, err := a.client.Do(req)
+	a.rule.set(info)
+	return info, nil
+}
+
+// forgetRule discards all cached rules, forcing the next lookups to ask Cloudflare.
+func (a *app) forgetRule() {
+	a.rule.forget()
+	a.rateLimitRule.forget()
+}
+
+// postRule adds a rule to rulesetID and returns the created rule, identified
+// by its ref (or, without one, its description) in the response, or nil if it
+// could not be identified.
+func (a *app) postRule(rulesetID string, payload cloudflare.Rule) (*cloudflare.Rule, error) {
+	if a.plan != nil {
+		a.plan.change(a.conf.Domain, plannedChange{Action: "create_rule", Ruleset: rulesetID, Rule: payload.Description, RuleAction: payload.Action})
+		return nil, nil
+	}
+	rs, err := a.cf().CreateRule(a.apiContext(), a.zoneId, rulesetID, payload)
 	if err != nil {
 		return nil, err
 	}
+	var created *cloudflare.Rule
+	for i, r := range rs.Rules {
+		switch {
+		case payload.Ref != "" && r.Ref == payload.Ref:
+			return &rs.Rules[i], nil
+		case payload.Ref == "" && r.Ref == "" && r.Description == payload.Description:
+			// Without a ref, take the last match: new rules are appended
+			// unless positioned.
+			created = &rs.Rules[i]
+		}
+	}
+	return created, nil
+}
 
-	var data struct {
-		Rules []struct {
-			ID          string `json:"id"`
-			Description string `json:"description"`
-			Expression  string `json:"expression"`
-		} `json:"rules"`
+// patchRule updates rule ruleID in rulesetID in place, keeping its ID and
+// (unless payload has a position) its position, and returns the updated rule.
+func (a *app) patchRule(rulesetID, ruleID string, payload cloudflare.Rule) (*cloudflare.Rule, error) {
+	if a.plan != nil {
+		a.plan.change(a.conf.Domain, plannedChange{Action: "update_rule", Ruleset: rulesetID, RuleID: ruleID, Rule: payload.Description, RuleAction: payload.Action})
+		payload.ID, payload.Position = ruleID, nil
+		return &payload, nil
 	}
-	if err := decodeCF(resp, &data); err != nil {
+	rs, err := a.cf().UpdateRule(a.apiContext(), a.zoneId, rulesetID, ruleID, payload)
+	if err != nil {
 		return nil, err
 	}
-	for _, r := range data.Rules {
-		if r.Description == botCheckDescription {
-			return &ruleInfo{ID: r.ID, Expression: r.Expression}, nil
-		}
+	if r := rs.Rule(ruleID); r != nil {
+		return r, nil
 	}
-	return nil, nil
+	return nil, fmt.Errorf("rule %s missing from updated ruleset", ruleID)
+}
+
+// updateRuleIn brings rule old in rulesetID up to date with payload. It
+// patches the rule in place; if that fails it creates a replacement before
+// deleting old, so the site is never left without the rule. If the
+// replacement cannot be created either, old is left as it was.
+func (a *app) updateRuleIn(rulesetID string, old *cloudflare.Rule, payload cloudflare.Rule) (*cloudflare.Rule, error) {
+	r, err := a.patchRule(rulesetID, old.ID, payload)
+	if err == nil {
+		return r, nil
+	}
+	slog.Warn("updating rule in place failed, replacing it", "id", old.ID, "err", err)
+	// Refs are unique within a ruleset, so the replacement goes without
+	// until the next update; findRuleIn recognises it by description.
+	replacement := payload
+	replacement.Ref = ""
+	r, cerr := a.postRule(rulesetID, replacement)
+	if cerr != nil {
+		return nil, errors.Join(err, fmt.Errorf("creating replacement: %w", cerr))
+	}
+	if r != nil && r.ID == old.ID {
+		return r, nil
+	}
+	if derr := a.deleteRuleIn(rulesetID, old.ID); derr != nil {
+		slog.Warn("deleting replaced rule", "id", old.ID, "err", derr)
+	}
+	return r, nil
+}
+
+// botCheckPayload returns the bot check rule as sent to Cloudflare.
+func (a *app) botCheckPayload(rulesetID string) (cloudflare.Rule, error) {
+	expr, err := a.buildExpression()
+	if err != nil {
+		return cloudflare.Rule{}, err
+	}
+	payload := cloudflare.Rule{
+		Action:      a.ruleAction(),
+		Description: botCheckDescription,
+		Ref:         botCheckRef,
+		Enabled:     true,
+		Expression:  expr,
+	}
+	err = a.withPosition(&payload, rulesetID, a.conf.Position)
+	return payload, err
 }
 
 // createRule creates the bot check WAF rule in Cloudflare with a fresh expression.
 func (a *app) createRule(reason string) error {
-	payload := map[string]any{
-		"action":      "managed_challenge",
-		"description": botCheckDescription,
-		"enabled":     true,
-		"expression":  a.buildExpression(),
-	}
-	body, err := json.Marshal(payload)
+	rulesetID, err := a.botCheckRuleset()
 	if err != nil {
 		return err
 	}
-	req, err := a.NewRequest(http.MethodPost, a.cfURL("zones", a.zoneId, "rulesets", a.conf.RulesetID, "rules"), bytes.NewBuffer(body))
+	payload, err := a.botCheckPayload(rulesetID)
 	if err != nil {
 		return err
 	}
-	resp, err := a.client.Do(req)
+	r, err := a.postRule(rulesetID, payload)
 	if err != nil {
 		return err
 	}
+	if r == nil {
+		slog.Info("created bot check rule (id unknown)", "reason", reason)
+		a.rule.forget()
+		return nil
+	}
+	ruleURL := a.cf().URL("zones", a.zoneId, "rulesets", rulesetID, "rules", r.ID)
+	slog.Info("created bot check rule", "reason", reason, "id", r.ID, "action", r.Action, "url", ruleURL)
+	slog.Debug("bot check rule details", "description", botCheckDescription, "expression", r.Expression)
+	a.rule.set(r)
+	a.notify(event{Kind: eventEnabled, Rule: botCheckDescription, RuleID: r.ID, Action: r.Action, Reason: reason, URL: ruleURL})
+	return nil
+}
 
-	var result struct {
-		Rules []struct {
-			ID          string `json:"id"`
-			Description string `json:"description"`
-			Expression  string `json:"expression"`
-		} `json:"rules"`
+// updateRule refreshes the bot check rule's expression and action in place.
+func (a *app) updateRule(info *cloudflare.Rule, reason string) error {
+	rulesetID, err := a.botCheckRuleset()
+	if err != nil {
+		return err
 	}
-	if err := decodeCF(resp, &result); err != nil {
+	payload, err := a.botCheckPayload(rulesetID)
+	if err != nil {
 		return err
 	}
-	for _, r := range result.Rules {
-		if r.Description == botCheckDescription {
-			ruleURL := a.cfURL("zones", a.zoneId, "rulesets", a.conf.RulesetID, "rules", r.ID)
-			slog.Info("created bot check rule", "reason", reason, "id", r.ID, "url", ruleURL)
-			slog.Debug("bot check rule details", "description", r.Description, "expression", r.Expression)
-			return nil
-		}
+	r, err := a.updateRuleIn(rulesetID, info, payload)
+	if err != nil {
+		a.rule.forget()
+		return fmt.Errorf("updating bot check rule: %w", err)
+	}
+	if r == nil {
+		slog.Info("updated bot check rule (id unknown)", "reason", reason)
+		a.rule.forget()
+		return nil
 	}
-	slog.Info("created bot check rule (id unknown)", "reason", reason)
+	slog.Info("updated bot check rule", "reason", reason, "id", r.ID, "action", r.Action)
+	a.rule.set(r)
 	return nil
 }
 
-// deleteRule removes the WAF rule with the given ID from the configured ruleset.
-func (a *app) deleteRule(ruleID string) error {
-	req, err := a.NewRequest(http.MethodDelete, a.cfURL("zones", a.zoneId, "rulesets", a.conf.RulesetID, "rules", ruleID), nil)
-	if err != nil {
-		return err
-	}
-	resp, err := a.client.Do(req)
+// deleteRule removes the WAF rule with the given ID from the bot check ruleset.
+// reason says why, for notifications.
+func (a *app) deleteRule(ruleID, reason string) error {
+	rulesetID, err := a.botCheckRuleset()
 	if err != nil {
 		return err
 	}
-	if err := decodeCF(resp, nil); err != nil {
+	if err := a.deleteRuleIn(rulesetID, ruleID); err != nil {
+		a.rule.forget()
 		return err
 	}
+	a.rule.set(nil)
 	slog.Info("deleted bot check rule", "id", ruleID)
+	a.notify(event{Kind: eventDisabled, Rule: botCheckDescription, RuleID: ruleID, Reason: reason})
 	return nil
 }
 
+// deleteRuleIn removes the rule with the given ID from rulesetID.
+func (a *app) deleteRuleIn(rulesetID, ruleID string) error {
+	if a.plan != nil {
+		a.plan.change(a.conf.Domain, plannedChange{Action: "delete_rule", Ruleset: rulesetID, RuleID: ruleID})
+		return nil
+	}
+	return a.cf().DeleteRule(a.apiContext(), a.zoneId, rulesetID, ruleID)
+}
+
+// ruleAction returns the action for the bot check rule at the current escalation level.
+func (a *app) ruleAction() string {
+	if a.action == "" {
+		return a.levels()[0].Action
+	}
+	return a.action
+}
+
 // ensureBotCheck creates the bot check rule (active=true) or removes it (active=false).
-// When activating, the rule is only replaced if today's date is not already in the
-// expression — avoiding churn on every run while the server stays under load.
+// When activating, an existing rule is only updated if its expression is out of
+// date (see expressionCurrent) or its action differs from ruleAction — avoiding
+// churn on every run while the server stays under load. Updates are made in
+// place, so the rule keeps protecting the site throughout.
 // reason is logged alongside creation to explain why it was triggered.
 func (a *app) ensureBotCheck(active bool, reason string) error {
-	info, err := a.findRule()
+	info, err := a.currentRule()
 	if err != nil {
 		return fmt.Errorf("finding bot check rule: %w", err)
 	}
 	if active {
-		today := time.Now().Format(a.dateFormat)
-		if info != nil && strings.Contains(info.Expression, today) {
-			slog.Info("bot check rule already current, skipping", "id", info.ID, "reason", reason)
+		if info != nil && info.Ref == botCheckRef && a.expressionCurrent(info.Expression) && info.Action == a.ruleAction() {
+			slog.Debug("bot check rule already current, skipping", "id", info.ID, "reason", reason)
 			return nil
 		}
 		if info != nil {
-			if err := a.deleteRule(info.ID); err != nil {
-				return err
-			}
 			if reason == "" {
 				reason = "date rollover"
 			}
+			return a.updateRule(info, reason)
 		}
 		return a.createRule(reason)
 	}
 	if info != nil {
 		slog.Info("deleting bot check rule", "id", info.ID, "reason", reason)
-		return a.deleteRule(info.ID)
+		return a.deleteRule(info.ID, reason)
 	}
 	return nil
 }
@@ -374,9 +622,10 @@ func newApp() *app {
 		client: &http.Client{
 			Timeout: 10 * time.Second,
 		},
-		baseURL:    "https://api.cloudflare.com/client/v4",
+		baseURL:    cloudflare.DefaultBaseURL,
 		exemptDays: 9,
 		dateFormat: "02-01-2006",
+		dbTimeout:  5 * time.Second,
 	}
 }
 
@@ -391,10 +640,45 @@ func main() {
 	})
 	flag.IntVar(&a.exemptDays, "exemptDays", 9, "number of days (including tomorrow) to exempt from bot check")
 	flag.StringVar(&a.dateFormat, "dateFormat", "02-01-2006", "Go time format for dates in article URLs")
+	flag.StringVar(&a.dateMatch, "dateMatch", dateContains, "match exempted dates anywhere in the path (contains) or at its start (prefix)")
 	flag.Float64Var(&a.maxLoad, "maxLoad", 4.5, "max load before enabling bot check rule")
 	flag.Float64Var(&a.minLoad, "minLoad", 1.0, "disable bot check rule if load is this low")
 	flag.IntVar(&a.maxProcs, "maxProc", 20, "max number of lsphp processes we allow to run")
 	flag.StringVar(&a.loadFile, "loadFile", "/proc/loadavg", "location of loadavg proc file")
+	flag.BoolVar(&a.perCPU, "perCPU", false, "treat -maxLoad and -minLoad as per-CPU values, scaled by the number of CPUs")
+	flag.StringVar(&a.cpuinfoFile, "cpuinfoFile", "/proc/cpuinfo", "location of cpuinfo proc file")
+	flag.StringVar(&a.cpuMaxFile, "cpuMaxFile", "/sys/fs/cgroup/cpu.max", "location of cgroup v2 CPU quota file")
+	flag.StringVar(&a.psiCPUFile, "psiCPUFile", "/proc/pressure/cpu", "location of CPU pressure stall file")
+	flag.StringVar(&a.psiMemoryFile, "psiMemoryFile", "/proc/pressure/memory", "location of memory pressure stall file")
+	flag.StringVar(&a.psiIOFile, "psiIOFile", "/proc/pressure/io", "location of IO pressure stall file")
+	flag.StringVar(&a.memFile, "memFile", "/proc/meminfo", "location of meminfo proc file")
+	flag.StringVar(&a.vmstatFile, "vmstatFile", "/proc/vmstat", "location of vmstat proc file")
+	flag.Float64Var(&a.maxMem, "maxMem", 0, "enable bot check rule if memory usage percentage reaches this (0 reports usage only)")
+	flag.Float64Var(&a.minMem, "minMem", 80, "memory usage percentage must be below this before the bot check rule is removed")
+	flag.Float64Var(&a.maxSwapRate, "maxSwapRate", 0, "enable bot check rule if swap-in plus swap-out reaches this many pages/sec (0 disables)")
+	flag.DurationVar(&a.swapInterval, "swapInterval", time.Second, "interval over which the swap rate is measured")
+	flag.DurationVar(&a.dbTimeout, "dbTimeout", 5*time.Second, "timeout for the database health probe")
+	flag.DurationVar(&a.maxDbLatency, "maxDbLatency", 0, "enable bot check rule if the database probe takes longer than this, e.g. 2s (0 disables)")
+	flag.IntVar(&a.maxThreadsRunning, "maxDbThreadsRunning", 0, "enable bot check rule if MySQL Threads_running reaches this (0 disables)")
+	flag.IntVar(&a.maxThreadsConnected, "maxDbThreadsConnected", 0, "enable bot check rule if MySQL Threads_connected reaches this (0 disables)")
+	flag.StringVar(&a.stateFile, "stateFile", "/var/tmp/underattack.state", "file recording rule state between runs (empty disables)")
+	flag.DurationVar(&a.minOn, "minOn", 10*time.Minute, "minimum time the bot check rule stays on once enabled")
+	flag.DurationVar(&a.cooldown, "cooldown", 0, "minimum time after removing the bot check rule before it is enabled again")
+	flag.IntVar(&a.healthySamples, "healthySamples", 1, "number of consecutive healthy samples needed before removing the bot check rule")
+	flag.DurationVar(&a.underAttackAfter, "underAttackAfter", 0, "switch the zone to I'm Under Attack mode if the bot check rule has been on this long and load is still critical (0 disables)")
+	flag.Float64Var(&a.criticalLoad, "criticalLoad", 10, "load (per CPU with -perCPU) at which to escalate to I'm Under Attack mode")
+	flag.BoolVar(&a.daemon, "daemon", false, "run continuously instead of checking once")
+	flag.DurationVar(&a.zoneCacheTTL, "zoneCacheTTL", 24*time.Hour, "how long a looked-up zone ID is remembered in the state file (0 disables)")
+	flag.IntVar(&a.maxRetries, "maxRetries", 3, "how many times a failed Cloudflare API request is retried")
+	flag.DurationVar(&a.apiTimeout, "apiTimeout", 30*time.Second, "deadline for all Cloudflare API requests in one run, including retries (0 for none)")
+	flag.BoolVar(&a.dryRun, "dry-run", false, "check once and print what would change in Cloudflare, without changing anything")
+	flag.BoolVar(&a.jsonOutput, "json", false, "print the -dry-run plan or status command output as JSON")
+	flag.IntVar(&a.alertAfterFailures, "alertAfterFailures", 3, "notify once this many runs in a row have failed (0 disables)")
+	flag.DurationVar(&a.notifyInterval, "notifyInterval", 10*time.Minute, "minimum time between notifications of the same kind for the same zone and rule")
+	flag.DurationVar(&a.interval, "interval", 5*time.Second, "how often to sample signals in daemon mode")
+	flag.DurationVar(&a.metricsInterval, "metricsInterval", time.Minute, "how often to push batched metrics in daemon mode")
+	flag.DurationVar(&a.ruleRefresh, "ruleRefresh", 10*time.Minute, "how long a looked-up rule is trusted before it is fetched from Cloudflare again")
+	flag.Usage = usage
 	flag.Parse()
 
 	log.SetFlags(log.LstdFlags | log.LUTC)
@@ -406,101 +690,141 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err := a.getZoneID(); err != nil {
+	if err := a.initSignals(); err != nil {
+		slog.Error("initialising signals", "err", err)
+		os.Exit(1)
+	}
+	a.notifications = newNotifications(a.conf.Notify)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	a.ctx = ctx
+	if a.dryRun {
+		// Log lines describe what would have been done.
+		slog.SetDefault(slog.Default().With("dryRun", true))
+		a.plan = &plan{}
+		a.client.Transport = readOnlyTransport{base: cmp.Or(a.client.Transport, http.DefaultTransport)}
+	}
+	a.installRetry()
+	a.startRun()
+	a.initZones()
+	if err := a.initZoneIDs(); err != nil {
 		slog.Error("initialising", "err", err)
+		if a.plan == nil {
+			a.recordRun(err)
+			if err := a.writeState(); err != nil {
+				slog.Warn("writing state file", "err", err)
+			}
+			a.notifications.wait(notifyWait)
+		}
 		os.Exit(1)
 	}
 
+	if args := flag.Args(); len(args) > 0 {
+		err := a.command(os.Stdout, args)
+		a.notifications.wait(notifyWait)
+		if err != nil {
+			slog.Error(args[0], "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if a.dryRun {
+		if err := a.planOnce(os.Stdout, a.jsonOutput); err != nil {
+			slog.Error("dry run", "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if a.daemon {
+		a.runDaemon(ctx)
+		return
+	}
+
 	a.doIt()
 	slog.Debug("invocation complete", "duration", time.Since(start))
 }
 
-// doIt checks server health and creates or removes the bot check rule accordingly.
+// doIt runs a single check, exiting on failure. It is used when invoked from cron.
 func (a *app) doIt() {
-	text, err := os.ReadFile(a.loadFile)
+	enabled, err := a.runOnce()
+	slog.Info("rule state", append([]any{"enabled", enabled}, a.windowAttrs(time.Now())...)...)
+	a.notifications.wait(notifyWait)
 	if err != nil {
-		slog.Error("reading load file", "err", err)
+		slog.Error("check failed", "err", err)
 		os.Exit(1)
 	}
+}
 
-	la, err := loadAvg(string(text))
-	if err != nil {
-		slog.Error("parsing load average", "err", err)
-		os.Exit(1)
+// runOnce samples every health signal, creates or removes the bot check rule
+// in each zone accordingly, records metrics and saves state. It reports
+// whether the rule is enabled in any zone afterwards.
+func (a *app) runOnce() (ruleEnabled bool, err error) {
+	if a.signals == nil {
+		if err := a.initSignals(); err != nil {
+			return false, fmt.Errorf("initialising signals: %w", err)
+		}
 	}
-
-	memPct, err := memoryPercent()
-	if err != nil {
-		slog.Warn("could not read memory usage", "err", err)
-		memPct = 0
+	if a.zones == nil {
+		a.initZones()
 	}
-
-	var ruleEnabled bool
-	var phpCount int
+	if a.daemon {
+		a.reloadOverrides()
+	}
+	a.startRun()
 	defer func() {
-		slog.Info("rule state", "enabled", ruleEnabled)
-		// bot_check_rule_active_seconds increments by 60 (1 min interval) when rule is active
-		ruleActiveSeconds := 0.0
-		if ruleEnabled {
-			ruleActiveSeconds = 60
+		if a.plan != nil {
+			return // a dry run leaves the state as it was
 		}
-		metrics := map[string]float64{
-			"bot_check_rule_active_seconds": ruleActiveSeconds,
-			"load_average":                  la[0],
-			"memory_percent":                memPct,
-			"php_process_count":             float64(phpCount),
+		if err := a.writeState(); err != nil {
+			slog.Warn("writing state file", "err", err)
 		}
-		a.pushMetrics(metrics)
 	}()
 
-	if err := a.checkDb(); err != nil {
-		slog.Warn("cannot connect to db, enabling bot check rule", "err", err)
-		if err := a.ensureBotCheck(true, "db unavailable"); err != nil {
-			slog.Error("failed to enable bot check rule", "err", err)
-			os.Exit(1)
+	readings := a.sampleSignals()
+	a.plan.setReadings(readings)
+	now := time.Now()
+	st := a.loadStateOnce()
+	st.LastCheck, st.LastSignals = now, reportReadings(readings)
+	host := metricSample{Time: now, Values: readingMetrics(readings)}
+	samples := []metricSample{host}
+	var errs []error
+	for _, z := range a.zones {
+		enabled, metrics, err := z.applyZone(readings, now)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", z.conf.Domain, err))
+			z.notify(event{Kind: eventError, Error: err.Error()})
 		}
-		ruleEnabled = true
-		return
-	}
-
-	lsphpCount, err := countProcesses("lsphp")
-	phpCount = lsphpCount
-	if err != nil {
-		slog.Warn("could not count lsphp processes", "err", err)
-	} else if lsphpCount > a.maxProcs {
-		slog.Info("lsphp count above threshold, enabling bot check rule", "count", lsphpCount)
-		if err := a.ensureBotCheck(true, fmt.Sprintf("lsphp count %d", lsphpCount)); err != nil {
-			slog.Error("failed to enable bot check rule", "err", err)
-			os.Exit(1)
+		ruleEnabled = ruleEnabled || enabled
+		if len(a.zones) == 1 {
+			maps.Copy(host.Values, metrics)
+			continue
 		}
-		ruleEnabled = true
-		return
+		slog.Debug("zone rule state", "zone", z.conf.Domain, "enabled", enabled)
+		samples = append(samples, metricSample{Time: now, Values: metrics, Attrs: map[string]string{"zone": z.conf.Domain}})
 	}
-
-	if la[0] >= a.maxLoad {
-		slog.Debug("load average above threshold, enabling bot check rule", "load", la[0])
-		if err := a.ensureBotCheck(true, fmt.Sprintf("load %.2f", la[0])); err != nil {
-			slog.Error("failed to enable bot check rule", "err", err)
-			os.Exit(1)
-		}
-		ruleEnabled = true
-		return
+	maps.Copy(host.Values, a.apiMetrics())
+	if a.plan == nil {
+		a.recordMetrics(samples...)
 	}
+	err = errors.Join(errs...)
+	a.recordRun(err)
+	return ruleEnabled, err
+}
 
-	if allBelow(la, a.minLoad) {
-		slog.Debug("load average below threshold, disabling bot check rule", "load", la[0])
-		if err := a.ensureBotCheck(false, "load average below threshold"); err != nil {
-			slog.Error("failed to disable bot check rule", "err", err)
-			os.Exit(1)
-		}
-		ruleEnabled = false
-		return
+// loadValue returns the load figure compared against a.criticalLoad and the
+// escalation levels, or NaN if no load signal was sampled.
+func (a *app) loadValue(metrics map[string]float64) float64 {
+	name := "load_average"
+	if a.perCPU {
+		name = "load_per_cpu"
 	}
-
-	// Mid-range load: no change — check current state for metrics.
-	if info, err := a.findRule(); err == nil {
-		ruleEnabled = info != nil
+	if v, ok := metrics[name]; ok {
+		return v
 	}
+	return math.NaN()
 }
 
 // allBelow reports whether all values in a are strictly less than x.
@@ -6,6 +6,8 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -22,92 +24,330 @@ func newTestApp() *app {
 
 type testRule struct {
 	ID          string
+	Ref         string
 	Description string
 	Expression  string
+	Action      string         // "managed_challenge" if empty
+	RateLimit   map[string]any // ratelimit parameters, for rules in the http_ratelimit phase
+}
+
+func (r testRule) json() map[string]any {
+	action := r.Action
+	if action == "" {
+		action = "managed_challenge"
+	}
+	m := map[string]any{"id": r.ID, "ref": r.Ref, "description": r.Description, "expression": r.Expression, "action": action}
+	if r.RateLimit != nil {
+		m["ratelimit"] = r.RateLimit
+	}
+	return m
+}
+
+// fakeCF is a fake Cloudflare API server backed by in-memory rulesets and
+// zone settings.
+type fakeCF struct {
+	ts            *httptest.Server
+	mu            sync.Mutex
+	rules         []testRule             // rules of the ruleset passed to newFakeCF
+	rulesets      map[string]*[]testRule // all rulesets by ID, including rules
+	phases        map[string]string      // phase entrypoint ruleset IDs by phase
+	nextID        int
+	securityLevel string
+	fail          map[string]bool // methods on ruleset endpoints that fail with 500
+
+	zones       []map[string]string // zones listed by /zones
+	perPage     int                 // page size cap for /zones, if not 0
+	zoneLookups int
 }
 
 // rulesetServer creates a fake Cloudflare API server backed by an in-memory
-// rule list. It handles GET (list rules), POST (create rule), and DELETE
-// (delete rule). Returns the server and a pointer to the rule slice.
+// rule list. It handles GET (list rules), POST (create rule), PATCH (update
+// rule) and DELETE (delete rule), enforcing unique refs and honouring the
+// position field. Returns the server and a pointer to the rule slice.
 func rulesetServer(t *testing.T, zoneID, rulesetID string, initial []testRule) (*httptest.Server, *[]testRule) {
+	f := newFakeCF(t, zoneID, rulesetID, initial)
+	return f.ts, &f.rules
+}
+
+// newFakeCF creates a fake Cloudflare API server. Besides the ruleset
+// endpoints described at rulesetServer, it serves phase entrypoints (GET
+// returns 404 until the entrypoint is created with PUT) and the zone's
+// security_level setting, which starts as "medium".
+func newFakeCF(t *testing.T, zoneID, rulesetID string, initial []testRule) *fakeCF {
 	t.Helper()
-	var mu sync.Mutex
-	rules := make([]testRule, len(initial))
-	copy(rules, initial)
-	nextID := 100
+	f := &fakeCF{nextID: 100, securityLevel: "medium", phases: map[string]string{}, fail: map[string]bool{}}
+	f.zones = []map[string]string{{"id": zoneID, "name": "example.com", "status": "active"}}
+	f.rules = make([]testRule, len(initial))
+	copy(f.rules, initial)
+	f.rulesets = map[string]*[]testRule{rulesetID: &f.rules}
+	mu := &f.mu
 
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/zones", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		f.zoneLookups++
+		var matches []map[string]string
+		for _, z := range f.zones {
+			if name := r.URL.Query().Get("name"); name == "" || z["name"] == name {
+				matches = append(matches, z)
+			}
+		}
+		perPage, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+		if perPage == 0 {
+			perPage = 20
+		}
+		if f.perPage > 0 {
+			perPage = min(perPage, f.perPage)
+		}
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		page = max(page, 1)
+		start, end := min((page-1)*perPage, len(matches)), min(page*perPage, len(matches))
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]any{
-			"success": true,
-			"result":  []map[string]string{{"id": zoneID, "name": "example.com"}},
+			"success":     true,
+			"result":      matches[start:end],
+			"result_info": map[string]int{"page": page, "per_page": perPage, "total_pages": (len(matches) + perPage - 1) / perPage},
 		})
 	})
 
-	rulesetPath := fmt.Sprintf("/zones/%s/rulesets/%s", zoneID, rulesetID)
-	mux.HandleFunc(rulesetPath, func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc(fmt.Sprintf("/zones/%s/settings/security_level", zoneID), func(w http.ResponseWriter, r *http.Request) {
 		mu.Lock()
 		defer mu.Unlock()
-		w.Header().Set("Content-Type", "application/json")
-		result := make([]map[string]any, len(rules))
-		for i, rule := range rules {
-			result[i] = map[string]any{"id": rule.ID, "description": rule.Description, "expression": rule.Expression}
+		if f.fail[r.Method] {
+			writeCFError(w, http.StatusInternalServerError, 10000, "internal error")
+			return
 		}
-		json.NewEncoder(w).Encode(map[string]any{"success": true, "result": map[string]any{"rules": result}})
-	})
-
-	rulesPath := fmt.Sprintf("/zones/%s/rulesets/%s/rules", zoneID, rulesetID)
-	mux.HandleFunc(rulesPath+"/", func(w http.ResponseWriter, r *http.Request) {
-		// DELETE /zones/{z}/rulesets/{rs}/rules/{id}
-		if r.Method != http.MethodDelete {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPatch:
+			var body struct{ Value string }
+			json.NewDecoder(r.Body).Decode(&body)
+			f.securityLevel = body.Value
+		default:
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		ruleID := strings.TrimPrefix(r.URL.Path, rulesPath+"/")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"success": true,
+			"result":  map[string]any{"id": "security_level", "value": f.securityLevel},
+		})
+	})
+
+	rulesetsPath := fmt.Sprintf("/zones/%s/rulesets/", zoneID)
+	mux.HandleFunc(rulesetsPath, func(w http.ResponseWriter, r *http.Request) {
 		mu.Lock()
 		defer mu.Unlock()
-		for i, rule := range rules {
-			if rule.ID == ruleID {
-				rules = append(rules[:i], rules[i+1:]...)
-				w.Header().Set("Content-Type", "application/json")
-				json.NewEncoder(w).Encode(map[string]any{"success": true, "result": map[string]any{"rules": rules}})
-				return
-			}
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, rulesetsPath), "/")
+		if f.fail[r.Method] {
+			writeCFError(w, http.StatusInternalServerError, 10000, "internal error")
+			return
+		}
+		switch {
+		case len(parts) == 3 && parts[0] == "phases" && parts[2] == "entrypoint":
+			f.serveEntrypoint(w, r, parts[1])
+		case len(parts) == 1 && r.Method == http.MethodGet:
+			// GET /zones/{z}/rulesets/{rs}
+			f.serveRuleset(w, parts[0])
+		case len(parts) == 2 && parts[1] == "rules" && r.Method == http.MethodPost:
+			// POST /zones/{z}/rulesets/{rs}/rules
+			f.createRule(w, r, parts[0])
+		case len(parts) == 3 && parts[1] == "rules" && r.Method == http.MethodPatch:
+			// PATCH /zones/{z}/rulesets/{rs}/rules/{id}
+			f.patchRule(w, r, parts[0], parts[2])
+		case len(parts) == 3 && parts[1] == "rules" && r.Method == http.MethodDelete:
+			// DELETE /zones/{z}/rulesets/{rs}/rules/{id}
+			f.deleteRule(w, parts[0], parts[2])
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		}
-		http.Error(w, "rule not found", http.StatusNotFound)
 	})
 
-	mux.HandleFunc(rulesPath, func(w http.ResponseWriter, r *http.Request) {
-		// POST /zones/{z}/rulesets/{rs}/rules
-		if r.Method != http.MethodPost {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	f.ts = httptest.NewServer(mux)
+	t.Cleanup(f.ts.Close)
+	return f
+}
+
+func writeCFResult(w http.ResponseWriter, result any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"success": true, "result": result})
+}
+
+func writeCFError(w http.ResponseWriter, status, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"success": false, "errors": []map[string]any{{"code": code, "message": message}}})
+}
+
+func (f *fakeCF) rulesetJSON(id string) map[string]any {
+	rules := *f.rulesets[id]
+	result := make([]map[string]any, len(rules))
+	for i, rule := range rules {
+		result[i] = rule.json()
+	}
+	return map[string]any{"id": id, "rules": result}
+}
+
+func (f *fakeCF) serveRuleset(w http.ResponseWriter, rulesetID string) {
+	if _, ok := f.rulesets[rulesetID]; !ok {
+		http.Error(w, "ruleset not found", http.StatusNotFound)
+		return
+	}
+	writeCFResult(w, f.rulesetJSON(rulesetID))
+}
+
+func (f *fakeCF) serveEntrypoint(w http.ResponseWriter, r *http.Request, phase string) {
+	id, ok := f.phases[phase]
+	switch r.Method {
+	case http.MethodGet:
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]any{"success": false, "errors": []map[string]any{{"code": 10003, "message": "could not find entrypoint ruleset"}}})
 			return
 		}
-		var body map[string]any
-		json.NewDecoder(r.Body).Decode(&body)
-		mu.Lock()
-		defer mu.Unlock()
-		nextID++
-		rule := testRule{
-			ID:          fmt.Sprintf("rule-%d", nextID),
-			Description: body["description"].(string),
-			Expression:  body["expression"].(string),
+	case http.MethodPut:
+		if !ok {
+			id = "entry-" + phase
+			f.phases[phase] = id
+			f.rulesets[id] = &[]testRule{}
 		}
-		rules = append(rules, rule)
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]any{
-			"success": true,
-			"result": map[string]any{
-				"rules": []map[string]any{{"id": rule.ID, "description": rule.Description, "expression": rule.Expression}},
-			},
-		})
-	})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeCFResult(w, f.rulesetJSON(id))
+}
+
+func (f *fakeCF) createRule(w http.ResponseWriter, r *http.Request, rulesetID string) {
+	rules, ok := f.rulesets[rulesetID]
+	if !ok {
+		http.Error(w, "ruleset not found", http.StatusNotFound)
+		return
+	}
+	var body map[string]any
+	json.NewDecoder(r.Body).Decode(&body)
+	ref, _ := body["ref"].(string)
+	if f.refTaken(*rules, ref, "") {
+		writeCFError(w, http.StatusBadRequest, 20217, "ref must be unique in the ruleset")
+		return
+	}
+	f.nextID++
+	rule := testRule{
+		ID:          fmt.Sprintf("rule-%d", f.nextID),
+		Ref:         ref,
+		Description: body["description"].(string),
+		Expression:  body["expression"].(string),
+		Action:      body["action"].(string),
+	}
+	if rl, ok := body["ratelimit"].(map[string]any); ok {
+		rule.RateLimit = rl
+	}
+	*rules = append(*rules, rule)
+	if !f.place(rules, len(*rules)-1, body["position"]) {
+		writeCFError(w, http.StatusBadRequest, 20218, "invalid position")
+		return
+	}
+	writeCFResult(w, f.rulesetJSON(rulesetID))
+}
+
+// refTaken reports whether a rule other than id already has ref.
+func (f *fakeCF) refTaken(rules []testRule, ref, id string) bool {
+	for _, r := range rules {
+		if ref != "" && r.Ref == ref && r.ID != id {
+			return true
+		}
+	}
+	return false
+}
+
+// place moves the rule at index i according to a Cloudflare position object,
+// reporting false if the position refers to an unknown rule.
+func (f *fakeCF) place(rules *[]testRule, i int, position any) bool {
+	pos, ok := position.(map[string]any)
+	if !ok {
+		return true
+	}
+	rule := (*rules)[i]
+	rest := slices.Delete(slices.Clone(*rules), i, i+1)
+	at := -1
+	if id, ok := pos["before"].(string); ok {
+		at = 0
+		if id != "" {
+			at = slices.IndexFunc(rest, func(r testRule) bool { return r.ID == id })
+		}
+	} else if id, ok := pos["after"].(string); ok {
+		at = len(rest)
+		if id != "" {
+			if at = slices.IndexFunc(rest, func(r testRule) bool { return r.ID == id }); at >= 0 {
+				at++
+			}
+		}
+	}
+	if at < 0 {
+		return false
+	}
+	*rules = slices.Insert(rest, at, rule)
+	return true
+}
 
-	ts := httptest.NewServer(mux)
-	t.Cleanup(ts.Close)
-	return ts, &rules
+func (f *fakeCF) patchRule(w http.ResponseWriter, r *http.Request, rulesetID, ruleID string) {
+	rules, ok := f.rulesets[rulesetID]
+	if !ok {
+		http.Error(w, "ruleset not found", http.StatusNotFound)
+		return
+	}
+	var body map[string]any
+	json.NewDecoder(r.Body).Decode(&body)
+	for i := range *rules {
+		rule := &(*rules)[i]
+		if rule.ID != ruleID {
+			continue
+		}
+		if v, ok := body["ref"].(string); ok {
+			if f.refTaken(*rules, v, ruleID) {
+				writeCFError(w, http.StatusBadRequest, 20217, "ref must be unique in the ruleset")
+				return
+			}
+			rule.Ref = v
+		}
+		if v, ok := body["description"].(string); ok {
+			rule.Description = v
+		}
+		if v, ok := body["expression"].(string); ok {
+			rule.Expression = v
+		}
+		if v, ok := body["action"].(string); ok {
+			rule.Action = v
+		}
+		if rl, ok := body["ratelimit"].(map[string]any); ok {
+			rule.RateLimit = rl
+		}
+		if !f.place(rules, i, body["position"]) {
+			writeCFError(w, http.StatusBadRequest, 20218, "invalid position")
+			return
+		}
+		writeCFResult(w, f.rulesetJSON(rulesetID))
+		return
+	}
+	http.Error(w, "rule not found", http.StatusNotFound)
+}
+
+func (f *fakeCF) deleteRule(w http.ResponseWriter, rulesetID, ruleID string) {
+	rules, ok := f.rulesets[rulesetID]
+	if !ok {
+		http.Error(w, "ruleset not found", http.StatusNotFound)
+		return
+	}
+	for i, rule := range *rules {
+		if rule.ID == ruleID {
+			*rules = append((*rules)[:i], (*rules)[i+1:]...)
+			writeCFResult(w, f.rulesetJSON(rulesetID))
+			return
+		}
+	}
+	http.Error(w, "rule not found", http.StatusNotFound)
 }
 
 func appForServer(ts *httptest.Server, zoneID, rulesetID string) *app {
@@ -251,70 +491,6 @@ func TestAllBelow_EmptySlice(t *testing.T) {
 	}
 }
 
-// ---------------------------------------------------------------------------
-// NewRequest
-// ---------------------------------------------------------------------------
-
-func TestCfURL(t *testing.T) {
-	a := &app{baseURL: "https://api.cloudflare.com/client/v4"}
-	cases := []struct {
-		segments []string
-		want     string
-	}{
-		{[]string{"zones"}, "https://api.cloudflare.com/client/v4/zones"},
-		{[]string{"zones", "zoneID", "rulesets", "rulesetID"}, "https://api.cloudflare.com/client/v4/zones/zoneID/rulesets/rulesetID"},
-		{[]string{"zones", "zoneID", "rulesets", "rulesetID", "rules"}, "https://api.cloudflare.com/client/v4/zones/zoneID/rulesets/rulesetID/rules"},
-		{[]string{"zones", "zoneID", "rulesets", "rulesetID", "rules", "ruleID"}, "https://api.cloudflare.com/client/v4/zones/zoneID/rulesets/rulesetID/rules/ruleID"},
-	}
-	for _, tc := range cases {
-		if got := a.cfURL(tc.segments...); got != tc.want {
-			t.Errorf("cfURL(%v) = %q, want %q", tc.segments, got, tc.want)
-		}
-	}
-}
-
-func TestNewRequest_SetsAuthHeader(t *testing.T) {
-	a := newTestApp()
-	a.conf.ApiKey = "my-secret-key"
-	req, err := a.NewRequest("GET", "http://example.com", nil)
-	if err != nil {
-		t.Fatalf("NewRequest error: %v", err)
-	}
-	if got := req.Header.Get("Authorization"); got != "Bearer my-secret-key" {
-		t.Errorf("Authorization = %q, want %q", got, "Bearer my-secret-key")
-	}
-}
-
-func TestNewRequest_SetsContentType(t *testing.T) {
-	a := newTestApp()
-	req, err := a.NewRequest("POST", "http://example.com", nil)
-	if err != nil {
-		t.Fatalf("NewRequest error: %v", err)
-	}
-	if got := req.Header.Get("Content-Type"); got != "application/json" {
-		t.Errorf("Content-Type = %q, want application/json", got)
-	}
-}
-
-func TestNewRequest_Methods(t *testing.T) {
-	a := newTestApp()
-	for _, method := range []string{"GET", "POST", "PATCH", "DELETE"} {
-		req, err := a.NewRequest(method, "http://example.com", nil)
-		if err != nil {
-			t.Fatalf("NewRequest(%q) error: %v", method, err)
-		}
-		if req.Method != method {
-			t.Errorf("Method = %q, want %q", req.Method, method)
-		}
-	}
-}
-
-func TestNewRequest_InvalidURL(t *testing.T) {
-	if _, err := newTestApp().NewRequest("GET", "://bad-url", nil); err == nil {
-		t.Error("expected error for invalid URL, got nil")
-	}
-}
-
 // ---------------------------------------------------------------------------
 // findRule
 // ---------------------------------------------------------------------------
@@ -358,6 +534,53 @@ func TestFindRule_EmptyRuleset(t *testing.T) {
 	}
 }
 
+func TestBotCheckRuleset_DiscoversAndCachesEntrypoint(t *testing.T) {
+	f := newFakeCF(t, "zr3", "rs1", nil)
+	a := appForServer(f.ts, "zr3", "")
+	if err := a.ensureBotCheck(true, "test"); err != nil {
+		t.Fatalf("ensureBotCheck: %v", err)
+	}
+	id := f.phases[customRulesPhase]
+	if id == "" {
+		t.Fatal("custom rules entrypoint was not created")
+	}
+	if rules := *f.rulesets[id]; len(rules) != 1 || rules[0].Ref != botCheckRef {
+		t.Errorf("entrypoint rules = %+v, want the bot check rule", rules)
+	}
+	if got := a.zoneState().RulesetID; got != id {
+		t.Errorf("cached ruleset ID = %q, want %q", got, id)
+	}
+	if len(f.rules) != 0 {
+		t.Errorf("configured ruleset should be unused, has %d rules", len(f.rules))
+	}
+}
+
+func TestBotCheckRuleset_UsesCachedID(t *testing.T) {
+	f := newFakeCF(t, "zr4", "rs1", nil)
+	a := appForServer(f.ts, "zr4", "")
+	ct := &countingTransport{counts: map[string]int{}, base: f.ts.Client().Transport}
+	a.client = &http.Client{Transport: ct}
+	a.zoneState().RulesetID = "rs1"
+	if _, err := a.findRule(); err != nil {
+		t.Fatalf("findRule: %v", err)
+	}
+	if ct.count(http.MethodGet) != 1 || ct.count(http.MethodPut) != 0 {
+		t.Errorf("requests = %v, want a single GET of the cached ruleset", ct.counts)
+	}
+}
+
+func TestBotCheckRuleset_ForgetsIDWhenLookupFails(t *testing.T) {
+	f := newFakeCF(t, "zr5", "rs1", nil)
+	a := appForServer(f.ts, "zr5", "")
+	a.zoneState().RulesetID = "deleted"
+	if _, err := a.findRule(); err == nil {
+		t.Fatal("expected error for a missing ruleset")
+	}
+	if got := a.zoneState().RulesetID; got != "" {
+		t.Errorf("cached ruleset ID = %q, want it forgotten", got)
+	}
+}
+
 // ---------------------------------------------------------------------------
 // ensureBotCheck
 // ---------------------------------------------------------------------------
@@ -376,7 +599,7 @@ func TestEnsureBotCheck_CreatesRuleWhenNoneExists(t *testing.T) {
 	}
 }
 
-func TestEnsureBotCheck_ReplacesExistingRuleToRefreshExpression(t *testing.T) {
+func TestEnsureBotCheck_UpdatesExistingRuleToRefreshExpression(t *testing.T) {
 	stale := testRule{ID: "old-rule", Description: botCheckDescription, Expression: "old expression"}
 	ts, rules := rulesetServer(t, "z5", "rs1", []testRule{stale})
 	a := appForServer(ts, "z5", "rs1")
@@ -384,16 +607,63 @@ func TestEnsureBotCheck_ReplacesExistingRuleToRefreshExpression(t *testing.T) {
 		t.Fatalf("ensureBotCheck(true) error: %v", err)
 	}
 	if len(*rules) != 1 {
-		t.Fatalf("expected 1 rule after replace, got %d", len(*rules))
+		t.Fatalf("expected 1 rule after update, got %d", len(*rules))
 	}
-	if (*rules)[0].ID == "old-rule" {
-		t.Error("old rule should have been replaced")
+	if (*rules)[0].ID != "old-rule" {
+		t.Error("rule should have been updated in place, keeping its ID")
 	}
 	if (*rules)[0].Expression == "old expression" {
 		t.Error("expression should have been updated")
 	}
 }
 
+func TestEnsureBotCheck_FallsBackToReplaceWhenPatchFails(t *testing.T) {
+	stale := testRule{ID: "old-rule", Description: botCheckDescription, Expression: "old expression"}
+	f := newFakeCF(t, "z5a", "rs1", []testRule{stale})
+	f.fail[http.MethodPatch] = true
+	a := appForServer(f.ts, "z5a", "rs1")
+	if err := a.ensureBotCheck(true, "test"); err != nil {
+		t.Fatalf("ensureBotCheck(true) error: %v", err)
+	}
+	if len(f.rules) != 1 || f.rules[0].ID == "old-rule" || f.rules[0].Expression == "old expression" {
+		t.Fatalf("rules = %+v, want just a fresh replacement", f.rules)
+	}
+	if info := a.rule.info; info == nil || info.ID != f.rules[0].ID {
+		t.Errorf("cached rule = %+v, want the replacement %s", info, f.rules[0].ID)
+	}
+}
+
+func TestEnsureBotCheck_KeepsOldRuleWhenUpdateAndCreateFail(t *testing.T) {
+	stale := testRule{ID: "old-rule", Description: botCheckDescription, Expression: "old expression"}
+	f := newFakeCF(t, "z5b", "rs1", []testRule{stale})
+	f.fail[http.MethodPatch] = true
+	f.fail[http.MethodPost] = true
+	a := appForServer(f.ts, "z5b", "rs1")
+	if err := a.ensureBotCheck(true, "test"); err == nil {
+		t.Error("expected error when the rule cannot be updated or replaced")
+	}
+	if len(f.rules) != 1 || f.rules[0].ID != "old-rule" {
+		t.Errorf("rules = %+v, want the old rule left protecting the site", f.rules)
+	}
+}
+
+func TestEnsureBotCheck_ReplacementKeptWhenDeleteFails(t *testing.T) {
+	stale := testRule{ID: "old-rule", Description: botCheckDescription, Expression: "old expression"}
+	f := newFakeCF(t, "z5c", "rs1", []testRule{stale})
+	f.fail[http.MethodPatch] = true
+	f.fail[http.MethodDelete] = true
+	a := appForServer(f.ts, "z5c", "rs1")
+	if err := a.ensureBotCheck(true, "test"); err != nil {
+		t.Fatalf("ensureBotCheck(true) error: %v", err)
+	}
+	if len(f.rules) != 2 {
+		t.Fatalf("rules = %+v, want the old rule and its replacement", f.rules)
+	}
+	if info := a.rule.info; info == nil || info.ID != f.rules[1].ID {
+		t.Errorf("cached rule = %+v, want the replacement %s", info, f.rules[1].ID)
+	}
+}
+
 func TestEnsureBotCheck_DeletesRuleWhenInactive(t *testing.T) {
 	existing := testRule{ID: "rule-1", Description: botCheckDescription}
 	ts, rules := rulesetServer(t, "z6", "rs1", []testRule{existing})
@@ -435,7 +705,7 @@ func TestEnsureBotCheck_NoopWhenInactiveAndNoRule(t *testing.T) {
 // ---------------------------------------------------------------------------
 
 func TestBuildExpression_ContainsBaseConditions(t *testing.T) {
-	expr := newApp().buildExpression()
+	expr := mustBuildExpression(t, newApp())
 	for _, want := range []string{
 		`http.request.uri.path contains "/articles/"`,
 		`http.request.method eq "GET"`,
@@ -449,7 +719,7 @@ func TestBuildExpression_ContainsBaseConditions(t *testing.T) {
 }
 
 func TestBuildExpression_ExemptsRecentDates(t *testing.T) {
-	expr := newApp().buildExpression()
+	expr := mustBuildExpression(t, newApp())
 	// tomorrow through 7 days ago (9 dates total)
 	for i := range 9 {
 		d := time.Now().AddDate(0, 0, 1-i).Format("02-01-2006")
@@ -461,7 +731,7 @@ func TestBuildExpression_ExemptsRecentDates(t *testing.T) {
 }
 
 func TestBuildExpression_ExemptsTomorrow(t *testing.T) {
-	expr := newApp().buildExpression()
+	expr := mustBuildExpression(t, newApp())
 	tomorrow := time.Now().AddDate(0, 0, 1).Format("02-01-2006")
 	if !strings.Contains(expr, tomorrow) {
 		t.Errorf("expression should exempt tomorrow (%s) for timezone offset", tomorrow)
@@ -469,7 +739,7 @@ func TestBuildExpression_ExemptsTomorrow(t *testing.T) {
 }
 
 func TestBuildExpression_DoesNotExemptOldDate(t *testing.T) {
-	expr := newApp().buildExpression()
+	expr := mustBuildExpression(t, newApp())
 	old := time.Now().AddDate(0, 0, -8).Format("02-01-2006")
 	if strings.Contains(expr, old) {
 		t.Errorf("expression should not exempt date 8 days ago (%s)", old)
@@ -477,7 +747,7 @@ func TestBuildExpression_DoesNotExemptOldDate(t *testing.T) {
 }
 
 func TestBuildExpression_HasNineDateExemptions(t *testing.T) {
-	expr := newApp().buildExpression()
+	expr := mustBuildExpression(t, newApp())
 	if !strings.Contains(expr, "not (") {
 		t.Error("expression missing 'not (' for date exemptions")
 	}
@@ -501,6 +771,7 @@ func newDoItApp(t *testing.T, ts *httptest.Server, loadContent, zoneID, rulesetI
 	t.Helper()
 	a := appForServer(ts, zoneID, rulesetID)
 	a.loadFile = writeTempLoadFile(t, loadContent)
+	a.memFile = writeTempLoadFile(t, meminfoFixture(50))
 	return a
 }
 
@@ -541,15 +812,15 @@ func TestDoIt_ExactlyAtMaxLoadEnablesRule(t *testing.T) {
 	}
 }
 
-func TestDoIt_HighLoadReplacesStaleRule(t *testing.T) {
+func TestDoIt_HighLoadUpdatesStaleRule(t *testing.T) {
 	stale := testRule{ID: "stale", Description: botCheckDescription, Expression: "old expression"}
 	ts, rules := rulesetServer(t, "z13", "rs2", []testRule{stale})
 	a := newDoItApp(t, ts, "10.00 8.00 6.00 5/200 12345", "z13", "rs2")
 	a.doIt()
 	if len(*rules) != 1 {
-		t.Fatalf("expected 1 rule after replace, got %d", len(*rules))
+		t.Fatalf("expected 1 rule after update, got %d", len(*rules))
 	}
-	if (*rules)[0].ID == "stale" {
-		t.Error("stale rule should have been replaced")
+	if (*rules)[0].ID != "stale" || (*rules)[0].Expression == "old expression" {
+		t.Errorf("rule = %+v, want the stale rule updated in place", (*rules)[0])
 	}
 }
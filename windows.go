@@ -0,0 +1,289 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Window actions, selected by Window.Action.
+const (
+	windowEnable     = "enable"     // keep the rule on while the window is open
+	windowDisable    = "disable"    // keep the rule off while the window is open
+	windowThresholds = "thresholds" // judge the load against MaxLoad and MinLoad instead
+)
+
+// maxWindowDuration caps Window.Duration, which bounds the search for the
+// cron match that opened a window.
+const maxWindowDuration = 7 * 24 * time.Hour
+
+// Window is an entry in the config file's Windows list: a recurring period,
+// such as a crawler's visit or a nightly backup, during which the rule is
+// forced on or off or the load thresholds change. A window opens either on a
+// cron schedule and stays open for Duration, or daily between From and To on
+// the given Days.
+type Window struct {
+	Name     string
+	Cron     string   // "minute hour day-of-month month day-of-week", e.g. "0 3 * * *"
+	Duration duration // how long a Cron window stays open
+	Days     string   // weekdays for a From-To window, e.g. "Mon-Fri" or "Sat,Sun"; default every day
+	From     string   // "15:04"; a window whose To is not after From closes the next day
+	To       string
+	Timezone string  // IANA name, e.g. "Europe/London"; default local time
+	Action   string  // windowEnable, windowDisable or windowThresholds
+	MaxLoad  float64 // with windowThresholds; 0 keeps the usual threshold
+	MinLoad  float64
+
+	loc      *time.Location
+	cron     *cronSpec
+	days     uint64 // bit d set if the window opens on weekday d
+	from, to int    // minutes after midnight
+}
+
+// validateWindows checks and compiles the windows in place.
+func validateWindows(ws []Window) error {
+	for i := range ws {
+		if err := ws[i].compile(); err != nil {
+			name := ws[i].Name
+			if name == "" {
+				name = strconv.Itoa(i)
+			}
+			return fmt.Errorf("window %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (w *Window) compile() error {
+	if w.Name == "" {
+		return errors.New("missing required field: name")
+	}
+	switch w.Action {
+	case windowEnable, windowDisable:
+	case windowThresholds:
+		if w.MaxLoad == 0 && w.MinLoad == 0 {
+			return errors.New("thresholds window needs MaxLoad or MinLoad")
+		}
+	default:
+		return fmt.Errorf("unknown action %q, want %s, %s or %s", w.Action, windowEnable, windowDisable, windowThresholds)
+	}
+	// LoadLocation("") is UTC, not local time.
+	var err error
+	w.loc = time.Local
+	if w.Timezone != "" {
+		if w.loc, err = time.LoadLocation(w.Timezone); err != nil {
+			return err
+		}
+	}
+	if w.Cron != "" {
+		if w.Days != "" || w.From != "" || w.To != "" {
+			return errors.New("use either Cron and Duration or Days, From and To")
+		}
+		if d := time.Duration(w.Duration); d <= 0 || d > maxWindowDuration {
+			return fmt.Errorf("cron window needs a Duration up to %v", maxWindowDuration)
+		}
+		w.cron, err = parseCron(w.Cron)
+		return err
+	}
+	if w.From == "" || w.To == "" {
+		return errors.New("needs Cron and Duration, or From and To")
+	}
+	days := w.Days
+	if days == "" {
+		days = "*"
+	}
+	if w.days, err = parseCronField(days, 0, 7, dayNames); err != nil {
+		return fmt.Errorf("days: %w", err)
+	}
+	w.days = foldSunday(w.days)
+	if w.from, err = parseClock(w.From); err != nil {
+		return err
+	}
+	w.to, err = parseClock(w.To)
+	return err
+}
+
+// parseClock parses a time of day such as "02:30" into minutes after midnight.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, want HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// open reports whether the window is open at now.
+func (w *Window) open(now time.Time) bool {
+	t := now.In(w.loc)
+	if w.cron != nil {
+		// Open if the schedule fired within the last Duration.
+		start := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, w.loc)
+		for m := start; t.Sub(m) < time.Duration(w.Duration); m = m.Add(-time.Minute) {
+			if w.cron.matches(m) {
+				return true
+			}
+		}
+		return false
+	}
+	mins := t.Hour()*60 + t.Minute()
+	today := w.days&(1<<t.Weekday()) != 0
+	if w.from < w.to {
+		return today && mins >= w.from && mins < w.to
+	}
+	yesterday := w.days&(1<<((t.Weekday()+6)%7)) != 0
+	return (today && mins >= w.from) || (yesterday && mins < w.to)
+}
+
+// activeWindow returns the first configured window open at now, or nil.
+func (a *app) activeWindow(now time.Time) *Window {
+	for i := range a.conf.Windows {
+		if w := &a.conf.Windows[i]; w.open(now) {
+			return w
+		}
+	}
+	return nil
+}
+
+// applyWindow forces the verdict while an enable or disable window is open.
+func (a *app) applyWindow(w *Window, verdict Verdict, reason string) (Verdict, string) {
+	if w == nil {
+		return verdict, reason
+	}
+	switch w.Action {
+	case windowEnable:
+		return Overload, "window " + w.Name
+	case windowDisable:
+		return Recovered, "window " + w.Name
+	}
+	if reason != "" {
+		reason += " in window " + w.Name
+	}
+	return verdict, reason
+}
+
+// windowAttrs returns log attributes naming the window open at now, if any.
+func (a *app) windowAttrs(now time.Time) []any {
+	if w := a.activeWindow(now); w != nil {
+		return []any{"window", w.Name}
+	}
+	return nil
+}
+
+// cronSpec is a parsed five-field cron schedule. Each field is a bit set of
+// the values it matches.
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool
+}
+
+var dayNames = map[string]int{"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6}
+
+var monthNames = map[string]int{"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6, "jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12}
+
+// parseCron parses a schedule such as "*/15 2-4 * * Mon-Fri". Fields accept
+// *, numbers, names for months and weekdays, ranges, lists and /steps.
+func parseCron(s string) (*cronSpec, error) {
+	f := strings.Fields(s)
+	if len(f) != 5 {
+		return nil, fmt.Errorf("cron %q: want 5 fields, got %d", s, len(f))
+	}
+	var c cronSpec
+	var err error
+	fields := []struct {
+		bits     *uint64
+		min, max int
+		names    map[string]int
+	}{
+		{&c.minute, 0, 59, nil},
+		{&c.hour, 0, 23, nil},
+		{&c.dom, 1, 31, nil},
+		{&c.month, 1, 12, monthNames},
+		{&c.dow, 0, 7, dayNames},
+	}
+	for i, fd := range fields {
+		if *fd.bits, err = parseCronField(f[i], fd.min, fd.max, fd.names); err != nil {
+			return nil, fmt.Errorf("cron %q: %w", s, err)
+		}
+	}
+	c.dow = foldSunday(c.dow)
+	c.domAny, c.dowAny = f[2] == "*", f[4] == "*"
+	return &c, nil
+}
+
+// foldSunday maps weekday 7 onto 0, both being Sunday.
+func foldSunday(bits uint64) uint64 {
+	if bits&(1<<7) != 0 {
+		bits = bits&^(1<<7) | 1
+	}
+	return bits
+}
+
+// parseCronField parses one comma-separated cron field into a bit set.
+func parseCronField(f string, min, max int, names map[string]int) (uint64, error) {
+	value := func(s string) (int, error) {
+		if n, ok := names[strings.ToLower(s)]; ok {
+			return n, nil
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < min || n > max {
+			return 0, fmt.Errorf("invalid value %q, want %d-%d", s, min, max)
+		}
+		return n, nil
+	}
+	var bits uint64
+	for _, part := range strings.Split(f, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepStr); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepStr)
+			}
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = value(a); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = value(b); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				hi = max
+			}
+		}
+		if hi < lo {
+			// A range that wraps, such as Fri-Mon.
+			for v := lo; v <= max; v += step {
+				bits |= 1 << v
+			}
+			lo = min
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+// matches reports whether the schedule fires at t's minute. As in cron, if
+// both day of month and day of week are restricted, either may match.
+func (c *cronSpec) matches(t time.Time) bool {
+	if c.minute&(1<<t.Minute()) == 0 || c.hour&(1<<t.Hour()) == 0 || c.month&(1<<int(t.Month())) == 0 {
+		return false
+	}
+	dom, dow := c.dom&(1<<t.Day()) != 0, c.dow&(1<<t.Weekday()) != 0
+	switch {
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	}
+	return dom || dow
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	at := func(s string) time.Time {
+		tm, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	tests := []struct {
+		spec string
+		t    string
+		want bool
+	}{
+		{"0 3 * * *", "2026-04-19 03:00", true},
+		{"0 3 * * *", "2026-04-19 03:01", false},
+		{"*/15 * * * *", "2026-04-19 10:45", true},
+		{"*/15 * * * *", "2026-04-19 10:46", false},
+		{"0 2-4 * * Mon-Fri", "2026-04-20 04:00", true},  // Monday
+		{"0 2-4 * * Mon-Fri", "2026-04-19 04:00", false}, // Sunday
+		{"0 0 * * 7", "2026-04-19 00:00", true},          // 7 is Sunday too
+		{"0 0 * * Fri-Mon", "2026-04-19 00:00", true},    // wrapping range
+		{"0 0 * * Fri-Mon", "2026-04-22 00:00", false},   // Wednesday
+		{"30 1 1,15 jan,apr *", "2026-04-15 01:30", true},
+		{"30 1 1,15 jan,apr *", "2026-05-15 01:30", false},
+		// Day of month and day of week both restricted: either matches.
+		{"0 0 1 * Mon", "2026-04-20 00:00", true},
+		{"0 0 1 * Mon", "2026-04-01 00:00", true},
+		{"0 0 1 * Mon", "2026-04-02 00:00", false},
+	}
+	for _, tt := range tests {
+		c, err := parseCron(tt.spec)
+		if err != nil {
+			t.Fatalf("parseCron(%q): %v", tt.spec, err)
+		}
+		if got := c.matches(at(tt.t)); got != tt.want {
+			t.Errorf("%q matches %s = %v, want %v", tt.spec, tt.t, got, tt.want)
+		}
+	}
+	for _, bad := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "* * * * funday"} {
+		if _, err := parseCron(bad); err == nil {
+			t.Errorf("parseCron(%q): expected error", bad)
+		}
+	}
+}
+
+func TestWindowOpen_TimeRange(t *testing.T) {
+	ws := []Window{
+		{Name: "backup", Days: "Mon-Fri", From: "02:00", To: "04:00", Action: windowDisable, Timezone: "UTC"},
+		{Name: "overnight", Days: "Sat", From: "22:00", To: "06:00", Action: windowEnable, Timezone: "UTC"},
+		{Name: "london", From: "09:00", To: "10:00", Action: windowEnable, Timezone: "Europe/London"},
+	}
+	if err := validateWindows(ws); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		w    int
+		t    string
+		want bool
+	}{
+		{0, "2026-04-20T02:00:00Z", true},  // Monday
+		{0, "2026-04-20T03:59:00Z", true},  // Monday
+		{0, "2026-04-20T04:00:00Z", false}, // To is exclusive
+		{0, "2026-04-19T03:00:00Z", false}, // Sunday
+		{1, "2026-04-18T23:00:00Z", true},  // Saturday night
+		{1, "2026-04-19T05:00:00Z", true},  // carries over into Sunday morning
+		{1, "2026-04-19T23:00:00Z", false}, // Sunday night
+		{1, "2026-04-18T05:00:00Z", false}, // Saturday morning belongs to Friday
+		{2, "2026-04-20T08:30:00Z", true},  // 09:30 BST
+		{2, "2026-01-20T08:30:00Z", false}, // 08:30 GMT
+	}
+	for _, tt := range tests {
+		now, _ := time.Parse(time.RFC3339, tt.t)
+		if got := ws[tt.w].open(now); got != tt.want {
+			t.Errorf("%s open at %s = %v, want %v", ws[tt.w].Name, tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestWindowOpen_LocalTime(t *testing.T) {
+	local := time.Local
+	time.Local = time.FixedZone("UTC+5", 5*60*60)
+	t.Cleanup(func() { time.Local = local })
+
+	ws := []Window{{Name: "local", From: "09:00", To: "10:00", Action: windowEnable}}
+	if err := validateWindows(ws); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		t    string
+		want bool
+	}{
+		{"2026-04-20T04:30:00Z", true},  // 09:30 local
+		{"2026-04-20T09:30:00Z", false}, // 14:30 local
+	} {
+		now, _ := time.Parse(time.RFC3339, tt.t)
+		if got := ws[0].open(now); got != tt.want {
+			t.Errorf("open at %s = %v, want %v", tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestWindowOpen_Cron(t *testing.T) {
+	ws := []Window{{Name: "crawler", Cron: "0 3 * * Sun", Duration: duration(90 * time.Minute), Action: windowEnable, Timezone: "UTC"}}
+	if err := validateWindows(ws); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		t    string
+		want bool
+	}{
+		{"2026-04-19T02:59:59Z", false},
+		{"2026-04-19T03:00:00Z", true},
+		{"2026-04-19T04:29:59Z", true},
+		{"2026-04-19T04:30:00Z", false},
+		{"2026-04-20T03:30:00Z", false}, // Monday
+	} {
+		now, _ := time.Parse(time.RFC3339, tt.t)
+		if got := ws[0].open(now); got != tt.want {
+			t.Errorf("open at %s = %v, want %v", tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestValidateWindows_Errors(t *testing.T) {
+	bad := []Window{
+		{From: "01:00", To: "02:00", Action: windowEnable},
+		{Name: "a", From: "01:00", To: "02:00", Action: "pause"},
+		{Name: "a", From: "01:00", To: "02:00", Action: windowThresholds},
+		{Name: "a", From: "1am", To: "02:00", Action: windowEnable},
+		{Name: "a", From: "01:00", Action: windowEnable},
+		{Name: "a", Days: "Someday", From: "01:00", To: "02:00", Action: windowEnable},
+		{Name: "a", Cron: "0 3 * * *", Action: windowEnable},
+		{Name: "a", Cron: "0 3 * * *", Duration: duration(8 * 24 * time.Hour), Action: windowEnable},
+		{Name: "a", Cron: "0 3 * * *", Duration: duration(time.Hour), From: "01:00", Action: windowEnable},
+		{Name: "a", From: "01:00", To: "02:00", Action: windowEnable, Timezone: "Mars/Olympus"},
+	}
+	for _, w := range bad {
+		if err := validateWindows([]Window{w}); err == nil {
+			t.Errorf("validateWindows(%+v): expected error", w)
+		}
+	}
+}
+
+// openWindow returns w, compiled, named "test window" and open all day.
+func openWindow(t *testing.T, w Window) Window {
+	t.Helper()
+	w.Name, w.From, w.To = "test window", "00:00", "00:00"
+	ws := []Window{w}
+	if err := validateWindows(ws); err != nil {
+		t.Fatal(err)
+	}
+	return ws[0]
+}
+
+func TestApplyZone_EnableWindow(t *testing.T) {
+	f := newFakeCF(t, "z1", "rs1", nil)
+	a := newDoItApp(t, f.ts, "0.10 0.20 0.30 1/100 12345", "z1", "rs1")
+	a.conf.Windows = []Window{openWindow(t, Window{Action: windowEnable})}
+	a.initZones()
+	enabled, _, err := a.applyZone(a.sampleSignals(), time.Now())
+	if err != nil || !enabled || len(f.rules) != 1 {
+		t.Fatalf("applyZone = %v, %v with %d rules; want the rule forced on", enabled, err, len(f.rules))
+	}
+	if reason := a.zoneState().EnabledReason; reason != "window test window" {
+		t.Errorf("enabled reason = %q, want the window name", reason)
+	}
+	if attrs := a.windowAttrs(time.Now()); len(attrs) != 2 || attrs[1] != "test window" {
+		t.Errorf("windowAttrs = %v", attrs)
+	}
+}
+
+func TestApplyZone_DisableWindow(t *testing.T) {
+	f := newFakeCF(t, "z1", "rs1", []testRule{{ID: "rule-1", Ref: botCheckRef, Description: botCheckDescription}})
+	a := newDoItApp(t, f.ts, "10.00 8.00 6.00 5/200 12345", "z1", "rs1")
+	a.conf.Windows = []Window{openWindow(t, Window{Action: windowDisable})}
+	a.initZones()
+	if enabled, _, err := a.applyZone(a.sampleSignals(), time.Now()); err != nil || enabled || len(f.rules) != 0 {
+		t.Errorf("applyZone = %v, %v with %d rules; want the rule forced off", enabled, err, len(f.rules))
+	}
+
+	// A manual override beats the window.
+	a.zoneState().Override, a.zoneState().OverrideUntil = overrideEnable, time.Now().Add(time.Hour)
+	if enabled, _, err := a.applyZone(a.sampleSignals(), time.Now()); err != nil || !enabled {
+		t.Errorf("applyZone with override = %v, %v; want enabled", enabled, err)
+	}
+}
+
+func TestApplyZone_ThresholdsWindow(t *testing.T) {
+	f := newFakeCF(t, "z1", "rs1", nil)
+	a := newDoItApp(t, f.ts, "10.00 8.00 6.00 5/200 12345", "z1", "rs1")
+	a.conf.Windows = []Window{openWindow(t, Window{Action: windowThresholds, MaxLoad: 20})}
+	a.initZones()
+	if err := a.initSignals(); err != nil {
+		t.Fatal(err)
+	}
+	if enabled, _, err := a.applyZone(a.sampleSignals(), time.Now()); err != nil || enabled {
+		t.Errorf("applyZone = %v, %v; want load 10 tolerated with MaxLoad 20", enabled, err)
+	}
+
+	a.conf.Windows[0].MaxLoad = 8
+	if _, _, err := a.applyZone(a.sampleSignals(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if reason := a.zoneState().EnabledReason; !strings.Contains(reason, "load 10.00 in window test window") {
+		t.Errorf("enabled reason = %q, want the load and the window", reason)
+	}
+}
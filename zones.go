@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// ZoneConfig is an entry in the config file's Zones list, for hosts serving
+// several sites from separate Cloudflare zones. Fields left empty take the
+// top-level config or command line values.
+type ZoneConfig struct {
+	Domain     string
+	ZoneID     string // looked up from Domain if empty
+	RulesetID  string // discovered if empty
+	ExemptDays *int   // number of days to exempt from the bot check
+	DateFormat string // Go time format for dates in article URLs
+	DateMatch  string // contains or prefix; see -dateMatch
+	MaxLoad    float64
+	MinLoad    float64
+	Expression string // rule expression template
+}
+
+// validateZones checks that every zone has the fields it needs.
+func validateZones(zones []ZoneConfig) error {
+	seen := map[string]bool{}
+	for i, z := range zones {
+		if z.Domain == "" {
+			return fmt.Errorf("zone %d missing required field: domain", i)
+		}
+		if seen[z.Domain] {
+			return fmt.Errorf("zone %s listed twice", z.Domain)
+		}
+		seen[z.Domain] = true
+	}
+	return nil
+}
+
+// initZones builds a.zones: a copy of a for each configured zone, with that
+// zone's settings applied, or just a itself if there is no Zones list. The
+// copies share a's state, so the state file holds every zone.
+func (a *app) initZones() {
+	a.loadStateOnce()
+	if len(a.conf.Zones) == 0 {
+		a.zones = []*app{a}
+		return
+	}
+	a.zones = nil
+	for _, zc := range a.conf.Zones {
+		a.zones = append(a.zones, a.zoneApp(zc))
+	}
+}
+
+// zoneApp returns a copy of a with zc's settings applied.
+func (a *app) zoneApp(zc ZoneConfig) *app {
+	z := *a
+	z.zones = nil
+	z.zoneConf = &zc
+	z.conf.Domain = zc.Domain
+	z.conf.RulesetID = zc.RulesetID
+	z.zoneId = ""
+	z.rule, z.rateLimitRule = ruleCache{}, ruleCache{}
+	if zc.ExemptDays != nil {
+		z.exemptDays = *zc.ExemptDays
+	}
+	if zc.DateFormat != "" {
+		z.dateFormat = zc.DateFormat
+	}
+	if zc.DateMatch != "" {
+		z.dateMatch = zc.DateMatch
+	}
+	return &z
+}
+
+// zoneReadings returns readings judged against this zone's own load
+// thresholds, or those of w if it is a thresholds window, if there are any.
+func (a *app) zoneReadings(readings []Reading, w *Window) []Reading {
+	max, min := a.maxLoad, a.minLoad
+	changed := false
+	set := func(newMax, newMin float64) {
+		if newMax != 0 {
+			max, changed = newMax, true
+		}
+		if newMin != 0 {
+			min, changed = newMin, true
+		}
+	}
+	if zc := a.zoneConf; zc != nil {
+		set(zc.MaxLoad, zc.MinLoad)
+	}
+	if w != nil && w.Action == windowThresholds {
+		set(w.MaxLoad, w.MinLoad)
+	}
+	if !changed {
+		return readings
+	}
+	return withLoadThresholds(readings, max, min)
+}
+
+// getZoneID finds the Cloudflare zone ID for the configured domain and stores
+// it in a.zoneId. An explicit ZoneID in the config is used as is; otherwise an
+// ID remembered in the state file less than a.zoneCacheTTL ago is reused, or
+// the zone is looked up by name.
+func (a *app) getZoneID() error {
+	if id := a.configuredZoneID(); id != "" {
+		a.zoneId = id
+		return nil
+	}
+	zs := a.zoneState()
+	if zs.ZoneID != "" && a.zoneCacheTTL > 0 && time.Since(zs.ZoneIDCheckedAt) < a.zoneCacheTTL {
+		a.zoneId = zs.ZoneID
+		return nil
+	}
+	id, err := a.lookupZoneID()
+	if err != nil {
+		return err
+	}
+	a.zoneId = id
+	zs.ZoneID, zs.ZoneIDCheckedAt = id, time.Now()
+	return nil
+}
+
+// configuredZoneID returns the zone ID set in the config for this zone, if any.
+func (a *app) configuredZoneID() string {
+	if a.zoneConf != nil {
+		return a.zoneConf.ZoneID
+	}
+	return a.conf.ZoneID
+}
+
+// lookupZoneID asks Cloudflare for the zone named a.conf.Domain. If the
+// token can see several zones of that name (in different accounts), an active
+// one is preferred.
+func (a *app) lookupZoneID() (string, error) {
+	zones, err := a.cf().ListZones(a.apiContext(), a.conf.Domain)
+	if err != nil {
+		return "", err
+	}
+	var found string
+	for _, z := range zones {
+		if z.Name != a.conf.Domain {
+			continue
+		}
+		if z.Status == "active" {
+			return z.ID, nil
+		}
+		if found == "" {
+			found = z.ID
+		}
+	}
+	if found == "" {
+		return "", errors.New("zone ID not found for domain " + a.conf.Domain)
+	}
+	return found, nil
+}
+
+// initZoneIDs looks up the Cloudflare zone ID of every zone.
+func (a *app) initZoneIDs() error {
+	var errs []error
+	for _, z := range a.zones {
+		if err := z.getZoneID(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", z.conf.Domain, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// applyZone decides, from the shared readings, whether this zone's rule should
+// be on, and makes it so. It returns whether the rule is enabled afterwards
+// and the zone's own metrics.
+func (a *app) applyZone(readings []Reading, now time.Time) (ruleEnabled bool, metrics map[string]float64, err error) {
+	zs := a.zoneState()
+	window := a.activeWindow(now)
+	readings = a.zoneReadings(readings, window)
+	load := a.loadValue(readingMetrics(readings))
+
+	defer func() {
+		// bot_check_rule_active_seconds counts the seconds the rule was active
+		// during the interval this sample covers (1 minute under cron).
+		ruleActiveSeconds := 0.0
+		if ruleEnabled {
+			ruleActiveSeconds = 60
+			if a.daemon {
+				ruleActiveSeconds = a.interval.Seconds()
+			}
+		}
+		if err == nil {
+			if err := a.escalate(zs, ruleEnabled, load, now); err != nil {
+				slog.Warn("escalation", "zone", a.conf.Domain, "err", err)
+			}
+		}
+		metrics = map[string]float64{
+			"bot_check_rule_active_seconds": ruleActiveSeconds,
+			"bot_check_level":               0,
+			"under_attack_mode":             0,
+			"bot_check_override":            overrideMetric(zs),
+		}
+		if ruleEnabled {
+			metrics["bot_check_level"] = float64(zs.Level + 1)
+		}
+		if zs.PreviousSecurityLevel != "" {
+			metrics["under_attack_mode"] = 1
+		}
+	}()
+
+	verdict, reason := decide(readings)
+	verdict, reason = a.applyHysteresis(zs, verdict, reason, now)
+	verdict, reason = a.applyWindow(window, verdict, reason)
+	verdict, reason = a.applyOverride(zs, verdict, reason, now)
+	a.plan.decide(a.conf.Domain, verdict, reason)
+	switch verdict {
+	case Overload:
+		slog.Info("signal above threshold, enabling bot check rule", "reason", reason)
+		if zs.EnabledAt.IsZero() {
+			zs.Level, zs.LevelSince = 0, now
+		} else if a.stepLevel(zs, load, now) {
+			reason = fmt.Sprintf("escalation level %s (%s)", a.levelAction(zs), reason)
+		}
+		a.action = a.levelAction(zs)
+		if err := a.ensureMitigation(true, reason); err != nil {
+			return false, nil, fmt.Errorf("enabling bot check rule: %w", err)
+		}
+		if zs.EnabledAt.IsZero() {
+			zs.EnabledAt, zs.EnabledReason = now, reason
+		}
+		return true, nil, nil
+	case Recovered:
+		slog.Debug("all signals below threshold, disabling bot check rule")
+		if err := a.ensureMitigation(false, reason); err != nil {
+			return true, nil, fmt.Errorf("disabling bot check rule: %w", err)
+		}
+		if !zs.EnabledAt.IsZero() {
+			zs.DisabledAt = now
+		}
+		zs.EnabledAt, zs.EnabledReason = time.Time{}, ""
+		zs.Level, zs.LevelSince = 0, time.Time{}
+		return false, nil, nil
+	}
+	// Between thresholds: no change — check current state for metrics.
+	active, err := a.mitigationActive()
+	if err != nil {
+		return !zs.EnabledAt.IsZero(), nil, fmt.Errorf("checking bot check rule: %w", err)
+	}
+	if !active {
+		zs.EnabledAt, zs.EnabledReason = time.Time{}, ""
+		return false, nil, nil
+	}
+	if !zs.EnabledAt.IsZero() && a.mode() != modeRateLimit && a.stepLevel(zs, load, now) {
+		a.action = a.levelAction(zs)
+		if err := a.ensureBotCheck(true, fmt.Sprintf("escalation level %s (load %.2f)", a.action, load)); err != nil {
+			return true, nil, fmt.Errorf("changing escalation level: %w", err)
+		}
+	}
+	return true, nil, nil
+}
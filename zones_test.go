@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig_Zones(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		cfg     Config
+		wantErr string
+	}{
+		{"zones only", Config{ApiKey: "k", Zones: []ZoneConfig{{Domain: "a.example", RulesetID: "rs1"}}}, ""},
+		{"zone without ruleset", Config{ApiKey: "k", Zones: []ZoneConfig{{Domain: "a.example"}}}, ""},
+		{"zone missing domain", Config{ApiKey: "k", Zones: []ZoneConfig{{RulesetID: "rs1"}}}, "domain"},
+		{"duplicate zone", Config{ApiKey: "k", Zones: []ZoneConfig{{Domain: "a.example", RulesetID: "rs1"}, {Domain: "a.example", RulesetID: "rs2"}}}, "twice"},
+		{"no zones or domain", Config{ApiKey: "k"}, "domain"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data, _ := json.Marshal(tc.cfg)
+			fn := writeTempLoadFile(t, string(data))
+			err := newTestApp().loadConfig(fn)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("error = %v, want one mentioning %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestInitZones_AppliesZoneSettings(t *testing.T) {
+	a := newTestApp()
+	a.exemptDays = 9
+	a.dateFormat = "2006/01/02"
+	days := 3
+	a.conf.Zones = []ZoneConfig{
+		{Domain: "a.example", RulesetID: "rs1"},
+		{Domain: "b.example", RulesetID: "rs2", ExemptDays: &days, DateFormat: "2006-01-02"},
+	}
+	a.initZones()
+	if len(a.zones) != 2 {
+		t.Fatalf("got %d zones, want 2", len(a.zones))
+	}
+	za, zb := a.zones[0], a.zones[1]
+	if za.conf.Domain != "a.example" || za.conf.RulesetID != "rs1" || za.exemptDays != 9 || za.dateFormat != "2006/01/02" {
+		t.Errorf("zone a = %s %s %d %s, want defaults", za.conf.Domain, za.conf.RulesetID, za.exemptDays, za.dateFormat)
+	}
+	if zb.conf.Domain != "b.example" || zb.conf.RulesetID != "rs2" || zb.exemptDays != 3 || zb.dateFormat != "2006-01-02" {
+		t.Errorf("zone b = %s %s %d %s, want overrides", zb.conf.Domain, zb.conf.RulesetID, zb.exemptDays, zb.dateFormat)
+	}
+	if za.state != zb.state || za.state != a.state {
+		t.Error("zones should share one state")
+	}
+}
+
+func TestInitZones_SingleZone(t *testing.T) {
+	a := newTestApp()
+	a.initZones()
+	if len(a.zones) != 1 || a.zones[0] != a {
+		t.Errorf("without Zones, a.zones should be just a")
+	}
+}
+
+func TestRunOnce_EnablesEveryZone(t *testing.T) {
+	f := newFakeCF(t, "zm", "rs1", nil)
+	var rs2 []testRule
+	f.rulesets["rs2"] = &rs2
+	a := newDoItApp(t, f.ts, "10.00 8.00 6.00 5/200 12345", "zm", "")
+	a.conf.Zones = []ZoneConfig{
+		{Domain: "a.example", ZoneID: "zm", RulesetID: "rs1"},
+		{Domain: "b.example", ZoneID: "zm", RulesetID: "rs2"},
+	}
+	a.initZones()
+	if err := a.initZoneIDs(); err != nil {
+		t.Fatal(err)
+	}
+
+	enabled, err := a.runOnce()
+	if err != nil {
+		t.Fatalf("runOnce: %v", err)
+	}
+	if !enabled {
+		t.Error("runOnce reported the rule disabled")
+	}
+	if len(f.rules) != 1 || len(rs2) != 1 {
+		t.Errorf("rules = %d, %d; want one in each zone", len(f.rules), len(rs2))
+	}
+	if a.state.zone("a.example").EnabledAt.IsZero() || a.state.zone("b.example").EnabledAt.IsZero() {
+		t.Error("each zone should record when its rule was enabled")
+	}
+}
+
+func TestRunOnce_PerZoneLoadThresholds(t *testing.T) {
+	f := newFakeCF(t, "zm", "rs1", nil)
+	var rs2 []testRule
+	f.rulesets["rs2"] = &rs2
+	a := newDoItApp(t, f.ts, "10.00 8.00 6.00 5/200 12345", "zm", "")
+	a.conf.Zones = []ZoneConfig{
+		{Domain: "a.example", ZoneID: "zm", RulesetID: "rs1"},
+		{Domain: "b.example", ZoneID: "zm", RulesetID: "rs2", MaxLoad: 20},
+	}
+	a.initZones()
+	if err := a.initZoneIDs(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.runOnce(); err != nil {
+		t.Fatalf("runOnce: %v", err)
+	}
+	if len(f.rules) != 1 {
+		t.Errorf("zone a rules = %d, want 1 at load 10 with maxLoad 4.5", len(f.rules))
+	}
+	if len(rs2) != 0 {
+		t.Errorf("zone b rules = %d, want 0 at load 10 with maxLoad 20", len(rs2))
+	}
+}
+
+func TestRunOnce_ReportsLookupFailureBetweenThresholds(t *testing.T) {
+	f := newFakeCF(t, "z1", "rs1", nil)
+	f.fail[http.MethodGet] = true
+	a := newDoItApp(t, f.ts, "2.00 2.00 2.00 1/100 12345", "z1", "rs1")
+	if _, err := a.runOnce(); err == nil {
+		t.Error("runOnce succeeded, want the failed rule lookup")
+	}
+}
+
+func TestRunOnce_TagsMetricsByZone(t *testing.T) {
+	zones := map[string]bool{}
+	var untaggedLoad bool
+	metricsSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			ResourceMetrics []struct {
+				ScopeMetrics []struct {
+					Metrics []struct {
+						Name  string
+						Gauge struct {
+							DataPoints []struct {
+								Attributes []struct {
+									Key   string
+									Value struct{ StringValue string }
+								}
+							}
+						}
+					}
+				}
+			}
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		for _, m := range body.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+			for _, dp := range m.Gauge.DataPoints {
+				switch m.Name {
+				case "load_average":
+					untaggedLoad = len(dp.Attributes) == 0
+				case "bot_check_rule_active_seconds":
+					for _, kv := range dp.Attributes {
+						if kv.Key == "zone" {
+							zones[kv.Value.StringValue] = true
+						}
+					}
+				}
+			}
+		}
+	}))
+	defer metricsSrv.Close()
+
+	f := newFakeCF(t, "zm", "rs1", nil)
+	f.rulesets["rs2"] = &[]testRule{}
+	a := newDoItApp(t, f.ts, "2.00 1.50 1.20 3/100 12345", "zm", "")
+	a.conf.Zones = []ZoneConfig{
+		{Domain: "a.example", ZoneID: "zm", RulesetID: "rs1"},
+		{Domain: "b.example", ZoneID: "zm", RulesetID: "rs2"},
+	}
+	a.initZones()
+	if err := a.initZoneIDs(); err != nil {
+		t.Fatal(err)
+	}
+	a.conf.MetricsURL = metricsSrv.URL
+
+	if _, err := a.runOnce(); err != nil {
+		t.Fatalf("runOnce: %v", err)
+	}
+	if !untaggedLoad {
+		t.Error("host metrics such as load_average should not be tagged with a zone")
+	}
+	if !zones["a.example"] || !zones["b.example"] {
+		t.Errorf("rule metrics tagged with zones %v, want both", zones)
+	}
+}
+
+func TestWithLoadThresholds_ScalesPerCPU(t *testing.T) {
+	readings := []Reading{{Signal: "load", Verdict: Overload, load: &loadSample{la: []float64{6, 6, 6}, cpus: 4}}}
+	got := withLoadThresholds(readings, 2, 1)
+	if got[0].Verdict != Neutral {
+		t.Errorf("verdict = %s, want neutral for load 6 on 4 CPUs with max 2 per CPU", got[0].Verdict)
+	}
+	if readings[0].Verdict != Overload {
+		t.Error("withLoadThresholds modified its input")
+	}
+}
+
+func newZoneLookupApp(t *testing.T, f *fakeCF) *app {
+	t.Helper()
+	a := appForServer(f.ts, "", "rs1")
+	a.conf.Domain = "example.com"
+	a.zoneCacheTTL = time.Hour
+	return a
+}
+
+func TestGetZoneID_FiltersByName(t *testing.T) {
+	f := newFakeCF(t, "zid1", "rs1", nil)
+	f.zones = append([]map[string]string{{"id": "other", "name": "other.example", "status": "active"}}, f.zones...)
+	a := newZoneLookupApp(t, f)
+	if err := a.getZoneID(); err != nil {
+		t.Fatalf("getZoneID: %v", err)
+	}
+	if a.zoneId != "zid1" {
+		t.Errorf("zoneId = %q, want zid1", a.zoneId)
+	}
+}
+
+func TestGetZoneID_FollowsPagination(t *testing.T) {
+	f := newFakeCF(t, "zid2", "rs1", nil)
+	f.zones = []map[string]string{
+		{"id": "pending-1", "name": "example.com", "status": "pending"},
+		{"id": "pending-2", "name": "example.com", "status": "pending"},
+		{"id": "zid2", "name": "example.com", "status": "active"},
+	}
+	f.perPage = 1
+	a := newZoneLookupApp(t, f)
+	if err := a.getZoneID(); err != nil {
+		t.Fatalf("getZoneID: %v", err)
+	}
+	if a.zoneId != "zid2" {
+		t.Errorf("zoneId = %q, want the active zone on page 3", a.zoneId)
+	}
+	if f.zoneLookups != 3 {
+		t.Errorf("zone list requests = %d, want 3", f.zoneLookups)
+	}
+}
+
+func TestGetZoneID_NotFound(t *testing.T) {
+	f := newFakeCF(t, "zid3", "rs1", nil)
+	a := newZoneLookupApp(t, f)
+	a.conf.Domain = "missing.example"
+	if err := a.getZoneID(); err == nil {
+		t.Error("expected error for an unknown domain")
+	}
+}
+
+func TestGetZoneID_ConfiguredID(t *testing.T) {
+	f := newFakeCF(t, "zid4", "rs1", nil)
+	a := newZoneLookupApp(t, f)
+	a.conf.ZoneID = "explicit"
+	if err := a.getZoneID(); err != nil || a.zoneId != "explicit" {
+		t.Errorf("getZoneID = %v, zoneId %q; want explicit", err, a.zoneId)
+	}
+	if f.zoneLookups != 0 {
+		t.Errorf("zone list requests = %d, want none", f.zoneLookups)
+	}
+}
+
+func TestGetZoneID_CachedInStateFile(t *testing.T) {
+	f := newFakeCF(t, "zid5", "rs1", nil)
+	stateFile := writeTempLoadFile(t, "")
+	os.Remove(stateFile)
+
+	a := newZoneLookupApp(t, f)
+	a.stateFile = stateFile
+	if err := a.getZoneID(); err != nil {
+		t.Fatalf("getZoneID: %v", err)
+	}
+	if err := saveState(a.stateFile, a.state); err != nil {
+		t.Fatalf("saveState: %v", err)
+	}
+
+	// A later run reads the ID from the state file.
+	b := newZoneLookupApp(t, f)
+	b.stateFile = stateFile
+	if err := b.getZoneID(); err != nil || b.zoneId != "zid5" {
+		t.Errorf("getZoneID = %v, zoneId %q; want zid5", err, b.zoneId)
+	}
+	if f.zoneLookups != 1 {
+		t.Errorf("zone list requests = %d, want 1", f.zoneLookups)
+	}
+
+	// Once the TTL has passed it is looked up again.
+	b.state.zone("example.com").ZoneIDCheckedAt = time.Now().Add(-2 * time.Hour)
+	if err := b.getZoneID(); err != nil {
+		t.Fatalf("getZoneID: %v", err)
+	}
+	if f.zoneLookups != 2 {
+		t.Errorf("zone list requests = %d, want 2 after the cache expired", f.zoneLookups)
+	}
+}
+
+func TestGetZoneID_ZoneConfigID(t *testing.T) {
+	a := newTestApp()
+	a.conf.Zones = []ZoneConfig{{Domain: "a.example", ZoneID: "za"}}
+	a.initZones()
+	if err := a.initZoneIDs(); err != nil || a.zones[0].zoneId != "za" {
+		t.Errorf("initZoneIDs = %v, zoneId %q; want za", err, a.zones[0].zoneId)
+	}
+}